@@ -0,0 +1,73 @@
+// Copyright 2015-2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codec
+
+import (
+	"encoding"
+	"fmt"
+)
+
+// binary codec name and id
+const (
+	NAME_BINARY = "binary"
+	ID_BINARY   = 'b'
+)
+
+func init() {
+	Reg(new(BinaryCodec))
+}
+
+// BinaryCodec binary codec, which delegates to
+// encoding.BinaryMarshaler and encoding.BinaryUnmarshaler.
+type BinaryCodec struct{}
+
+// Name returns codec name.
+func (BinaryCodec) Name() string {
+	return NAME_BINARY
+}
+
+// Id returns codec id.
+func (BinaryCodec) Id() byte {
+	return ID_BINARY
+}
+
+// ContentType returns the MIME type of the encoding.
+func (BinaryCodec) ContentType() string {
+	return "application/octet-stream"
+}
+
+// Marshal returns the binary encoding of v,
+// v must implement encoding.BinaryMarshaler.
+func (BinaryCodec) Marshal(v interface{}) ([]byte, error) {
+	if m, ok := v.(encoding.BinaryMarshaler); ok {
+		return m.MarshalBinary()
+	}
+	return nil, fmt.Errorf("binary codec: %T does not implement encoding.BinaryMarshaler", v)
+}
+
+// CanMarshal reports whether v implements encoding.BinaryMarshaler.
+func (BinaryCodec) CanMarshal(v interface{}) bool {
+	_, ok := v.(encoding.BinaryMarshaler)
+	return ok
+}
+
+// Unmarshal parses the binary-encoded data and stores the result
+// in v, which must implement encoding.BinaryUnmarshaler.
+func (BinaryCodec) Unmarshal(data []byte, v interface{}) error {
+	if m, ok := v.(encoding.BinaryUnmarshaler); ok {
+		return m.UnmarshalBinary(data)
+	}
+	return fmt.Errorf("binary codec: %T does not implement encoding.BinaryUnmarshaler", v)
+}
@@ -0,0 +1,54 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+type point struct {
+	X, Y int32
+}
+
+func (p point) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, uint32(p.X))
+	binary.BigEndian.PutUint32(b[4:], uint32(p.Y))
+	return b, nil
+}
+
+func (p *point) UnmarshalBinary(data []byte) error {
+	if len(data) != 8 {
+		return errors.New("point: invalid length")
+	}
+	p.X = int32(binary.BigEndian.Uint32(data))
+	p.Y = int32(binary.BigEndian.Uint32(data[4:]))
+	return nil
+}
+
+func TestBinary(t *testing.T) {
+	c, err := GetByName(NAME_BINARY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := point{X: 1, Y: -2}
+	data, err := c.Marshal(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b point
+	if err = c.Unmarshal(data, &b); err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Fatalf("get: %#v, but expect: %#v", b, a)
+	}
+
+	if _, err = c.Marshal(struct{}{}); err == nil || !strings.Contains(err.Error(), "encoding.BinaryMarshaler") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = c.Unmarshal(data, b); err == nil || !strings.Contains(err.Error(), "encoding.BinaryUnmarshaler") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -18,6 +18,11 @@ package codec
 
 import (
 	"fmt"
+	"io"
+	"mime"
+	"sort"
+	"strings"
+	"sync"
 )
 
 // Codec makes the body's Encoder and Decoder
@@ -33,12 +38,43 @@ type Codec interface {
 	Unmarshal(data []byte, v interface{}) error
 }
 
+// StreamCodec is an optional interface of Codec,
+// which encodes and decodes the body without the intermediate []byte.
+type StreamCodec interface {
+	Codec
+	// EncodeTo writes the encoding of v to w.
+	EncodeTo(w io.Writer, v interface{}) error
+	// DecodeFrom reads the encoded data from r and stores the result
+	// in the value pointed to by v.
+	DecodeFrom(r io.Reader, v interface{}) error
+}
+
+// ContentTyper is an optional interface of Codec,
+// which advertises the MIME type of the encoding, such as "application/json",
+// for bridging to HTTP.
+type ContentTyper interface {
+	// ContentType returns the MIME type of the encoding.
+	ContentType() string
+}
+
+// BodyChecker is an optional interface of Codec,
+// which reports whether a body can be marshalled without marshalling it,
+// so that the mismatched body is rejected with a clear error before writing.
+// Note: the codecs accepting any value, such as JSON, need not implement it.
+type BodyChecker interface {
+	// CanMarshal reports whether the type of v is supported by Marshal.
+	CanMarshal(v interface{}) bool
+}
+
 var codecMap = struct {
-	idMap   map[byte]Codec
-	nameMap map[string]Codec
+	idMap       map[byte]Codec
+	nameMap     map[string]Codec
+	reservedMap map[byte]string
+	rwMu        sync.RWMutex
 }{
-	idMap:   make(map[byte]Codec),
-	nameMap: make(map[string]Codec),
+	idMap:       make(map[byte]Codec),
+	nameMap:     make(map[string]Codec),
+	reservedMap: make(map[byte]string),
 }
 
 const (
@@ -48,24 +84,83 @@ const (
 	NilCodecName string = ""
 )
 
-// Reg registers Codec.
+// Codec id ranges.
+// Note:
+//  [1,127] is reserved for the built-in and well-known codecs,
+//  the built-in codecs use the ASCII letters such as 'j' and 'p';
+//  [128,255] is for the extension codecs, preferably allocated by ReserveId.
+const (
+	MinExtensionCodecId byte = 128
+	MaxExtensionCodecId byte = 255
+)
+
+// Reg registers Codec, and panics on error.
+// Note: see Register for the errors.
 func Reg(codec Codec) {
+	if err := Register(codec); err != nil {
+		panic(err.Error())
+	}
+}
+
+// Register registers Codec.
+// Note:
+//  returns error if the id or name is already registered,
+//  or the id is reserved under another name;
+//  it is safe for concurrent use with the lookup functions.
+func Register(codec Codec) error {
 	if codec.Id() == NilCodecId {
-		panic(fmt.Sprintf("codec id can not be %d", NilCodecId))
+		return fmt.Errorf("codec id can not be %d", NilCodecId)
 	}
-	if _, ok := codecMap.idMap[codec.Id()]; ok {
-		panic(fmt.Sprintf("multi-register codec id: %d", codec.Id()))
+	codecMap.rwMu.Lock()
+	defer codecMap.rwMu.Unlock()
+	if old, ok := codecMap.idMap[codec.Id()]; ok {
+		return fmt.Errorf("multi-register codec id: %d (registered by %q, now %q)", codec.Id(), old.Name(), codec.Name())
 	}
 	if _, ok := codecMap.nameMap[codec.Name()]; ok {
-		panic("multi-register codec name: " + codec.Name())
+		return fmt.Errorf("multi-register codec name: %s", codec.Name())
+	}
+	if name, ok := codecMap.reservedMap[codec.Id()]; ok && name != codec.Name() {
+		return fmt.Errorf("codec id %d is reserved by %q, can not be registered by %q", codec.Id(), name, codec.Name())
 	}
 	codecMap.idMap[codec.Id()] = codec
 	codecMap.nameMap[codec.Name()] = codec
+	return nil
+}
+
+// ReserveId reserves the lowest free extension codec id for the codec name,
+// so that the extension codecs do not hard-code conflicting ids.
+// Note:
+//  calling it again with the same name returns the same id;
+//  returns error if the name is already registered or no id is available.
+func ReserveId(codecName string) (byte, error) {
+	codecMap.rwMu.Lock()
+	defer codecMap.rwMu.Unlock()
+	for id, name := range codecMap.reservedMap {
+		if name == codecName {
+			return id, nil
+		}
+	}
+	if _, ok := codecMap.nameMap[codecName]; ok {
+		return NilCodecId, fmt.Errorf("codec name is already registered: %s", codecName)
+	}
+	for id := int(MinExtensionCodecId); id <= int(MaxExtensionCodecId); id++ {
+		if _, ok := codecMap.idMap[byte(id)]; ok {
+			continue
+		}
+		if _, ok := codecMap.reservedMap[byte(id)]; ok {
+			continue
+		}
+		codecMap.reservedMap[byte(id)] = codecName
+		return byte(id), nil
+	}
+	return NilCodecId, fmt.Errorf("no free codec id for: %s", codecName)
 }
 
 // Get returns Codec by id.
 func Get(codecId byte) (Codec, error) {
+	codecMap.rwMu.RLock()
 	codec, ok := codecMap.idMap[codecId]
+	codecMap.rwMu.RUnlock()
 	if !ok {
 		return nil, fmt.Errorf("unsupported codec id: %d", codecId)
 	}
@@ -74,13 +169,72 @@ func Get(codecId byte) (Codec, error) {
 
 // GetByName returns Codec by name.
 func GetByName(codecName string) (Codec, error) {
+	codecMap.rwMu.RLock()
 	codec, ok := codecMap.nameMap[codecName]
+	codecMap.rwMu.RUnlock()
 	if !ok {
 		return nil, fmt.Errorf("unsupported codec name: %s", codecName)
 	}
 	return codec, nil
 }
 
+// GetByContentType returns the Codec whose ContentType matches the MIME type,
+// such as the Content-Type of an HTTP request.
+// Note:
+//  the parameters, such as charset, are ignored, and the match is case-insensitive;
+//  if several codecs match, the one with the smallest id is returned.
+func GetByContentType(contentType string) (Codec, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("invalid content type: %q: %v", contentType, err)
+	}
+	for _, codec := range ListAll() {
+		if ct, ok := codec.(ContentTyper); ok && strings.EqualFold(ct.ContentType(), mediaType) {
+			return codec, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported content type: %s", mediaType)
+}
+
+// MustGetByName returns Codec by name.
+// Note:
+//  panic if the codec name is not registered,
+//  the message lists the available codec names.
+func MustGetByName(codecName string) Codec {
+	codec, err := GetByName(codecName)
+	if err == nil {
+		return codec
+	}
+	list := ListAll()
+	names := make([]string, len(list))
+	for i, c := range list {
+		names[i] = c.Name()
+	}
+	panic(fmt.Sprintf("codec: no codec registered under name %q (available: %v)", codecName, names))
+}
+
+// ListAll returns all registered codecs sorted by id.
+func ListAll() []Codec {
+	codecMap.rwMu.RLock()
+	list := make([]Codec, 0, len(codecMap.idMap))
+	for _, codec := range codecMap.idMap {
+		list = append(list, codec)
+	}
+	codecMap.rwMu.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Id() < list[j].Id()
+	})
+	return list
+}
+
+// Exists reports whether the codec name is registered.
+func Exists(codecName string) bool {
+	codecMap.rwMu.RLock()
+	_, ok := codecMap.nameMap[codecName]
+	codecMap.rwMu.RUnlock()
+	return ok
+}
+
 // Marshal returns the encoding of v.
 func Marshal(codecId byte, v interface{}) ([]byte, error) {
 	codec, err := Get(codecId)
@@ -0,0 +1,218 @@
+package codec
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type testCodec struct {
+	JsonCodec
+	id   byte
+	name string
+}
+
+func (t *testCodec) Id() byte     { return t.id }
+func (t *testCodec) Name() string { return t.name }
+
+// registerOnce registers the codec, which may be registered by the previous run of -count.
+func registerOnce(t *testing.T, c *testCodec) {
+	if err := Register(c); err != nil {
+		if old, _ := Get(c.id); old == nil || old.Name() != c.name {
+			t.Error(err)
+		}
+	}
+}
+
+func TestConcurrentReg(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			registerOnce(t, &testCodec{id: byte(200 + i), name: fmt.Sprintf("test-concurrent-%d", i)})
+		}(i)
+		go func() {
+			defer wg.Done()
+			if _, err := GetByName(NAME_JSON); err != nil {
+				t.Error(err)
+			}
+			if _, err := Get(ID_JSON); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	for i := 0; i < 10; i++ {
+		if _, err := Get(byte(200 + i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRegisterError(t *testing.T) {
+	if err := Register(&testCodec{id: ID_JSON, name: "test-register-error"}); err == nil {
+		t.Fatal("expect error on the duplicate codec id")
+	}
+	if err := Register(&testCodec{id: NilCodecId, name: "test-register-nil"}); err == nil {
+		t.Fatal("expect error on the nil codec id")
+	}
+	if Exists("test-register-error") || Exists("test-register-nil") {
+		t.Fatal("the failed codecs should not be registered")
+	}
+}
+
+func TestDuplicateReg(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expect panic on the duplicate codec id")
+		}
+	}()
+	Reg(&testCodec{id: ID_JSON, name: "test-duplicate"})
+}
+
+func TestListAll(t *testing.T) {
+	if !Exists(NAME_JSON) || !Exists(NAME_PROTOBUF) {
+		t.Fatal("the default codecs should be registered")
+	}
+	registerOnce(t, &testCodec{id: 250, name: "test-list"})
+	if !Exists("test-list") {
+		t.Fatal("test-list should be registered")
+	}
+	list := ListAll()
+	var found bool
+	for i, c := range list {
+		if i > 0 && list[i-1].Id() >= c.Id() {
+			t.Fatalf("the list is not sorted by id: %d, %d", list[i-1].Id(), c.Id())
+		}
+		if c.Name() == "test-list" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("test-list is not in the list")
+	}
+}
+
+func TestMustGetByName(t *testing.T) {
+	if c := MustGetByName(NAME_JSON); c.Id() != ID_JSON {
+		t.Fatalf("got codec id %d, want %d", c.Id(), ID_JSON)
+	}
+	defer func() {
+		msg, _ := recover().(string)
+		if !strings.Contains(msg, `no codec registered under name "test-unknown"`) {
+			t.Fatalf("unexpected panic message: %q", msg)
+		}
+		if !strings.Contains(msg, NAME_JSON) || !strings.Contains(msg, NAME_PROTOBUF) {
+			t.Fatalf("the panic message should list the available names: %q", msg)
+		}
+	}()
+	MustGetByName("test-unknown")
+	t.Fatal("MustGetByName should panic for an unknown name")
+}
+
+func TestReserveId(t *testing.T) {
+	id, err := ReserveId("test-reserve-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id < MinExtensionCodecId {
+		t.Fatalf("reserved id %d is not in the extension range", id)
+	}
+	if again, _ := ReserveId("test-reserve-a"); again != id {
+		t.Fatalf("reserve again got %d, want %d", again, id)
+	}
+	id2, err := ReserveId("test-reserve-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id2 == id {
+		t.Fatalf("two names reserved the same id %d", id)
+	}
+	if _, err = ReserveId(NAME_JSON); err == nil {
+		t.Fatal("expect error reserving a registered name")
+	}
+
+	registerOnce(t, &testCodec{id: id, name: "test-reserve-a"})
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expect panic registering an id reserved by another name")
+			}
+		}()
+		Reg(&testCodec{id: id2, name: "test-reserve-c"})
+	}()
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expect panic on the second codec claiming the same id")
+			}
+		}()
+		Reg(&testCodec{id: id, name: "test-reserve-d"})
+	}()
+}
+
+func TestGetByContentType(t *testing.T) {
+	for ct, id := range map[string]byte{
+		"application/json":                  ID_JSON,
+		"Application/JSON; charset=utf-8":   ID_JSON,
+		"application/x-msgpack":             ID_MSGPACK,
+		"application/x-protobuf":            ID_PROTOBUF,
+		"application/x-www-form-urlencoded": ID_FORM,
+		"text/plain; charset=utf-8":         ID_PLAIN,
+	} {
+		c, err := GetByContentType(ct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Id() != id {
+			t.Fatalf("%s: got codec %q, want %q", ct, c.Id(), id)
+		}
+	}
+	for _, ct := range []string{"application/xml", "", "/json"} {
+		if _, err := GetByContentType(ct); err == nil {
+			t.Fatalf("%q: want the unsupported content type error", ct)
+		}
+	}
+}
+
+func TestBodyChecker(t *testing.T) {
+	type form struct{ A string }
+	for _, c := range []struct {
+		codec BodyChecker
+		v     interface{}
+		ok    bool
+	}{
+		{ProtoCodec{}, new(PbEmpty), true},
+		{ProtoCodec{}, struct{}{}, true},
+		{ProtoCodec{}, map[string]int{}, false},
+		{BinaryCodec{}, map[string]int{}, false},
+		{PlainCodec{}, 3.14, true},
+		{PlainCodec{}, new(string), true},
+		{PlainCodec{}, []int{1}, false},
+		{FormCodec{}, &form{}, true},
+		{FormCodec{}, map[string][]string{}, true},
+		{FormCodec{}, []string{}, false},
+	} {
+		if ok := c.codec.CanMarshal(c.v); ok != c.ok {
+			t.Fatalf("%T can marshal %T: got %v, want %v", c.codec, c.v, ok, c.ok)
+		}
+	}
+}
+
+func TestJsonEncodeTo(t *testing.T) {
+	v := map[string]int{"a": 1}
+	want, err := JsonCodec{}.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = (JsonCodec{}).EncodeTo(&buf, v); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("EncodeTo: got %q, want %q", buf.Bytes(), want)
+	}
+}
@@ -48,6 +48,11 @@ func (FormCodec) Id() byte {
 	return ID_FORM
 }
 
+// ContentType returns the MIME type of the encoding.
+func (FormCodec) ContentType() string {
+	return "application/x-www-form-urlencoded"
+}
+
 // Marshal returns the url encoded date of v.
 func (FormCodec) Marshal(v interface{}) ([]byte, error) {
 	var b []byte
@@ -76,6 +81,19 @@ func (FormCodec) Marshal(v interface{}) ([]byte, error) {
 	return b, nil
 }
 
+// CanMarshal reports whether v is url.Values, map[string][]string or a struct.
+func (FormCodec) CanMarshal(v interface{}) bool {
+	switch v.(type) {
+	case nil, url.Values, *url.Values, map[string][]string, *map[string][]string:
+		return true
+	}
+	vv := reflect.ValueOf(v)
+	for vv.Kind() == reflect.Ptr {
+		vv = vv.Elem()
+	}
+	return vv.Kind() == reflect.Struct
+}
+
 func setStructToForm(q url.Values, val reflect.Value) {
 	for val.Kind() == reflect.Ptr {
 		val = val.Elem()
@@ -16,6 +16,7 @@ package codec
 
 import (
 	"encoding/json"
+	"io"
 )
 
 // json codec name and id
@@ -41,6 +42,11 @@ func (JsonCodec) Id() byte {
 	return ID_JSON
 }
 
+// ContentType returns the MIME type of the encoding.
+func (JsonCodec) ContentType() string {
+	return "application/json"
+}
+
 // Marshal returns the JSON encoding of v.
 func (JsonCodec) Marshal(v interface{}) ([]byte, error) {
 	return json.Marshal(v)
@@ -51,3 +57,20 @@ func (JsonCodec) Marshal(v interface{}) ([]byte, error) {
 func (JsonCodec) Unmarshal(data []byte, v interface{}) error {
 	return json.Unmarshal(data, v)
 }
+
+// EncodeTo writes the JSON encoding of v to w.
+// Note: the bytes are the same as Marshal, without the newline of json.Encoder.
+func (JsonCodec) EncodeTo(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// DecodeFrom reads the JSON-encoded value from r and stores it
+// in the value pointed to by v.
+func (JsonCodec) DecodeFrom(r io.Reader, v interface{}) error {
+	return json.NewDecoder(r).Decode(v)
+}
@@ -0,0 +1,89 @@
+package codec
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/henrylee2cn/teleport/xfer"
+)
+
+func TestJsonGzip(t *testing.T) {
+	type T struct {
+		Name  string
+		Tags  []string
+		Attrs map[string][]int
+	}
+	var (
+		a = T{
+			Name:  strings.Repeat("teleport", 64),
+			Tags:  []string{"a", "b"},
+			Attrs: map[string][]int{"x": {1, 2}, "y": {}},
+		}
+		b T
+	)
+	c, err := GetByName(NAME_JSONGZIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Id() != ID_JSONGZIP {
+		t.Fatalf("got id %q, want %q", c.Id(), ID_JSONGZIP)
+	}
+	data, err := c.Marshal(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		t.Fatalf("the encoding is not gzipped: [% x]", data[:2])
+	}
+	plain, _ := (JsonCodec{}).Marshal(a)
+	if len(data) >= len(plain) {
+		t.Fatalf("got %d bytes, want less than the plain JSON %d bytes", len(data), len(plain))
+	}
+	err = c.Unmarshal(data, &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(a, b) {
+		t.Fatalf("get: %#v, but expect: %#v", b, a)
+	}
+
+	// the pooled writer and reader are reusable
+	var m map[string]interface{}
+	data, err = c.Marshal(map[string]interface{}{"k": "v"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["k"] != "v" {
+		t.Fatalf("got %v, want map[k:v]", m)
+	}
+
+	if err = c.Unmarshal(plain, &b); err == nil {
+		t.Fatal("want the error of unmarshalling the plain JSON")
+	}
+}
+
+func TestJsonGzipMaxDecompressedBytes(t *testing.T) {
+	defer xfer.SetMaxDecompressedBytes(xfer.MaxDecompressedBytes())
+	xfer.SetMaxDecompressedBytes(1 << 20)
+	// a tiny body inflates into a huge JSON string
+	bomb, err := (JsonGzipCodec{}).Marshal(strings.Repeat("a", 1<<24))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bomb) > 1<<16 {
+		t.Fatalf("the gzip bomb takes %d bytes", len(bomb))
+	}
+	var s string
+	if err = (JsonGzipCodec{}).Unmarshal(bomb, &s); err != xfer.ErrDecompressedTooLarge {
+		t.Fatalf("got error %v, want %v", err, xfer.ErrDecompressedTooLarge)
+	}
+	xfer.SetMaxDecompressedBytes(0)
+	if err = (JsonGzipCodec{}).Unmarshal(bomb, &s); err != nil || len(s) != 1<<24 {
+		t.Fatalf("got %d bytes, error: %v", len(s), err)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2015-2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codec
+
+import (
+	"github.com/vmihailenco/msgpack"
+)
+
+// msgpack codec name and id
+const (
+	NAME_MSGPACK = "msgpack"
+	ID_MSGPACK   = 'm'
+)
+
+func init() {
+	Reg(new(MsgpackCodec))
+}
+
+// MsgpackCodec msgpack codec
+type MsgpackCodec struct{}
+
+// Name returns codec name.
+func (MsgpackCodec) Name() string {
+	return NAME_MSGPACK
+}
+
+// Id returns codec id.
+func (MsgpackCodec) Id() byte {
+	return ID_MSGPACK
+}
+
+// ContentType returns the MIME type of the encoding.
+func (MsgpackCodec) ContentType() string {
+	return "application/x-msgpack"
+}
+
+// Marshal returns the msgpack encoding of v.
+func (MsgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+// Unmarshal parses the msgpack-encoded data and stores the result
+// in the value pointed to by v.
+func (MsgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
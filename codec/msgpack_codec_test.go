@@ -0,0 +1,37 @@
+package codec
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMsgpack(t *testing.T) {
+	type T struct {
+		Name  string
+		Tags  []string
+		Attrs map[string][]int
+	}
+	var (
+		a = T{
+			Name:  "teleport",
+			Tags:  []string{"a", "b"},
+			Attrs: map[string][]int{"x": {1, 2}, "y": {}},
+		}
+		b T
+	)
+	c, err := GetByName(NAME_MSGPACK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := c.Marshal(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Unmarshal(data, &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(a, b) {
+		t.Fatalf("get: %#v, but expect: %#v", b, a)
+	}
+}
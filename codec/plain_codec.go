@@ -45,6 +45,11 @@ func (PlainCodec) Id() byte {
 	return ID_PLAIN
 }
 
+// ContentType returns the MIME type of the encoding.
+func (PlainCodec) ContentType() string {
+	return "text/plain"
+}
+
 // Marshal returns the string encoding of v.
 func (PlainCodec) Marshal(v interface{}) ([]byte, error) {
 	var b []byte
@@ -98,6 +103,16 @@ func formatProperType(v reflect.Value) (string, bool) {
 	}
 }
 
+// CanMarshal reports whether v is a string, bytes or a basic type.
+func (PlainCodec) CanMarshal(v interface{}) bool {
+	switch v.(type) {
+	case nil, string, *string, []byte, *[]byte:
+		return true
+	}
+	_, ok := formatProperType(reflect.ValueOf(v))
+	return ok
+}
+
 // Unmarshal parses the string-encoded data and stores the result
 // in the value pointed to by v.
 func (PlainCodec) Unmarshal(data []byte, v interface{}) error {
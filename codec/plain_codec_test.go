@@ -31,3 +31,28 @@ func TestPlain(t *testing.T) {
 		}
 	}
 }
+
+func TestPlainBytes(t *testing.T) {
+	c := new(PlainCodec)
+	src := []byte("raw bytes")
+	data, err := c.Marshal(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if &data[0] != &src[0] {
+		t.Fatal("marshaling []byte should not copy")
+	}
+	var dst []byte
+	if err = c.Unmarshal(data, &dst); err != nil {
+		t.Fatal(err)
+	}
+	if string(dst) != string(src) {
+		t.Fatalf("get: %q, but expect: %q", dst, src)
+	}
+	if _, err = c.Marshal(map[string]int{}); err == nil {
+		t.Fatal("expect type error")
+	}
+	if err = c.Unmarshal(data, new(map[string]int)); err == nil {
+		t.Fatal("expect type error")
+	}
+}
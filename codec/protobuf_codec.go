@@ -43,11 +43,25 @@ func (ProtoCodec) Id() byte {
 	return ID_PROTOBUF
 }
 
+// ContentType returns the MIME type of the encoding.
+func (ProtoCodec) ContentType() string {
+	return "application/x-protobuf"
+}
+
 // Marshal returns the Protobuf encoding of v.
 func (ProtoCodec) Marshal(v interface{}) ([]byte, error) {
 	return ProtoMarshal(v)
 }
 
+// CanMarshal reports whether v implements proto.Message or is an empty struct.
+func (ProtoCodec) CanMarshal(v interface{}) bool {
+	switch v.(type) {
+	case proto.Message, nil, *struct{}, struct{}:
+		return true
+	}
+	return false
+}
+
 // Unmarshal parses the Protobuf-encoded data and stores the result
 // in the value pointed to by v.
 func (ProtoCodec) Unmarshal(data []byte, v interface{}) error {
@@ -0,0 +1,45 @@
+package codec
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/henrylee2cn/teleport/proto/pbproto/pb"
+)
+
+func TestProtobuf(t *testing.T) {
+	var (
+		a = &pb.Payload{
+			Seq:       "1",
+			Ptype:     1,
+			Uri:       "/a/b",
+			Meta:      []byte("k=v"),
+			BodyCodec: ID_PROTOBUF,
+			Body:      []byte("teleport"),
+		}
+		b = new(pb.Payload)
+	)
+	c, err := GetByName(NAME_PROTOBUF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := c.Marshal(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Unmarshal(data, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(a, b) {
+		t.Fatalf("get: %#v, but expect: %#v", b, a)
+	}
+
+	if _, err = c.Marshal(map[string]int{}); err == nil || !strings.Contains(err.Error(), "proto.Message") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = c.Unmarshal(data, new(map[string]int)); err == nil || !strings.Contains(err.Error(), "proto.Message") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
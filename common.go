@@ -17,12 +17,14 @@ package tp
 import (
 	"context"
 	"crypto/tls"
+	"encoding/hex"
 	"os"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/henrylee2cn/goutil"
+	"github.com/henrylee2cn/goutil/errors"
 	"github.com/henrylee2cn/goutil/pool"
 	"github.com/henrylee2cn/teleport/codec"
 	"github.com/henrylee2cn/teleport/socket"
@@ -38,7 +40,8 @@ const (
 )
 
 // TypeText returns the packet type text.
-// If the type is undefined returns 'Undefined'.
+// If the type is not built-in, returns the name registered by socket.RegPtypeName,
+// or 'Undefined' if it is not registered.
 func TypeText(typ byte) string {
 	switch typ {
 	case TypeCall:
@@ -48,10 +51,57 @@ func TypeText(typ byte) string {
 	case TypePush:
 		return "PUSH"
 	default:
+		if name := socket.PtypeName(typ); name != "" {
+			return name
+		}
 		return "Undefined"
 	}
 }
 
+func init() {
+	for _, typ := range []byte{TypeCall, TypeReply, TypePush} {
+		socket.ReservePtypeName(typ, TypeText(typ))
+	}
+	// the metadata set per sending is not a part of the request
+	socket.RegTransportMetaKey(MetaCreatedAt)
+	socket.RegTransportMetaKey(MetaRealIp)
+}
+
+// Header validation errors
+var (
+	ErrUnknownType = errors.New("invalid header: unknown packet type")
+	ErrEmptySeq    = errors.New("invalid header: empty seq")
+	ErrEmptyUri    = errors.New("invalid header: empty URI path")
+)
+
+// ValidateHeader checks the packet header.
+// Note:
+//  the type must be one of TypeCall, TypeReply and TypePush;
+//  the seq can not be empty for CALL and REPLY;
+//  the URI path can not be empty for CALL and PUSH.
+func ValidateHeader(header socket.Header) error {
+	switch header.Ptype() {
+	case TypeCall:
+		if len(header.Seq()) == 0 {
+			return ErrEmptySeq
+		}
+		if len(header.UriObject().Path) == 0 {
+			return ErrEmptyUri
+		}
+	case TypeReply:
+		if len(header.Seq()) == 0 {
+			return ErrEmptySeq
+		}
+	case TypePush:
+		if len(header.UriObject().Path) == 0 {
+			return ErrEmptyUri
+		}
+	default:
+		return ErrUnknownType
+	}
+	return nil
+}
+
 // Internal Framework Rerror code.
 // Note: Recommended custom code is greater than 1000.
 //  unknown error code: -1.
@@ -144,10 +194,31 @@ const (
 	// MetaRealIp real IP metadata key
 	MetaRealIp = "X-Real-IP"
 	// MetaAcceptBodyCodec the key of body codec that the sender wishes to accept
-	MetaAcceptBodyCodec = "X-Accept-Body-Codec"
+	MetaAcceptBodyCodec = socket.MetaAcceptBodyCodec
+	// MetaCreatedAt the key of packet creation time in unix nanoseconds
+	MetaCreatedAt = "X-Created-At"
+	// MetaTraceId the key of distributed tracing trace id in hex
+	MetaTraceId = socket.MetaTraceId
+	// MetaSpanId the key of distributed tracing span id in hex
+	MetaSpanId = socket.MetaSpanId
+	// MetaIdempotencyKey the key of the idempotency key used to dedupe the retried packets
+	MetaIdempotencyKey = "X-Idempotency-Key"
+)
+
+// Max length of distributed tracing ids
+const (
+	MaxTraceIdLen = 16
+	MaxSpanIdLen  = 8
+)
+
+var (
+	// ErrTraceIdTooLong the trace id is longer than MaxTraceIdLen bytes.
+	ErrTraceIdTooLong = errors.New("trace id is longer than 16 bytes")
+	// ErrSpanIdTooLong the span id is longer than MaxSpanIdLen bytes.
+	ErrSpanIdTooLong = errors.New("span id is longer than 8 bytes")
 )
 
-// WithRerror sets the real IP to metadata.
+// WithRerror sets the reply error to metadata.
 func WithRerror(rerr *Rerror) socket.PacketSetting {
 	b, _ := rerr.MarshalJSON()
 	if len(b) == 0 {
@@ -185,6 +256,95 @@ func GetAcceptBodyCodec(meta *utils.Args) (byte, bool) {
 	return c, c != codec.NilCodecId
 }
 
+// WithStamp sets the current time in unix nanoseconds to metadata.
+// Note: it is used to measure the one-way latency of the packet.
+func WithStamp() socket.PacketSetting {
+	return func(p *socket.Packet) {
+		p.Meta().Set(MetaCreatedAt, strconv.FormatInt(time.Now().UnixNano(), 10))
+	}
+}
+
+// GetCreatedAt gets the packet creation time set by WithStamp.
+func GetCreatedAt(meta *utils.Args) (time.Time, bool) {
+	s := meta.Peek(MetaCreatedAt)
+	if len(s) == 0 {
+		return time.Time{}, false
+	}
+	n, err := strconv.ParseInt(goutil.BytesToString(s), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, n), true
+}
+
+// GetPacketAge returns the time elapsed since the packet was stamped by WithStamp.
+func GetPacketAge(meta *utils.Args) (time.Duration, bool) {
+	createdAt, ok := GetCreatedAt(meta)
+	if !ok {
+		return 0, false
+	}
+	return time.Since(createdAt), true
+}
+
+// WithTrace returns the setting of the distributed tracing trace id and span id to metadata.
+// NOTE:
+//  return ErrTraceIdTooLong if traceId is longer than MaxTraceIdLen,
+//  or ErrSpanIdTooLong if spanId is longer than MaxSpanIdLen.
+func WithTrace(traceId, spanId []byte) (socket.PacketSetting, error) {
+	if len(traceId) > MaxTraceIdLen {
+		return nil, ErrTraceIdTooLong
+	}
+	if len(spanId) > MaxSpanIdLen {
+		return nil, ErrSpanIdTooLong
+	}
+	traceHex, spanHex := hex.EncodeToString(traceId), hex.EncodeToString(spanId)
+	return func(p *socket.Packet) {
+		p.Meta().Set(MetaTraceId, traceHex)
+		p.Meta().Set(MetaSpanId, spanHex)
+	}, nil
+}
+
+// GetTrace gets the distributed tracing trace id and span id set by WithTrace.
+func GetTrace(meta *utils.Args) (traceId, spanId []byte, err error) {
+	traceId, err = hex.DecodeString(goutil.BytesToString(meta.Peek(MetaTraceId)))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(traceId) > MaxTraceIdLen {
+		return nil, nil, ErrTraceIdTooLong
+	}
+	spanId, err = hex.DecodeString(goutil.BytesToString(meta.Peek(MetaSpanId)))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(spanId) > MaxSpanIdLen {
+		return nil, nil, ErrSpanIdTooLong
+	}
+	return traceId, spanId, nil
+}
+
+// WithIdempotencyKey sets the idempotency key to metadata,
+// so that the receiver can dedupe the retried packets.
+// Note: an empty key is treated as not present, and nothing is set.
+func WithIdempotencyKey(key string) socket.PacketSetting {
+	return func(p *socket.Packet) {
+		if key == "" {
+			p.Meta().Del(MetaIdempotencyKey)
+			return
+		}
+		p.Meta().Set(MetaIdempotencyKey, key)
+	}
+}
+
+// GetIdempotencyKey gets the idempotency key set by WithIdempotencyKey.
+func GetIdempotencyKey(meta *utils.Args) (string, bool) {
+	key := meta.Peek(MetaIdempotencyKey)
+	if len(key) == 0 {
+		return "", false
+	}
+	return string(key), true
+}
+
 // WithContext sets the packet handling context.
 //  func WithContext(ctx context.Context) socket.PacketSetting
 var WithContext = socket.WithContext
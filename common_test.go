@@ -0,0 +1,175 @@
+package tp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/henrylee2cn/teleport/socket"
+)
+
+func TestWithStamp(t *testing.T) {
+	p := socket.NewPacket()
+	if _, ok := GetPacketAge(p.Meta()); ok {
+		t.Fatal("expect no stamp")
+	}
+	p = socket.NewPacket(WithStamp())
+	age, ok := GetPacketAge(p.Meta())
+	if !ok || age < 0 {
+		t.Fatalf("age: %v, ok: %v", age, ok)
+	}
+}
+
+func TestWithTrace(t *testing.T) {
+	traceId := []byte("0123456789abcdef")
+	spanId := []byte("01234567")
+	setting, err := WithTrace(traceId, spanId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := socket.NewPacket(setting)
+	gotTraceId, gotSpanId, err := GetTrace(p.Meta())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(gotTraceId) != string(traceId) || string(gotSpanId) != string(spanId) {
+		t.Fatalf("trace id: %x, span id: %x", gotTraceId, gotSpanId)
+	}
+
+	p.Meta().Set(MetaTraceId, hex.EncodeToString(append(traceId, 'x')))
+	if _, _, err = GetTrace(p.Meta()); err != ErrTraceIdTooLong {
+		t.Fatalf("expect ErrTraceIdTooLong, got: %v", err)
+	}
+
+	if _, err = WithTrace(append(traceId, 'x'), spanId); err != ErrTraceIdTooLong {
+		t.Fatalf("expect ErrTraceIdTooLong, got: %v", err)
+	}
+	if _, err = WithTrace(traceId, append(spanId, 'x')); err != ErrSpanIdTooLong {
+		t.Fatalf("expect ErrSpanIdTooLong, got: %v", err)
+	}
+}
+
+func TestValidateHeader(t *testing.T) {
+	var cases = []struct {
+		ptype byte
+		seq   string
+		uri   string
+		err   error
+	}{
+		{TypeCall, "1", "/a", nil},
+		{TypeCall, "", "/a", ErrEmptySeq},
+		{TypeCall, "1", "", ErrEmptyUri},
+		{TypeReply, "1", "", nil},
+		{TypeReply, "", "/a", ErrEmptySeq},
+		{TypePush, "", "/a", nil},
+		{TypePush, "1", "?a=1", ErrEmptyUri},
+		{TypeUndefined, "1", "/a", ErrUnknownType},
+		{9, "1", "/a", ErrUnknownType},
+	}
+	for i, c := range cases {
+		p := socket.NewPacket(socket.WithPtype(c.ptype), socket.WithSeq(c.seq), socket.WithUri(c.uri))
+		if err := ValidateHeader(p); err != c.err {
+			t.Errorf("case %d: got %v, want %v", i, err, c.err)
+		}
+	}
+}
+
+func TestWithRerror(t *testing.T) {
+	p := socket.NewPacket()
+	if NewRerrorFromMeta(p.Meta()) != nil {
+		t.Fatal("a packet without the reply error is OK")
+	}
+	p = socket.NewPacket(WithRerror(NewRerror(CodeNotFound, CodeText(CodeNotFound), "no such handler")))
+	rerr := NewRerrorFromMeta(p.Meta())
+	if rerr == nil || rerr.Code != CodeNotFound || rerr.Message != "Not Found" || rerr.Reason != "no such handler" {
+		t.Fatalf("reply error: %v", rerr)
+	}
+}
+
+func TestTypeName(t *testing.T) {
+	for _, typ := range []byte{TypeCall, TypeReply, TypePush} {
+		if name := socket.PtypeName(typ); name != TypeText(typ) {
+			t.Fatalf("type %d name: %q", typ, name)
+		}
+		if got, ok := socket.PtypeByName(TypeText(typ)); !ok || got != typ {
+			t.Fatalf("type of %q: %d", TypeText(typ), got)
+		}
+	}
+}
+
+func TestWithIdempotencyKey(t *testing.T) {
+	p := socket.NewPacket(WithIdempotencyKey("order-1"))
+	var rw bytes.Buffer
+	proto := socket.NewRawProtoFunc(&rw)
+	if err := proto.Pack(p); err != nil {
+		t.Fatal(err)
+	}
+	q := socket.NewPacket()
+	if err := proto.Unpack(q); err != nil {
+		t.Fatal(err)
+	}
+	if key, ok := GetIdempotencyKey(q.Meta()); !ok || key != "order-1" {
+		t.Fatalf("key: %q, ok: %v", key, ok)
+	}
+
+	q.Reset()
+	if _, ok := GetIdempotencyKey(q.Meta()); ok {
+		t.Fatal("reset should clear the idempotency key")
+	}
+
+	p = socket.NewPacket(WithIdempotencyKey(""))
+	if p.Meta().Len() != 0 {
+		t.Fatalf("the empty key should not be encoded: %s", p.Meta().String())
+	}
+	if _, ok := GetIdempotencyKey(p.Meta()); ok {
+		t.Fatal("the empty key should be treated as not present")
+	}
+}
+
+func TestTypeTextRegistered(t *testing.T) {
+	// a fresh type for each run, the registration can not be undone
+	ptype := byte(0xe3)
+	for socket.PtypeName(ptype) != "" {
+		ptype++
+	}
+	if TypeText(ptype) != "Undefined" {
+		t.Fatalf("got %q", TypeText(ptype))
+	}
+	socket.RegPtypeName(ptype, "CUSTOM")
+	if TypeText(ptype) != "CUSTOM" {
+		t.Fatalf("got %q", TypeText(ptype))
+	}
+}
+
+func TestTypeReserved(t *testing.T) {
+	for _, reg := range []func(){
+		func() { socket.RegPtypeName(TypeCall, "X") },
+		func() { socket.RegPtypeName(0xe0, "CALL") },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("the built-in type and name should not be overwritten")
+				}
+			}()
+			reg()
+		}()
+	}
+	if socket.PtypeName(TypeCall) != "CALL" || socket.PtypeName(0xe0) != "" {
+		t.Fatal("the built-in type should keep its name")
+	}
+}
+
+func TestSemanticKeyStamp(t *testing.T) {
+	p := socket.NewPacket(socket.WithUri("/a"), WithStamp(), WithRealIp("10.0.0.1"))
+	time.Sleep(time.Millisecond)
+	// the retry is stamped again, and may be forwarded by another proxy
+	q := socket.NewPacket(socket.WithUri("/a"), WithStamp(), WithRealIp("10.0.0.2"))
+	if bytes.Equal(p.Meta().Peek(MetaCreatedAt), q.Meta().Peek(MetaCreatedAt)) {
+		t.Fatal("the retry should be stamped again")
+	}
+	if p.SemanticKey() != q.SemanticKey() {
+		t.Fatalf("the keys of the retried packets differ:\n%q\n%q", p.SemanticKey(), q.SemanticKey())
+	}
+}
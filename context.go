@@ -349,16 +349,22 @@ func (c *handlerCtx) setContext(ctx context.Context) {
 func (c *handlerCtx) binding(header socket.Header) (body interface{}) {
 	c.start = c.sess.timeNow()
 	c.pluginContainer = c.sess.peer.pluginContainer
+	switch err := ValidateHeader(header); err {
+	case nil:
+	case ErrUnknownType:
+		c.handleErr = rerrCodePtypeNotAllowed
+		return nil
+	default:
+		c.handleErr = rerrBadPacket.Copy().SetReason(err.Error())
+		return nil
+	}
 	switch header.Ptype() {
 	case TypeReply:
 		return c.bindReply(header)
 	case TypePush:
 		return c.bindPush(header)
-	case TypeCall:
-		return c.bindCall(header)
 	default:
-		c.handleErr = rerrCodePtypeNotAllowed
-		return nil
+		return c.bindCall(header)
 	}
 }
 
@@ -401,10 +407,6 @@ func (c *handlerCtx) bindPush(header socket.Header) interface{} {
 	}
 
 	u := header.UriObject()
-	if len(u.Path) == 0 {
-		c.handleErr = rerrBadPacket.Copy().SetReason("invalid URI for packet")
-		return nil
-	}
 
 	var ok bool
 	c.handler, ok = c.sess.getPushHandler(u.Path)
@@ -462,10 +464,6 @@ func (c *handlerCtx) bindCall(header socket.Header) interface{} {
 	}
 
 	u := header.UriObject()
-	if len(u.Path) == 0 {
-		c.handleErr = rerrBadPacket.Copy().SetReason("invalid URI for packet")
-		return nil
-	}
 
 	var ok bool
 	c.handler, ok = c.sess.getCallHandler(u.Path)
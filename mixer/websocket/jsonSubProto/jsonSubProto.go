@@ -59,14 +59,18 @@ func (j *jsonSubProto) Pack(p *socket.Packet) error {
 	if err != nil {
 		return err
 	}
+	bodyCodec, err := p.ResolveBodyCodec()
+	if err != nil {
+		return err
+	}
 	// do transfer pipe
-	bodyBytes, err = p.XferPipe().OnPack(bodyBytes)
+	bodyBytes, ids, err := p.XferPipe().OnPackIds(bodyBytes)
 	if err != nil {
 		return err
 	}
 	// marshal transfer pipe ids
-	var xferPipeIds = make([]int, p.XferPipe().Len())
-	for i, id := range p.XferPipe().Ids() {
+	var xferPipeIds = make([]int, len(ids))
+	for i, id := range ids {
 		xferPipeIds[i] = int(id)
 	}
 	xferPipeIdsBytes, err := json.Marshal(xferPipeIds)
@@ -80,7 +84,7 @@ func (j *jsonSubProto) Pack(p *socket.Packet) error {
 		p.Ptype(),
 		p.Uri(),
 		p.Meta().QueryString(),
-		p.BodyCodec(),
+		bodyCodec,
 		bytes.Replace(bodyBytes, []byte{'"'}, []byte{'\\', '"'}, -1),
 		xferPipeIdsBytes,
 	)
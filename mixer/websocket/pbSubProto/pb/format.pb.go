@@ -520,10 +520,13 @@ func skipFormat(dAtA []byte) (n int, err error) {
 					break
 				}
 			}
-			iNdEx += length
 			if length < 0 {
 				return 0, ErrInvalidLengthFormat
 			}
+			iNdEx += length
+			if iNdEx < 0 {
+				return 0, ErrInvalidLengthFormat
+			}
 			return iNdEx, nil
 		case 3:
 			for {
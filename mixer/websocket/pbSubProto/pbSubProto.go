@@ -54,8 +54,12 @@ func (psp *pbSubProto) Pack(p *socket.Packet) error {
 	if err != nil {
 		return err
 	}
+	bodyCodec, err := p.ResolveBodyCodec()
+	if err != nil {
+		return err
+	}
 	// do transfer pipe
-	bodyBytes, err = p.XferPipe().OnPack(bodyBytes)
+	bodyBytes, ids, err := p.XferPipe().OnPackIds(bodyBytes)
 	if err != nil {
 		return err
 	}
@@ -65,9 +69,9 @@ func (psp *pbSubProto) Pack(p *socket.Packet) error {
 		Ptype:     int32(p.Ptype()),
 		Uri:       p.Uri(),
 		Meta:      p.Meta().QueryString(),
-		BodyCodec: int32(p.BodyCodec()),
+		BodyCodec: int32(bodyCodec),
 		Body:      bodyBytes,
-		XferPipe:  p.XferPipe().Ids(),
+		XferPipe:  ids,
 	})
 	if err != nil {
 		return err
@@ -17,6 +17,7 @@ package proxy
 import (
 	"github.com/henrylee2cn/goutil"
 	tp "github.com/henrylee2cn/teleport"
+	"github.com/henrylee2cn/teleport/codec"
 	"github.com/henrylee2cn/teleport/socket"
 )
 
@@ -89,10 +90,12 @@ func (p *proxy) PostNewPeer(peer tp.EarlyPeer) error {
 func (p *proxy) call(ctx tp.UnknownCallCtx) (interface{}, *tp.Rerror) {
 	var (
 		label    ProxyLabel
-		settings = make([]socket.PacketSetting, 1, 8)
+		settings = make([]socket.PacketSetting, 2, 8)
 	)
 	label.SessionId = ctx.Session().Id()
 	settings[0] = tp.WithSeq(label.SessionId + "@" + ctx.Seq())
+	// forwards the body bytes with the original codec
+	settings[1] = tp.WithBodyCodec(ctx.GetBodyCodec())
 	ctx.VisitMeta(func(key, value []byte) {
 		settings = append(settings, tp.WithAddMeta(string(key), string(value)))
 	})
@@ -111,6 +114,9 @@ func (p *proxy) call(ctx tp.UnknownCallCtx) (interface{}, *tp.Rerror) {
 	callcmd.InputMeta().VisitAll(func(key, value []byte) {
 		ctx.SetMeta(goutil.BytesToString(key), goutil.BytesToString(value))
 	})
+	if bodyCodec := callcmd.InputBodyCodec(); bodyCodec != codec.NilCodecId {
+		ctx.SetBodyCodec(bodyCodec)
+	}
 	rerr := callcmd.Rerror()
 	if rerr != nil && rerr.Code < 200 && rerr.Code > 99 {
 		rerr.Code = tp.CodeBadGateway
@@ -122,10 +128,12 @@ func (p *proxy) call(ctx tp.UnknownCallCtx) (interface{}, *tp.Rerror) {
 func (p *proxy) push(ctx tp.UnknownPushCtx) *tp.Rerror {
 	var (
 		label    ProxyLabel
-		settings = make([]socket.PacketSetting, 1, 8)
+		settings = make([]socket.PacketSetting, 2, 8)
 	)
 	label.SessionId = ctx.Session().Id()
 	settings[0] = tp.WithSeq(label.SessionId + "@" + ctx.Seq())
+	// forwards the body bytes with the original codec
+	settings[1] = tp.WithBodyCodec(ctx.GetBodyCodec())
 	ctx.VisitMeta(func(key, value []byte) {
 		settings = append(settings, tp.WithAddMeta(string(key), string(value)))
 	})
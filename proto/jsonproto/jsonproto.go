@@ -77,6 +77,10 @@ func (j *jsonproto) Pack(p *socket.Packet) error {
 	if err != nil {
 		return err
 	}
+	bodyCodec, err := p.ResolveBodyCodec()
+	if err != nil {
+		return err
+	}
 
 	// marshal whole
 	var s = fmt.Sprintf(format,
@@ -84,16 +88,16 @@ func (j *jsonproto) Pack(p *socket.Packet) error {
 		p.Ptype(),
 		p.Uri(),
 		p.Meta().QueryString(),
-		p.BodyCodec(),
+		bodyCodec,
 		bytes.Replace(bodyBytes, []byte{'"'}, []byte{'\\', '"'}, -1),
 	)
 
 	// do transfer pipe
-	b, err := p.XferPipe().OnPack(goutil.StringToBytes(s))
+	b, ids, err := p.XferPipe().OnPackIds(goutil.StringToBytes(s))
 	if err != nil {
 		return err
 	}
-	xferPipeLen := p.XferPipe().Len()
+	xferPipeLen := len(ids)
 
 	// set size
 	p.SetSize(uint32(1 + xferPipeLen + len(b)))
@@ -102,7 +106,7 @@ func (j *jsonproto) Pack(p *socket.Packet) error {
 	var all = make([]byte, p.Size()+4)
 	binary.BigEndian.PutUint32(all, p.Size())
 	all[4] = byte(xferPipeLen)
-	copy(all[4+1:], p.XferPipe().Ids())
+	copy(all[4+1:], ids)
 	copy(all[4+1+xferPipeLen:], b)
 	_, err = j.w.Write(all)
 
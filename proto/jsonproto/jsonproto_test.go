@@ -1,11 +1,14 @@
 package jsonproto_test
 
 import (
+	"bytes"
 	"testing"
 	"time"
 
 	tp "github.com/henrylee2cn/teleport"
+	"github.com/henrylee2cn/teleport/codec"
 	"github.com/henrylee2cn/teleport/proto/jsonproto"
+	"github.com/henrylee2cn/teleport/socket"
 	"github.com/henrylee2cn/teleport/xfer/gzip"
 )
 
@@ -64,3 +67,20 @@ func (p *Push) Test(arg *map[string]interface{}) *tp.Rerror {
 	tp.Infof("receive push(%s):\narg: %#v\n", p.Ip(), arg)
 	return nil
 }
+
+func TestJsonProtoHasBody(t *testing.T) {
+	for _, body := range []interface{}{nil, &codec.PbEmpty{}} {
+		var buf bytes.Buffer
+		p := socket.NewPacket(socket.WithBodyCodec(codec.ID_PROTOBUF), socket.WithBody(body))
+		if err := jsonproto.NewJsonProtoFunc(&buf).Pack(p); err != nil {
+			t.Fatal(err)
+		}
+		p = socket.NewPacket()
+		if err := jsonproto.NewJsonProtoFunc(&buf).Unpack(p); err != nil {
+			t.Fatal(err)
+		}
+		if p.HasBody() != (body != nil) {
+			t.Fatalf("body %v: got HasBody %v", body, p.HasBody())
+		}
+	}
+}
@@ -471,10 +471,13 @@ func skipPayload(dAtA []byte) (n int, err error) {
 					break
 				}
 			}
-			iNdEx += length
 			if length < 0 {
 				return 0, ErrInvalidLengthPayload
 			}
+			iNdEx += length
+			if iNdEx < 0 {
+				return 0, ErrInvalidLengthPayload
+			}
 			return iNdEx, nil
 		case 3:
 			for {
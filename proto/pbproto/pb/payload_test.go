@@ -0,0 +1,24 @@
+package pb
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestSkipPayloadMalformed(t *testing.T) {
+	// field 15, length-delimited, with a varint length overflowing int
+	overflow := []byte{15<<3 | 2, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}
+	if n, err := skipPayload(overflow); err != ErrInvalidLengthPayload {
+		t.Fatalf("got %d, %v, want error %v", n, err, ErrInvalidLengthPayload)
+	}
+	rd := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		data := make([]byte, 1+rd.Intn(16))
+		rd.Read(data)
+		data[0] = data[0]&^7 | 2
+		if n, err := skipPayload(data); err == nil && n < 0 {
+			t.Fatalf("data %x: negative index %d", data, n)
+		}
+		new(Payload).Unmarshal(data)
+	}
+}
@@ -70,13 +70,17 @@ func (pp *pbproto) Pack(p *socket.Packet) error {
 	if err != nil {
 		return err
 	}
+	bodyCodec, err := p.ResolveBodyCodec()
+	if err != nil {
+		return err
+	}
 
 	b, err := codec.ProtoMarshal(&pb.Payload{
 		Seq:       p.Seq(),
 		Ptype:     int32(p.Ptype()),
 		Uri:       p.Uri(),
 		Meta:      p.Meta().QueryString(),
-		BodyCodec: int32(p.BodyCodec()),
+		BodyCodec: int32(bodyCodec),
 		Body:      bodyBytes,
 	})
 	if err != nil {
@@ -84,11 +88,11 @@ func (pp *pbproto) Pack(p *socket.Packet) error {
 	}
 
 	// do transfer pipe
-	b, err = p.XferPipe().OnPack(b)
+	b, ids, err := p.XferPipe().OnPackIds(b)
 	if err != nil {
 		return err
 	}
-	xferPipeLen := p.XferPipe().Len()
+	xferPipeLen := len(ids)
 
 	// set size
 	p.SetSize(uint32(1 + xferPipeLen + len(b)))
@@ -97,7 +101,7 @@ func (pp *pbproto) Pack(p *socket.Packet) error {
 	var all = make([]byte, p.Size()+4)
 	binary.BigEndian.PutUint32(all, p.Size())
 	all[4] = byte(xferPipeLen)
-	copy(all[4+1:], p.XferPipe().Ids())
+	copy(all[4+1:], ids)
 	copy(all[4+1+xferPipeLen:], b)
 	_, err = pp.w.Write(all)
 	return err
@@ -0,0 +1,163 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bufferedConn is the connection whose writes are buffered.
+type bufferedConn struct {
+	net.Conn
+	// dst stores the connHolder that the buffer is flushed to,
+	// which is switched by setConn
+	dst atomic.Value
+	mu  sync.Mutex
+	bw  *bufio.Writer
+}
+
+// connHolder holds the connection under the buffer.
+type connHolder struct {
+	net.Conn
+}
+
+func newBufferedConn(c net.Conn, size int) *bufferedConn {
+	b := &bufferedConn{Conn: c}
+	b.dst.Store(connHolder{c})
+	b.bw = bufio.NewWriterSize(dstWriter{b}, size)
+	return b
+}
+
+// dstWriter writes to the current connection under the buffer.
+type dstWriter struct {
+	c *bufferedConn
+}
+
+func (w dstWriter) Write(b []byte) (int, error) {
+	return w.c.dst.Load().(connHolder).Write(b)
+}
+
+// setConn switches the connection under the buffer, keeping the buffered data.
+func (c *bufferedConn) setConn(conn net.Conn) {
+	c.dst.Store(connHolder{conn})
+}
+
+// Read reads data from the current connection under the buffer.
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.dst.Load().(connHolder).Read(b)
+}
+
+// Write writes b into the buffer,
+// the buffer is flushed only when it is full.
+func (c *bufferedConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	n, err := c.bw.Write(b)
+	c.mu.Unlock()
+	return n, err
+}
+
+// Flush writes the buffered data to the connection.
+func (c *bufferedConn) Flush() error {
+	c.mu.Lock()
+	err := c.bw.Flush()
+	c.mu.Unlock()
+	return err
+}
+
+// closeFlushTimeout is the time upper limit of flushing the buffered packets on closing,
+// after which the connection is closed to unblock the write stalled by the peer.
+var closeFlushTimeout = 3 * time.Second
+
+// closeConn flushes the buffered packets within the timeout, and closes the connection.
+// If timeout<=0, the connection is closed without flushing.
+func closeConn(conn net.Conn, buffered *bufferedConn, timeout time.Duration) error {
+	var err error
+	if buffered != nil && timeout > 0 {
+		timer := time.AfterFunc(timeout, func() { conn.Close() })
+		err = buffered.Flush()
+		if !timer.Stop() {
+			// closed by the timer
+			return err
+		}
+	}
+	if conn != nil {
+		if closeErr := conn.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// SetBufferedWrite enables the buffered writing with the buffer size,
+// so that many small packets are written to the connection by one system call,
+// and Flush must be called to write the buffered packets out.
+// If size<=0, the buffered writing is disabled, and the buffered packets are flushed.
+// Note:
+//  it waits for the in-flight writes;
+//  the settings of the protocol are kept if it supports, such as the default raw protocol,
+//  otherwise the protocol is recreated by the ProtoFunc of the socket;
+//  Close flushes the buffer automatically, for 3 seconds at most;
+//  Reset disables it.
+func (s *socket) SetBufferedWrite(size int) error {
+	// no write is in flight, so the buffered packets are not overtaken
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.mu.RLock()
+	old := s.buffered
+	s.mu.RUnlock()
+	var err error
+	if old != nil {
+		err = old.Flush()
+	}
+	s.mu.Lock()
+	if size > 0 {
+		s.buffered = newBufferedConn(s.protoConn(), size)
+	} else {
+		s.buffered = nil
+	}
+	s.resetProtoConn()
+	s.mu.Unlock()
+	return err
+}
+
+// resetProtoConn moves the protocol onto the current wrappers of the connection.
+// Note: s.mu must be locked.
+func (s *socket) resetProtoConn() {
+	var w net.Conn = s.protoConn()
+	if s.buffered != nil {
+		w = s.buffered
+	}
+	if p, ok := s.protocol.(ifaceResetConn); ok {
+		p.ResetConn(s.protoConn(), w)
+		return
+	}
+	s.protocol = getProto(s.protoFuncs, w)
+}
+
+// Flush writes the packets buffered by SetBufferedWrite to the connection.
+// If the buffered writing is disabled, do nothing.
+func (s *socket) Flush() error {
+	s.mu.RLock()
+	buffered := s.buffered
+	s.mu.RUnlock()
+	if buffered == nil {
+		return nil
+	}
+	return buffered.Flush()
+}
@@ -0,0 +1,116 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// PtypeHeartbeat is the reserved packet type of the socket-level heartbeat.
+// Note: ReadPacket discards the heartbeat packets silently.
+const PtypeHeartbeat byte = 0xfe
+
+// StartHeartbeat sends a heartbeat packet every interval,
+// and closes the socket if no packet arrives within timeout,
+// so that the half-open connection is detected.
+// Note:
+//  the peer just needs to read the socket, the heartbeat packets are not returned by ReadPacket;
+//  calling it again replaces the previous heartbeat, and interval<=0 stops it;
+//  Close and Reset stop it.
+func (s *socket) StartHeartbeat(interval, timeout time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopHeartbeat()
+	if interval <= 0 {
+		return
+	}
+	stop := make(chan struct{})
+	s.heartbeatStop = stop
+	s.touch()
+	go s.heartbeat(interval, timeout, stop)
+}
+
+func (s *socket) heartbeat(interval, timeout time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var sending int32
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if timeout > 0 && time.Since(s.LastActiveTime()) > timeout {
+			// the socket may have been stopped and reused by GetSocket meanwhile
+			s.closeIf(closeFlushTimeout, s.heartbeatRunning(stop))
+			return
+		}
+		// skip this heartbeat if the previous one is blocked
+		if !atomic.CompareAndSwapInt32(&sending, 0, 1) {
+			continue
+		}
+		go func() {
+			s.writeHeartbeat(stop)
+			atomic.StoreInt32(&sending, 0)
+		}()
+	}
+}
+
+// heartbeatRunning returns the function reporting whether the heartbeat of stop is not stopped,
+// which must be called with s.mu locked.
+func (s *socket) heartbeatRunning(stop chan struct{}) func() bool {
+	return func() bool {
+		return s.heartbeatStop == stop
+	}
+}
+
+// writeHeartbeat writes a heartbeat packet, and flushes it if the writing is buffered,
+// otherwise the peer would not get it on an idle connection.
+// If the heartbeat of stop has been stopped, do nothing.
+func (s *socket) writeHeartbeat(stop chan struct{}) error {
+	running := s.heartbeatRunning(stop)
+	if err := s.writePacket(NewPacket(WithPtype(PtypeHeartbeat)), running); err != nil {
+		return err
+	}
+	s.mu.RLock()
+	buffered := s.buffered
+	if !running() {
+		buffered = nil
+	}
+	s.mu.RUnlock()
+	if buffered == nil {
+		return nil
+	}
+	return buffered.Flush()
+}
+
+// stopHeartbeat stops the heartbeat, the s.mu must be locked.
+func (s *socket) stopHeartbeat() {
+	if s.heartbeatStop != nil {
+		close(s.heartbeatStop)
+		s.heartbeatStop = nil
+	}
+}
+
+// LastActiveTime returns the time when a packet was read last,
+// or when the socket was created or reset if no packet has been read.
+func (s *socket) LastActiveTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastActive))
+}
+
+func (s *socket) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
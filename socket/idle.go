@@ -0,0 +1,120 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// idleConn is the connection whose deadline is extended on each progress of the reads and writes.
+type idleConn struct {
+	net.Conn
+	// readTimeout and writeTimeout are the nanoseconds, accessed atomically
+	readTimeout  int64
+	writeTimeout int64
+	// wMu serializes the writes, which share the write deadline
+	wMu sync.Mutex
+}
+
+// Read reads data, and fails if no byte is read within the read idle timeout.
+func (c *idleConn) Read(b []byte) (int, error) {
+	d := time.Duration(atomic.LoadInt64(&c.readTimeout))
+	if d <= 0 {
+		return c.Conn.Read(b)
+	}
+	c.Conn.SetReadDeadline(time.Now().Add(d))
+	n, err := c.Conn.Read(b)
+	c.Conn.SetReadDeadline(time.Time{})
+	return n, err
+}
+
+// Write writes b, and fails if no byte is written within the write idle timeout,
+// the clock is restarted whenever some bytes are written.
+func (c *idleConn) Write(b []byte) (int, error) {
+	c.wMu.Lock()
+	defer c.wMu.Unlock()
+	d := time.Duration(atomic.LoadInt64(&c.writeTimeout))
+	if d <= 0 {
+		return c.Conn.Write(b)
+	}
+	defer c.Conn.SetWriteDeadline(time.Time{})
+	var n int
+	for {
+		c.Conn.SetWriteDeadline(time.Now().Add(d))
+		m, err := c.Conn.Write(b[n:])
+		n += m
+		if err == nil || m == 0 || !isTimeout(err) {
+			return n, err
+		}
+	}
+}
+
+func isTimeout(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
+
+// SetReadIdleTimeout sets the timeout of the reads that get no byte,
+// so that a stalled peer is cut off, while a slow one that keeps sending is not.
+// If d<=0, the reads have no idle timeout.
+// Note:
+//  the wait for the next packet is bounded as well;
+//  the settings of the protocol are kept if it supports, such as the default raw protocol,
+//  otherwise the first call of it or SetWriteIdleTimeout recreates the protocol by the ProtoFunc of the socket;
+//  it replaces the read deadline, so it should not be used with ReadPacketContext;
+//  Reset disables it.
+func (s *socket) SetReadIdleTimeout(d time.Duration) {
+	atomic.StoreInt64(&s.idleConn().readTimeout, int64(d))
+}
+
+// SetWriteIdleTimeout sets the timeout of the writes that put no byte,
+// so that a peer that stops accepting the bytes, such as a slow-loris one, is cut off,
+// whereas a single write deadline would also cut off a large body on a slow link.
+// If d<=0, the writes have no idle timeout.
+// Note:
+//  the settings of the protocol are kept if it supports, such as the default raw protocol,
+//  otherwise the first call of it or SetReadIdleTimeout recreates the protocol by the ProtoFunc of the socket;
+//  it replaces the write deadline, so it should not be used with WritePacketContext;
+//  Reset disables it.
+func (s *socket) SetWriteIdleTimeout(d time.Duration) {
+	atomic.StoreInt64(&s.idleConn().writeTimeout, int64(d))
+}
+
+// idleConn returns the idle timeout connection, which is installed at the first call.
+func (s *socket) idleConn() *idleConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.idle != nil {
+		return s.idle
+	}
+	s.idle = &idleConn{Conn: s.conn}
+	if s.buffered != nil {
+		// the buffer is kept above, so its flushes are timed as well
+		s.buffered.setConn(s.idle)
+	}
+	s.resetProtoConn()
+	return s.idle
+}
+
+// protoConn returns the connection that the protocol writes to, except for the buffer.
+func (s *socket) protoConn() net.Conn {
+	if s.idle != nil {
+		return s.idle
+	}
+	return s.conn
+}
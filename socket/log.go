@@ -0,0 +1,49 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"sync/atomic"
+)
+
+// Logger is the logger of the socket package,
+// the tp.Logger satisfies it.
+type Logger interface {
+	// Debugf logs a message using DEBUG as log level.
+	Debugf(format string, a ...interface{})
+	// Errorf logs a message using ERROR as log level.
+	Errorf(format string, a ...interface{})
+}
+
+// loggerHolder holds the Logger in the atomic.Value, which may be nil.
+type loggerHolder struct {
+	Logger
+}
+
+var logger atomic.Value
+
+// SetLogger sets the logger of the socket package, such as tp.GetLogger().
+// Note:
+//  if logger is nil, nothing is logged, which is the default;
+//  the messages are formatted only if the logger is set.
+func SetLogger(l Logger) {
+	logger.Store(loggerHolder{l})
+}
+
+// getLogger returns the logger, or nil if it is not set.
+func getLogger() Logger {
+	h, _ := logger.Load().(loggerHolder)
+	return h.Logger
+}
@@ -0,0 +1,427 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// PtypeMux is the reserved packet type of the multiplexed stream frames.
+const PtypeMux byte = 0xfc
+
+// Metadata keys of the multiplexed stream frames
+const (
+	MetaStreamId   = "X-Stream-Id"
+	MetaStreamFlag = "X-Stream-Flag"
+)
+
+const (
+	// muxOpen marks the frame opening the stream.
+	muxOpen = "open"
+	// muxMore marks a frame followed by more frames of the same packet.
+	muxMore = "more"
+	// muxEnd marks the last frame of a packet.
+	muxEnd = "end"
+	// muxClose marks the frame closing the stream.
+	muxClose = "close"
+	// muxChunkSize is the body length upper limit of a frame,
+	// so that a large packet does not block the other streams.
+	muxChunkSize = 1 << 14
+	// muxAcceptBacklog is the number of the unaccepted streams opened by the peer,
+	// the streams over it are refused.
+	muxAcceptBacklog = 64
+	// muxStreamBacklog is the number of the unread packets of a stream,
+	// the stream over it is reset.
+	muxStreamBacklog = 64
+)
+
+var (
+	// ErrMuxClosed the multiplexer is closed.
+	ErrMuxClosed = errors.New("socket: the multiplexer is closed")
+	// ErrMuxStreamReset the stream is reset, since too many packets are unread.
+	ErrMuxStreamReset = errors.New("socket: the stream is reset, too many packets are unread")
+)
+
+// StreamId returns the multiplexed stream id of the packet, or 0 if not set.
+func (p *Packet) StreamId() uint32 {
+	id, _ := strconv.ParseUint(string(p.meta.Peek(MetaStreamId)), 10, 32)
+	return uint32(id)
+}
+
+// SetStreamId sets the multiplexed stream id of the packet.
+// Note: it is carried by the metadata, so no header field is added to the protocol.
+func (p *Packet) SetStreamId(id uint32) {
+	p.meta.Set(MetaStreamId, strconv.FormatUint(uint64(id), 10))
+}
+
+type (
+	// Mux multiplexes the logical streams over one socket.
+	Mux struct {
+		s         Socket
+		protoFunc []ProtoFunc
+		// nextId is the id of the next stream opened by this side,
+		// the odd ones for the client, the even ones for the server.
+		nextId uint32
+		// openMu keeps the open frames in the order of the ids
+		openMu sync.Mutex
+		mu     sync.Mutex
+		// streams the open streams
+		streams map[uint32]*muxStream
+		// lastPeerId is the id of the last stream opened by the peer
+		lastPeerId uint32
+		accept     chan *muxStream
+		closed     chan struct{}
+		closeOnce  sync.Once
+		err        error
+	}
+	// Stream is a logical stream of packets multiplexed by Mux.
+	Stream interface {
+		// Id returns the stream id.
+		Id() uint32
+		// WritePacket writes the packet to the stream.
+		// Note:
+		//  the packet is split into the frames interleaved with the other streams;
+		//  it is concurrent unsafe.
+		WritePacket(packet *Packet) error
+		// ReadPacket reads the next packet of the stream.
+		// Note:
+		//  it returns io.EOF after the peer closes the stream;
+		//  it is concurrent unsafe.
+		ReadPacket(packet *Packet) error
+		// Close closes the stream, and tells the peer.
+		Close() error
+	}
+	muxStream struct {
+		m  *Mux
+		id uint32
+		// partial is the packet being reassembled, only used by the read loop
+		partial []byte
+		mu      sync.Mutex
+		queue   [][]byte
+		notify  chan struct{}
+		// remoteClosed is true after the peer closes the stream
+		remoteClosed bool
+		// err is ErrMuxStreamReset after the stream is reset
+		err    error
+		closed int32
+	}
+)
+
+// NewMux creates a multiplexer over the socket, and starts reading it.
+// The client is the side that dials, so the two sides open the streams with distinct ids.
+// Note:
+//  the socket must not be read by others after that;
+//  the packets are encoded with protoFunc, or the default protocol if not specified;
+//  the packets not sent by a peer multiplexer are discarded.
+func NewMux(s Socket, client bool, protoFunc ...ProtoFunc) *Mux {
+	m := &Mux{
+		s:         s,
+		protoFunc: protoFunc,
+		streams:   make(map[uint32]*muxStream),
+		accept:    make(chan *muxStream, muxAcceptBacklog),
+		closed:    make(chan struct{}),
+	}
+	if client {
+		m.nextId = 1
+	} else {
+		m.nextId = 2
+	}
+	go m.readLoop()
+	return m
+}
+
+// OpenStream opens a new stream, and tells the peer, which gets it by AcceptStream.
+func (m *Mux) OpenStream() (Stream, error) {
+	m.openMu.Lock()
+	defer m.openMu.Unlock()
+	select {
+	case <-m.closed:
+		return nil, ErrMuxClosed
+	default:
+	}
+	m.mu.Lock()
+	st := m.newStream(m.nextId)
+	m.nextId += 2
+	m.mu.Unlock()
+	frame := st.newFrame()
+	frame.meta.Set(MetaStreamFlag, muxOpen)
+	if err := m.s.WritePacket(frame); err != nil {
+		m.removeStream(st.id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// AcceptStream waits for and returns the next stream opened by the peer.
+func (m *Mux) AcceptStream() (Stream, error) {
+	select {
+	case st := <-m.accept:
+		return st, nil
+	case <-m.closed:
+		return nil, ErrMuxClosed
+	}
+}
+
+// Close closes the multiplexer and the socket.
+func (m *Mux) Close() error {
+	m.shutdown(ErrMuxClosed)
+	return m.s.Close()
+}
+
+// Err returns the error that stops the multiplexer, or nil if it is running.
+func (m *Mux) Err() error {
+	select {
+	case <-m.closed:
+		return m.err
+	default:
+		return nil
+	}
+}
+
+// newStream creates and registers a stream, the m.mu must be locked.
+func (m *Mux) newStream(id uint32) *muxStream {
+	st := &muxStream{
+		m:      m,
+		id:     id,
+		notify: make(chan struct{}, 1),
+	}
+	m.streams[id] = st
+	return st
+}
+
+func (m *Mux) shutdown(err error) {
+	m.closeOnce.Do(func() {
+		m.err = err
+		close(m.closed)
+	})
+}
+
+func (m *Mux) readLoop() {
+	var (
+		body = new([]byte)
+		p    = NewPacket()
+	)
+	for {
+		p.Reset(WithBody(body))
+		if err := m.s.ReadPacket(p); err != nil {
+			m.shutdown(err)
+			return
+		}
+		if p.Ptype() != PtypeMux {
+			continue
+		}
+		st := m.receiver(p.StreamId())
+		if st == nil {
+			continue
+		}
+		switch string(p.meta.Peek(MetaStreamFlag)) {
+		case muxOpen:
+		case muxMore:
+			st.partial = append(st.partial, *body...)
+			if int64(len(st.partial)) > m.maxBodyLength()+atomic.LoadInt64(&maxHeaderLength) {
+				m.s.Close()
+				m.shutdown(ErrBodyTooLarge)
+				return
+			}
+		case muxEnd:
+			if !st.push(append(st.partial, *body...)) {
+				st.reset()
+			}
+			st.partial = nil
+		case muxClose:
+			st.remoteClose()
+		}
+	}
+}
+
+// maxBodyLength returns the body length upper limit of reading for the socket.
+func (m *Mux) maxBodyLength() int64 {
+	if s, ok := m.s.(interface{ maxBodyLength() int64 }); ok {
+		return s.maxBodyLength()
+	}
+	return MaxBodyLength()
+}
+
+// receiver returns the stream of the frame, and creates it if the peer opens it,
+// it returns nil if the stream is closed already.
+// Note: the peer opens the streams in the order of the ids.
+func (m *Mux) receiver(id uint32) *muxStream {
+	m.mu.Lock()
+	if st := m.streams[id]; st != nil {
+		m.mu.Unlock()
+		return st
+	}
+	// a new stream has the peer's parity and a bigger id
+	if id == 0 || id%2 == m.nextId%2 || id <= m.lastPeerId {
+		m.mu.Unlock()
+		return nil
+	}
+	m.lastPeerId = id
+	st := m.newStream(id)
+	select {
+	case m.accept <- st:
+	default:
+		// the backlog is full, the stream is refused without blocking the read loop
+		delete(m.streams, id)
+		m.mu.Unlock()
+		go m.writeClose(id)
+		return nil
+	}
+	m.mu.Unlock()
+	return st
+}
+
+// writeClose tells the peer that the stream is closed.
+func (m *Mux) writeClose(id uint32) error {
+	frame := m.newFrame(id)
+	frame.meta.Set(MetaStreamFlag, muxClose)
+	return m.s.WritePacket(frame)
+}
+
+func (m *Mux) newFrame(id uint32) *Packet {
+	frame := NewPacket(WithPtype(PtypeMux))
+	frame.SetStreamId(id)
+	return frame
+}
+
+func (m *Mux) removeStream(id uint32) {
+	m.mu.Lock()
+	delete(m.streams, id)
+	m.mu.Unlock()
+}
+
+// Id returns the stream id.
+func (st *muxStream) Id() uint32 {
+	return st.id
+}
+
+// WritePacket writes the packet to the stream.
+func (st *muxStream) WritePacket(packet *Packet) error {
+	if atomic.LoadInt32(&st.closed) == 1 {
+		return ErrStreamClosed
+	}
+	data, err := packet.Encode(st.m.protoFunc...)
+	if err != nil {
+		return err
+	}
+	frame := st.newFrame()
+	for {
+		size := len(data)
+		if size > muxChunkSize {
+			size = muxChunkSize
+			frame.meta.Set(MetaStreamFlag, muxMore)
+		} else {
+			frame.meta.Set(MetaStreamFlag, muxEnd)
+		}
+		frame.SetBody(data[:size])
+		if err = st.m.s.WritePacket(frame); err != nil {
+			return err
+		}
+		data = data[size:]
+		if len(data) == 0 {
+			return nil
+		}
+	}
+}
+
+// ReadPacket reads the next packet of the stream.
+func (st *muxStream) ReadPacket(packet *Packet) error {
+	for {
+		st.mu.Lock()
+		if len(st.queue) > 0 {
+			data := st.queue[0]
+			st.queue[0] = nil
+			st.queue = st.queue[1:]
+			st.mu.Unlock()
+			return getProto(st.m.protoFunc, &decodeReader{data: data}).Unpack(packet)
+		}
+		remoteClosed, err := st.remoteClosed, st.err
+		st.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if atomic.LoadInt32(&st.closed) == 1 {
+			return ErrStreamClosed
+		}
+		if remoteClosed {
+			return io.EOF
+		}
+		select {
+		case <-st.notify:
+		case <-st.m.closed:
+			return st.m.err
+		}
+	}
+}
+
+// Close closes the stream, and tells the peer.
+func (st *muxStream) Close() error {
+	if !atomic.CompareAndSwapInt32(&st.closed, 0, 1) {
+		return nil
+	}
+	st.m.removeStream(st.id)
+	st.wake()
+	return st.m.writeClose(st.id)
+}
+
+func (st *muxStream) newFrame() *Packet {
+	return st.m.newFrame(st.id)
+}
+
+// push queues a reassembled packet, without blocking the read loop,
+// it returns false if the backlog of the stream is full.
+func (st *muxStream) push(data []byte) bool {
+	st.mu.Lock()
+	if len(st.queue) >= muxStreamBacklog {
+		st.mu.Unlock()
+		return false
+	}
+	st.queue = append(st.queue, data)
+	st.mu.Unlock()
+	st.wake()
+	return true
+}
+
+// reset discards the stream whose packets are unread, and tells the peer.
+func (st *muxStream) reset() {
+	st.mu.Lock()
+	st.queue = nil
+	st.err = ErrMuxStreamReset
+	st.mu.Unlock()
+	if atomic.CompareAndSwapInt32(&st.closed, 0, 1) {
+		go st.m.writeClose(st.id)
+	}
+	st.m.removeStream(st.id)
+	st.wake()
+}
+
+func (st *muxStream) remoteClose() {
+	st.mu.Lock()
+	st.remoteClosed = true
+	st.mu.Unlock()
+	st.m.removeStream(st.id)
+	st.wake()
+}
+
+func (st *muxStream) wake() {
+	select {
+	case st.notify <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/henrylee2cn/teleport/codec"
+	"github.com/henrylee2cn/teleport/xfer"
+)
+
+// PtypeNegotiate is the reserved packet type of the negotiation handshake.
+const PtypeNegotiate byte = 0xff
+
+// Metadata keys of the negotiation handshake
+const (
+	MetaNegotiateCodecs = "X-Negotiate-Codecs"
+	MetaNegotiateXfers  = "X-Negotiate-Xfers"
+)
+
+// ErrNegotiate the peer does not reply a negotiation handshake packet.
+var ErrNegotiate = errors.New("socket: the peer did not negotiate")
+
+// ErrNegotiatePacket is returned by Negotiate when the first packet of the peer
+// is not a negotiation handshake, which is consumed, so it is returned to the caller.
+// Note: the body is kept as the bytes, with the body codec of the peer.
+type ErrNegotiatePacket struct {
+	Packet *Packet
+}
+
+// Error implements error.
+func (e *ErrNegotiatePacket) Error() string {
+	return ErrNegotiate.Error()
+}
+
+// Unwrap returns ErrNegotiate.
+func (e *ErrNegotiatePacket) Unwrap() error {
+	return ErrNegotiate
+}
+
+type negotiated struct {
+	codecs []byte
+	xfers  []byte
+}
+
+// Negotiate exchanges the supported body codec ids and transfer filter ids
+// with the peer, which must call Negotiate at the same time.
+// If codecs or xfers is nil, all the registered ones are used.
+// Note:
+//  it must be the first exchange, before any other packet is read or written,
+//  if the peer sends another packet first, *ErrNegotiatePacket is returned with it;
+//  after that, WritePacket downgrades the packets to the negotiated ids.
+func (s *socket) Negotiate(codecs, xfers []byte) error {
+	return s.NegotiateContext(context.Background(), codecs, xfers)
+}
+
+// NegotiateContext is like Negotiate,
+// but the exchange is aborted with ctx.Err() when ctx is done.
+// Note: the aborted exchange may leave a partial packet on the connection,
+//  so the socket should be closed then.
+func (s *socket) NegotiateContext(ctx context.Context, codecs, xfers []byte) error {
+	if codecs == nil {
+		for _, c := range codec.ListAll() {
+			codecs = append(codecs, c.Id())
+		}
+	}
+	if xfers == nil {
+		for _, x := range xfer.ListAll() {
+			xfers = append(xfers, x.Id())
+		}
+	}
+	output := NewPacket(
+		WithPtype(PtypeNegotiate),
+		WithSetMeta(MetaNegotiateCodecs, string(codecs)),
+		WithSetMeta(MetaNegotiateXfers, string(xfers)),
+	)
+	writeErr := make(chan error, 1)
+	go func() {
+		writeErr <- s.WritePacketContext(ctx, output)
+	}()
+	input := NewPacket(WithBody(new([]byte)))
+	err := s.ReadPacketContext(ctx, input)
+	if e := <-writeErr; err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	if input.Ptype() != PtypeNegotiate {
+		return &ErrNegotiatePacket{Packet: input}
+	}
+	n := &negotiated{
+		codecs: intersect(codecs, input.Meta().Peek(MetaNegotiateCodecs)),
+		xfers:  intersect(xfers, input.Meta().Peek(MetaNegotiateXfers)),
+	}
+	s.mu.Lock()
+	s.negotiated = n
+	s.mu.Unlock()
+	return nil
+}
+
+// NegotiatedCodecs returns the body codec ids supported by both sides,
+// or nil if not negotiated.
+func (s *socket) NegotiatedCodecs() []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.negotiated == nil {
+		return nil
+	}
+	return s.negotiated.codecs
+}
+
+// NegotiatedXfers returns the transfer filter ids supported by both sides,
+// or nil if not negotiated.
+func (s *socket) NegotiatedXfers() []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.negotiated == nil {
+		return nil
+	}
+	return s.negotiated.xfers
+}
+
+// intersect returns the ids of a which are also in b.
+func intersect(a, b []byte) []byte {
+	ids := make([]byte, 0, len(a))
+	for _, id := range a {
+		if bytes.IndexByte(b, id) >= 0 {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// downgrade falls back to the JSON codec if the body codec is not negotiated,
+// and removes the transfer filters that are not negotiated.
+func (n *negotiated) downgrade(p *Packet) error {
+	switch p.body.(type) {
+	case nil, []byte, *[]byte:
+		// the encoded bytes can not be downgraded
+	default:
+		bodyCodec, err := p.resolveBodyCodec()
+		if err != nil {
+			return err
+		}
+		if bytes.IndexByte(n.codecs, bodyCodec) < 0 {
+			if bytes.IndexByte(n.codecs, codec.ID_JSON) < 0 {
+				return fmt.Errorf("socket: the peer does not support the body codec: %d", bodyCodec)
+			}
+			p.bodyCodec = codec.ID_JSON
+		}
+	}
+	ids := p.xferPipe.Ids()
+	if supported := intersect(ids, n.xfers); len(supported) < len(ids) {
+		p.xferPipe.Reset()
+		return p.xferPipe.Append(supported...)
+	}
+	return nil
+}
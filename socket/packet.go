@@ -20,9 +20,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 
 	"github.com/henrylee2cn/goutil"
 	"github.com/henrylee2cn/teleport/codec"
@@ -41,6 +46,9 @@ type (
 		uri string
 		// URI object
 		uriObject *url.URL
+		// uriQuery caches the parsed query of uriQueryRaw
+		uriQuery    url.Values
+		uriQueryRaw string
 		// metadata
 		meta *utils.Args
 		// body codec type
@@ -52,6 +60,8 @@ type (
 		//  only for writing packet;
 		//  should be nil when reading packet.
 		newBodyFunc NewBodyFunc
+		// newBodyCheck creates a new body or rejects the packet by header and body length.
+		newBodyCheck NewBodyCheckFunc
 		// XferPipe transfer filter pipe, handlers from outer-most to inner-most.
 		// Note: the length can not be bigger than 255!
 		xferPipe *xfer.XferPipe
@@ -61,8 +71,23 @@ type (
 		// carries a deadline, a cancelation signal,
 		// and other values across API boundaries.
 		ctx context.Context
-		// stack
-		next *Packet
+		// pooled is 1 when the packet is idle in the packet stack
+		pooled int32
+		// bodyReclaim is called with the body by PutPacket
+		bodyReclaim func(interface{})
+		// readBuffer is the frame buffer aliased by the header strings
+		// when UnsafeStringDecode, it is released by Reset
+		readBuffer *utils.ByteBuffer
+		// lazy holds the body bytes until DecodeBody when WithLazyBody
+		lazy lazyBody
+		// keepRawBody is true if rawBody keeps the body bytes read, set by WithKeepRawBody
+		keepRawBody bool
+		rawBody     []byte
+		// reuseBodyBuffer is true if the *[]byte body is decoded into its capacity,
+		// set by WithReuseBodyBuffer
+		reuseBodyBuffer bool
+		// bodyRead is true if the body bytes have been read by UnmarshalBody
+		bodyRead bool
 	}
 	// Header packet header interface
 	Header interface {
@@ -98,18 +123,33 @@ type (
 		// SetNewBody resets the function of geting body.
 		SetNewBody(newBodyFunc NewBodyFunc)
 		// MarshalBody returns the encoding of body.
-		// Note: when the body is a stream of bytes, no marshalling is done.
+		// Note:
+		//  when the body is a stream of bytes, no marshalling is done;
+		//  when the body codec is not set, it is set to the one named by the body
+		//  if it implements CodecNamer, otherwise to DefaultBodyCodec.
 		MarshalBody() ([]byte, error)
+		// MarshalBodyTo writes the encoding of body to w.
+		// Note:
+		//  if the body codec implements codec.StreamCodec,
+		//  the body is encoded directly to w.
+		MarshalBodyTo(w io.Writer) error
 		// UnmarshalBody unmarshals the encoded data to the body.
 		// Note:
 		//  seq, ptype, uri must be setted already;
 		//  if body=nil, try to use newBodyFunc to create a new one;
-		//  when the body is a stream of bytes, no unmarshalling is done.
+		//  when the body is a stream of bytes, no unmarshalling is done;
+		//  when the body is *[]byte, the data is copied into a new slice,
+		//  or into its existing capacity if WithReuseBodyBuffer.
 		UnmarshalBody(bodyBytes []byte) error
 	}
 
 	// NewBodyFunc creates a new body by header.
+	// Note: it can return a reused buffer, such as *[]byte with WithReuseBodyBuffer, to avoid allocation.
 	NewBodyFunc func(Header) interface{}
+
+	// NewBodyCheckFunc creates a new body by header and the length of the body bytes,
+	// or returns an error to reject the packet without unmarshalling the body.
+	NewBodyCheckFunc func(header Header, bodyLength int) (interface{}, error)
 )
 
 var (
@@ -117,35 +157,124 @@ var (
 	_ Body   = new(Packet)
 )
 
-var packetStack = new(struct {
-	freePacket *Packet
-	mu         sync.Mutex
-})
+// packetStack caches idle packets, it is sharded per-P by sync.Pool.
+var packetStack = sync.Pool{
+	New: func() interface{} {
+		atomic.AddUint64(&packetPoolStats.Misses, 1)
+		// the pool is empty, the idle packets released by the GC are not counted any more
+		atomic.StoreInt64(&freePackets, 0)
+		return NewPacket()
+	},
+}
+
+// freePackets is the number of the idle packets in packetStack.
+var freePackets int64
+
+// PacketPoolStats packet stack statistics.
+type PacketPoolStats struct {
+	// Gets the number of GetPacket calls
+	Gets uint64
+	// Misses the number of packets newly allocated by GetPacket
+	Misses uint64
+	// Puts the number of PutPacket calls
+	Puts uint64
+}
+
+var packetPoolStats PacketPoolStats
+
+// ReadPacketPoolStats returns a snapshot of the packet stack statistics.
+func ReadPacketPoolStats() PacketPoolStats {
+	return PacketPoolStats{
+		Gets:   atomic.LoadUint64(&packetPoolStats.Gets),
+		Misses: atomic.LoadUint64(&packetPoolStats.Misses),
+		Puts:   atomic.LoadUint64(&packetPoolStats.Puts),
+	}
+}
+
+var maxFreePackets int64 = 4096
+
+// MaxFreePackets returns the packet pooling parameter set by SetMaxFreePackets.
+func MaxFreePackets() int {
+	return int(atomic.LoadInt64(&maxFreePackets))
+}
+
+// SetMaxFreePackets sets the maximum number of the idle packets in the packet stack.
+// Note:
+//  if n<=0, disable pooling, every GetPacket allocates a new packet
+//  and PutPacket drops it, which helps to debug the suspected pool-related bugs with -race;
+//  if n>0, PutPacket drops the packet when the packet stack is full,
+//  and the idle packets may also be released by the GC;
+//  the default is 4096.
+func SetMaxFreePackets(n int) {
+	if n < 0 {
+		n = 0
+	}
+	atomic.StoreInt64(&maxFreePackets, int64(n))
+}
+
+var debugPool int32
+
+// DebugPool returns whether to panic when a packet is put back to the packet stack twice.
+func DebugPool() bool {
+	return atomic.LoadInt32(&debugPool) == 1
+}
+
+// SetDebugPool sets whether to panic when a packet is put back to the packet stack twice.
+// Note: the default is false, the repeated PutPacket is ignored silently.
+func SetDebugPool(debug bool) {
+	if debug {
+		atomic.StoreInt32(&debugPool, 1)
+	} else {
+		atomic.StoreInt32(&debugPool, 0)
+	}
+}
 
 // GetPacket gets a *Packet form packet stack.
 // Note:
 //  newBodyFunc is only for reading form connection;
 //  settings are only for writing to connection.
 func GetPacket(settings ...PacketSetting) *Packet {
-	packetStack.mu.Lock()
-	p := packetStack.freePacket
-	if p == nil {
-		p = NewPacket(settings...)
-	} else {
-		packetStack.freePacket = p.next
-		p.doSetting(settings...)
+	atomic.AddUint64(&packetPoolStats.Gets, 1)
+	if atomic.LoadInt64(&maxFreePackets) <= 0 {
+		atomic.AddUint64(&packetPoolStats.Misses, 1)
+		return NewPacket(settings...)
+	}
+	p := packetStack.Get().(*Packet)
+	if atomic.CompareAndSwapInt32(&p.pooled, 1, 0) {
+		atomic.AddInt64(&freePackets, -1)
 	}
-	packetStack.mu.Unlock()
+	p.doSetting(settings...)
 	return p
 }
 
 // PutPacket puts a *Packet to packet stack.
+// Note:
+//  the body is handed to the WithBodyReclaim function first, if any;
+//  if pooling is disabled or the packet stack is full, the packet is dropped;
+//  if the packet is already in the packet stack, do nothing,
+//  or panic when SetDebugPool(true) has been called.
 func PutPacket(p *Packet) {
-	packetStack.mu.Lock()
+	atomic.AddUint64(&packetPoolStats.Puts, 1)
+	if reclaim := p.bodyReclaim; reclaim != nil {
+		p.bodyReclaim = nil
+		reclaim(p.body)
+	}
+	if atomic.LoadInt64(&maxFreePackets) <= 0 {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&p.pooled, 0, 1) {
+		if atomic.LoadInt32(&debugPool) == 1 {
+			panic("socket: PutPacket: the packet has been put back to the packet stack")
+		}
+		return
+	}
+	if atomic.AddInt64(&freePackets, 1) > atomic.LoadInt64(&maxFreePackets) {
+		// the packet is dropped, but is still marked as put back
+		atomic.AddInt64(&freePackets, -1)
+		return
+	}
 	p.Reset()
-	p.next = packetStack.freePacket
-	packetStack.freePacket = p
-	packetStack.mu.Unlock()
+	packetStack.Put(p)
 }
 
 // NewPacket creates a new *Packet.
@@ -166,21 +295,234 @@ func NewPacket(settings ...PacketSetting) *Packet {
 //  newBodyFunc is only for reading form connection;
 //  settings are only for writing to connection.
 func (p *Packet) Reset(settings ...PacketSetting) {
-	p.next = nil
+	p.ResetKeep(0, settings...)
+}
+
+// ResetMask selects the header fields preserved by ResetKeep.
+type ResetMask uint8
+
+// The header fields preserved by ResetKeep
+const (
+	KeepSeq ResetMask = 1 << iota
+	KeepUri
+	KeepPtype
+	KeepMeta
+)
+
+// ResetKeep resets itself except the header fields selected by keep,
+// so that the fields stable across a sequence of packets are not set again.
+// Note:
+//  KeepUri preserves both the URI string and object;
+//  the body, the transfer pipe and the others are always reset;
+//  the settings are applied after resetting.
+func (p *Packet) ResetKeep(keep ResetMask, settings ...PacketSetting) {
+	if p.readBuffer != nil {
+		// the kept strings must not alias the released buffer
+		if keep&KeepSeq != 0 {
+			p.seq = string([]byte(p.seq))
+		}
+		if keep&KeepUri != 0 {
+			p.uri = string([]byte(p.Uri()))
+			p.uriObject = nil
+			p.uriQuery = nil
+		}
+		p.setReadBuffer(nil)
+	}
 	p.body = nil
-	p.meta.Reset()
+	if keep&KeepMeta == 0 {
+		p.meta.Reset()
+	}
 	p.xferPipe.Reset()
 	p.newBodyFunc = nil
-	p.seq = ""
-	p.ptype = 0
-	p.uri = ""
-	p.uriObject = nil
+	p.newBodyCheck = nil
+	if keep&KeepSeq == 0 {
+		p.seq = ""
+	}
+	if keep&KeepPtype == 0 {
+		p.ptype = 0
+	}
+	if keep&KeepUri == 0 {
+		p.uri = ""
+		p.uriObject = nil
+		p.uriQuery = nil
+		p.uriQueryRaw = ""
+	}
 	p.size = 0
 	p.ctx = nil
 	p.bodyCodec = codec.NilCodecId
+	p.bodyReclaim = nil
+	p.lazy = lazyBody{data: p.lazy.data[:0]}
+	p.keepRawBody = false
+	p.rawBody = p.rawBody[:0]
+	p.reuseBodyBuffer = false
+	p.bodyRead = false
 	p.doSetting(settings...)
 }
 
+// Clone returns a copy of the packet, which is not linked to the packet stack.
+// Note: the body object is shallow-copied.
+func (p *Packet) Clone() *Packet {
+	var c = NewPacket()
+	c.seq = p.seq
+	c.ptype = p.ptype
+	c.uri = p.uri
+	if p.readBuffer != nil {
+		// the clone must not alias the read buffer
+		c.seq = string([]byte(p.seq))
+		c.uri = string([]byte(p.Uri()))
+	} else if p.uriObject != nil {
+		u := *p.uriObject
+		c.uriObject = &u
+	}
+	p.meta.CopyTo(c.meta)
+	c.bodyCodec = p.bodyCodec
+	c.body = p.body
+	c.newBodyFunc = p.newBodyFunc
+	c.newBodyCheck = p.newBodyCheck
+	c.xferPipe.AppendFrom(p.xferPipe)
+	c.size = p.size
+	c.ctx = p.ctx
+	c.lazy = p.lazy
+	c.lazy.data = append([]byte(nil), p.lazy.data...)
+	c.keepRawBody = p.keepRawBody
+	c.rawBody = append([]byte(nil), p.rawBody...)
+	c.reuseBodyBuffer = p.reuseBodyBuffer
+	c.bodyRead = p.bodyRead
+	return c
+}
+
+// setReadBuffer releases the current read buffer, and replaces it with bb.
+func (p *Packet) setReadBuffer(bb *utils.ByteBuffer) {
+	if p.readBuffer != nil {
+		utils.ReleaseByteBuffer(p.readBuffer)
+	}
+	p.readBuffer = bb
+}
+
+// decodeString returns the string of the decoded bytes,
+// which aliases b if the packet holds the read buffer.
+func (p *Packet) decodeString(b []byte) string {
+	if p.readBuffer != nil {
+		return goutil.BytesToString(b)
+	}
+	return string(b)
+}
+
+// Equal reports whether the packets have the same header, body codec,
+// transfer pipe, size and body, ignoring the context and the pool state.
+// Note: the body is compared by reflect.DeepEqual.
+func (p *Packet) Equal(other *Packet) bool {
+	return p.Diff(other) == ""
+}
+
+// Diff returns the description of the first mismatch between the packets,
+// or "" if they are equal.
+// Note:
+//  the fields are compared as Equal does;
+//  the metadata is compared in order.
+func (p *Packet) Diff(other *Packet) string {
+	switch {
+	case p == nil || other == nil:
+		if p != other {
+			return fmt.Sprintf("packet: %p != %p", p, other)
+		}
+	case p.seq != other.seq:
+		return fmt.Sprintf("seq: %q != %q", p.seq, other.seq)
+	case p.ptype != other.ptype:
+		return fmt.Sprintf("ptype: %d != %d", p.ptype, other.ptype)
+	case p.Uri() != other.Uri():
+		return fmt.Sprintf("uri: %q != %q", p.Uri(), other.Uri())
+	case !bytes.Equal(p.meta.QueryString(), other.meta.QueryString()):
+		return fmt.Sprintf("meta: %q != %q", p.meta.QueryString(), other.meta.QueryString())
+	case p.bodyCodec != other.bodyCodec:
+		return fmt.Sprintf("body_codec: %d != %d", p.bodyCodec, other.bodyCodec)
+	case !bytes.Equal(p.xferPipe.Ids(), other.xferPipe.Ids()):
+		return fmt.Sprintf("xfer_pipe: %v != %v", p.xferPipe.Ids(), other.xferPipe.Ids())
+	case p.size != other.size:
+		return fmt.Sprintf("size: %d != %d", p.size, other.size)
+	case !reflect.DeepEqual(p.body, other.body):
+		return fmt.Sprintf("body: %#v != %#v", p.body, other.body)
+	}
+	return ""
+}
+
+// Metadata keys set by the package itself
+const (
+	// MetaAcceptBodyCodec the key of body codec that the sender wishes to accept
+	MetaAcceptBodyCodec = "X-Accept-Body-Codec"
+	// MetaTraceId the key of distributed tracing trace id in hex
+	MetaTraceId = "X-Trace-Id"
+	// MetaSpanId the key of distributed tracing span id in hex
+	MetaSpanId = "X-Span-Id"
+)
+
+// transportMetaKeys are the metadata keys ignored by SemanticKey,
+// which differ between the packets of the same request.
+var transportMetaKeys = struct {
+	sync.RWMutex
+	keys map[string]bool
+}{
+	keys: map[string]bool{
+		MetaAcceptBodyCodec: true,
+		MetaTraceId:         true,
+		MetaSpanId:          true,
+		MetaStream:          true,
+		MetaStreamId:        true,
+		MetaStreamFlag:      true,
+		MetaNegotiateCodecs: true,
+		MetaNegotiateXfers:  true,
+	},
+}
+
+// RegTransportMetaKey registers the metadata key ignored by SemanticKey,
+// whose value differs between the packets of the same request, such as the sending time.
+func RegTransportMetaKey(key string) {
+	transportMetaKeys.Lock()
+	transportMetaKeys.keys[key] = true
+	transportMetaKeys.Unlock()
+}
+
+// SemanticKey returns the key of the packet type, URI and metadata,
+// ignoring the transport fields, such as the seq, the transfer pipe, the size
+// and the metadata set by the package, such as the trace, stream, negotiation and accept-codec ones,
+// or registered by RegTransportMetaKey,
+// so the packets of the same request, such as the retried ones, have the same key,
+// which can be used to dedupe or cache them by a map.
+// Note:
+//  the metadata is sorted by key, and the values of the same key are kept in order;
+//  each string is prefixed by its length, so the different packets never have the same key;
+//  the metadata is included whole, such as the idempotency key set by the caller.
+func (p *Packet) SemanticKey() string {
+	type kv struct{ k, v []byte }
+	var meta []kv
+	transportMetaKeys.RLock()
+	p.meta.VisitAll(func(k, v []byte) {
+		if !transportMetaKeys.keys[string(k)] {
+			meta = append(meta, kv{k, v})
+		}
+	})
+	transportMetaKeys.RUnlock()
+	sort.SliceStable(meta, func(i, j int) bool {
+		return bytes.Compare(meta[i].k, meta[j].k) < 0
+	})
+	uri := p.Uri()
+	b := make([]byte, 0, 16+len(uri)+p.meta.Len()*16)
+	b = strconv.AppendUint(b, uint64(p.ptype), 10)
+	b = appendKeyString(b, uri)
+	for _, e := range meta {
+		b = appendKeyString(b, goutil.BytesToString(e.k))
+		b = appendKeyString(b, goutil.BytesToString(e.v))
+	}
+	return string(b)
+}
+
+func appendKeyString(b []byte, s string) []byte {
+	b = append(b, '|')
+	b = strconv.AppendInt(b, int64(len(s)), 10)
+	b = append(b, ':')
+	return append(b, s...)
+}
+
 func (p *Packet) doSetting(settings ...PacketSetting) {
 	for _, fn := range settings {
 		if fn != nil {
@@ -237,6 +579,32 @@ func (p *Packet) UriObject() *url.URL {
 	return p.uriObject
 }
 
+// UriPath returns the path of the URI.
+// Note: if the URI is malformed, it returns "".
+func (p *Packet) UriPath() string {
+	return p.UriObject().Path
+}
+
+// UriQuery returns the parsed query of the URI,
+// which is cached until the query changes.
+// Note:
+//  the result is shared by the later calls, so it must not be modified;
+//  if the URI is malformed or has no query, it returns the empty values.
+func (p *Packet) UriQuery() url.Values {
+	rawQuery := p.UriObject().RawQuery
+	if p.uriQuery == nil || p.uriQueryRaw != rawQuery {
+		p.uriQuery, _ = url.ParseQuery(rawQuery)
+		p.uriQueryRaw = rawQuery
+	}
+	return p.uriQuery
+}
+
+// UriParam returns the first value of the query parameter of the URI,
+// or "" if there is not.
+func (p *Packet) UriParam(key string) string {
+	return p.UriQuery().Get(key)
+}
+
 // SetUri sets the packet URI
 func (p *Packet) SetUri(uri string) {
 	p.uri = uri
@@ -270,22 +638,102 @@ func (p *Packet) Body() interface{} {
 	return p.body
 }
 
+// HasBody reports whether the packet carries a body, which may be empty, such as an empty struct,
+// as opposed to no body at all.
+// Note:
+//  the nil body is written with NilCodecId,
+//  and any other body, even if it is marshalled to zero bytes, with its body codec id;
+//  so for the packet read, it is true if the body codec id is not NilCodecId,
+//  or if there are any body bytes, which are sent without the body codec;
+//  for the packet to write, it is also true if the body is to be written with the default codec.
+func (p *Packet) HasBody() bool {
+	if p.bodyCodec != codec.NilCodecId || len(p.RawBody()) > 0 {
+		return true
+	}
+	switch p.body.(type) {
+	case nil, []byte, *[]byte:
+		return false
+	}
+	// the body created for reading is not received
+	return !p.bodyRead
+}
+
+// RawBody returns the body bytes if the body is a stream of bytes,
+// or the body bytes kept by WithKeepRawBody, else returns nil.
+// Note:
+//  reading with a *[]byte body keeps the received bytes as they are, whatever the body codec is,
+//  so they can be forwarded verbatim by WithBody and WithBodyCodec;
+//  for the typed body, the bytes are kept only if the packet is read WithKeepRawBody;
+//  the bytes in a reused buffer are only valid until PutPacket.
+func (p *Packet) RawBody() []byte {
+	switch body := p.body.(type) {
+	case []byte:
+		return body
+	case *[]byte:
+		if body != nil {
+			return *body
+		}
+	}
+	if p.keepRawBody {
+		return p.rawBody
+	}
+	return nil
+}
+
 // SetBody sets the body object
 func (p *Packet) SetBody(body interface{}) {
 	p.body = body
 }
 
+// SetBodyBytes sets the body bytes encoded already by the codec of codecId,
+// which are written as they are, without marshalling.
+// Note:
+//  it is useful for forwarding the cached encoded bodies whose types are unknown;
+//  the bytes are not copied, so they must not be modified until written;
+//  Reset clears them.
+func (p *Packet) SetBodyBytes(codecId byte, data []byte) {
+	p.bodyCodec = codecId
+	p.body = data
+}
+
+// BodyPool is the pool of the body objects, such as *sync.Pool.
+type BodyPool interface {
+	// Put adds the body to the pool.
+	Put(body interface{})
+}
+
+// SetBodyPool sets the pool that PutPacket returns the body to,
+// such as the *sync.Pool that newBodyFunc gets the body from.
+// Note:
+//  it replaces the function set by WithBodyReclaim;
+//  the nil body is not returned;
+//  the body is returned once, and Reset clears it without returning it;
+//  the body must not be referenced after PutPacket.
+func (p *Packet) SetBodyPool(pool BodyPool) {
+	p.bodyReclaim = func(body interface{}) {
+		if body != nil {
+			pool.Put(body)
+		}
+	}
+}
+
 // SetNewBody resets the function of geting body.
 func (p *Packet) SetNewBody(newBodyFunc NewBodyFunc) {
 	p.newBodyFunc = newBodyFunc
 }
 
 // MarshalBody returns the encoding of body.
-// Note: when the body is a stream of bytes, no marshalling is done.
+// Note:
+//  when the body is a stream of bytes, no marshalling is done;
+//  when the body codec is not set, the one named by the body is used
+//  if it implements CodecNamer, otherwise DefaultBodyCodec,
+//  and the packet is not changed, see ResolveBodyCodec;
+//  if the body codec reports by codec.BodyChecker that it does not support the body,
+//  *ErrBodyCodecMismatch is returned without marshalling.
 func (p *Packet) MarshalBody() ([]byte, error) {
 	switch body := p.body.(type) {
 	default:
-		c, err := codec.Get(p.bodyCodec)
+		c, err := p.getBodyCodec()
 		if err != nil {
 			return []byte{}, err
 		}
@@ -302,12 +750,154 @@ func (p *Packet) MarshalBody() ([]byte, error) {
 	}
 }
 
+// MarshalBodyTo writes the encoding of body to w.
+// Note:
+//  if the body codec implements codec.StreamCodec,
+//  the body is encoded directly to w.
+func (p *Packet) MarshalBodyTo(w io.Writer) error {
+	switch p.body.(type) {
+	case nil, *[]byte, []byte:
+	default:
+		c, err := p.getBodyCodec()
+		if err != nil {
+			return err
+		}
+		if sc, ok := c.(codec.StreamCodec); ok {
+			return sc.EncodeTo(w, p.body)
+		}
+	}
+	bodyBytes, err := p.MarshalBody()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(bodyBytes)
+	return err
+}
+
+// CodecNamer is implemented by the body that declares its own codec,
+// which is used when the body codec of the packet is not set.
+type CodecNamer interface {
+	// CodecName returns the name of the body codec.
+	CodecName() string
+}
+
+// ErrBodyCodecMismatch is returned when marshalling a body,
+// whose type is not supported by the body codec.
+type ErrBodyCodecMismatch struct {
+	// Codec is the name of the body codec.
+	Codec string
+	// BodyType is the concrete type of the body.
+	BodyType reflect.Type
+}
+
+// Error implements error.
+func (e *ErrBodyCodecMismatch) Error() string {
+	return fmt.Sprintf("socket: the body codec %q does not support the body type %s", e.Codec, e.BodyType)
+}
+
+// getBodyCodec returns the body codec, which is resolved if it is not set,
+// and checks that the codec supports the body if it implements codec.BodyChecker.
+func (p *Packet) getBodyCodec() (codec.Codec, error) {
+	id, err := p.resolveBodyCodec()
+	if err != nil {
+		return nil, err
+	}
+	c, err := codec.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if checker, ok := c.(codec.BodyChecker); ok && !checker.CanMarshal(p.body) {
+		return nil, &ErrBodyCodecMismatch{Codec: c.Name(), BodyType: reflect.TypeOf(p.body)}
+	}
+	return c, nil
+}
+
+// ResolveBodyCodec returns the body codec to be written into the frame,
+// without setting it to the packet.
+// Note:
+//  it is NilCodecId for the nil body,
+//  the body codec of the packet for the stream of bytes or if it is set,
+//  otherwise the one that MarshalBody uses.
+func (p *Packet) ResolveBodyCodec() (byte, error) {
+	switch p.body.(type) {
+	case nil:
+		// the nil body is no body, unlike the empty one
+		return codec.NilCodecId, nil
+	case []byte, *[]byte:
+		return p.bodyCodec, nil
+	}
+	return p.resolveBodyCodec()
+}
+
+// resolveBodyCodec returns the body codec, or the one named by the body if it is not set,
+// or DefaultBodyCodec.
+func (p *Packet) resolveBodyCodec() (byte, error) {
+	if p.bodyCodec != codec.NilCodecId {
+		return p.bodyCodec, nil
+	}
+	if namer, ok := p.body.(CodecNamer); ok {
+		c, err := codec.GetByName(namer.CodecName())
+		if err != nil {
+			return codec.NilCodecId, err
+		}
+		return c.Id(), nil
+	}
+	return defaultBodyCodec, nil
+}
+
 // UnmarshalBody unmarshals the encoded data to the body.
 // Note:
 //  seq, ptype, uri must be setted already;
 //  if body=nil, try to use newBodyFunc to create a new one;
-//  when the body is a stream of bytes, no unmarshalling is done.
+//  when the body is a stream of bytes, no unmarshalling is done;
+//  when the body is *[]byte, the data is copied into a new slice,
+//  or into its existing capacity if WithReuseBodyBuffer,
+//  then the caller owns the buffer and must not reuse it while still referenced;
+//  if body=nil and the function set by WithNewBodyCheck rejects the packet,
+//  its error is returned.
 func (p *Packet) UnmarshalBody(bodyBytes []byte) error {
+	p.bodyRead = true
+	if p.body == nil && p.newBodyCheck != nil {
+		body, err := p.newBodyCheck(p, len(bodyBytes))
+		if err != nil {
+			return err
+		}
+		p.body = body
+	}
+	if p.keepRawBody {
+		p.rawBody = append(p.rawBody[:0], bodyBytes...)
+	}
+	if p.lazy.enabled {
+		p.lazy.data = append(p.lazy.data[:0], bodyBytes...)
+		p.lazy.pending = true
+		p.lazy.err = nil
+		return nil
+	}
+	return p.unmarshalBody(bodyBytes)
+}
+
+// lazyBody is the body bytes of the packet read with WithLazyBody.
+type lazyBody struct {
+	enabled bool
+	pending bool
+	data    []byte
+	err     error
+}
+
+// DecodeBody unmarshals the body bytes kept by WithLazyBody to the body,
+// as UnmarshalBody does when reading eagerly.
+// Note:
+//  the body bytes are decoded once, and the later calls return the same error;
+//  it does nothing if the body is not read lazily.
+func (p *Packet) DecodeBody() error {
+	if p.lazy.pending {
+		p.lazy.pending = false
+		p.lazy.err = p.unmarshalBody(p.lazy.data)
+	}
+	return p.lazy.err
+}
+
+func (p *Packet) unmarshalBody(bodyBytes []byte) error {
 	if p.body == nil && p.newBodyFunc != nil {
 		p.body = p.newBodyFunc(p)
 	}
@@ -324,7 +914,12 @@ func (p *Packet) UnmarshalBody(bodyBytes []byte) error {
 	case nil:
 		return nil
 	case *[]byte:
-		if body != nil {
+		if body == nil {
+			return nil
+		}
+		if p.reuseBodyBuffer {
+			*body = append((*body)[:0], bodyBytes...)
+		} else {
 			*body = make([]byte, len(bodyBytes))
 			copy(*body, bodyBytes)
 		}
@@ -338,6 +933,143 @@ func (p *Packet) XferPipe() *xfer.XferPipe {
 	return p.xferPipe
 }
 
+// TotalSize returns the number of bytes the packet takes on the wire,
+// with the protocol of protoFunc, or the default protocol if not specified.
+// Note:
+//  the packet is packed and the bytes are discarded,
+//  so the size of packet is set as well.
+func (p *Packet) TotalSize(protoFunc ...ProtoFunc) (int64, error) {
+	var w countWriter
+	err := getProto(protoFunc, &w).Pack(p)
+	return int64(w), err
+}
+
+// Encode returns the frame bytes of the packet on the wire,
+// with the protocol of protoFunc, or the default protocol if not specified.
+// Note:
+//  the transfer filters, such as compression, are applied,
+//  so the result can be stored and parsed back by DecodePacket.
+func (p *Packet) Encode(protoFunc ...ProtoFunc) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := getProto(protoFunc, &buf).Pack(p); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ErrNeedMore the error that the data is not a whole packet.
+var ErrNeedMore = errors.New("socket: need more data to decode the packet")
+
+// DecodePacket parses the first packet encoded by Encode in data,
+// and returns the packet and the number of bytes consumed,
+// with the protocol of protoFunc, or the default protocol if not specified.
+// If data is not a whole packet, it returns ErrNeedMore.
+// Note:
+//  newBodyFunc creates the body object, as WithNewBody does;
+//  the number of bytes consumed is the size of the packet,
+//  so the protocol must set it, as the default raw protocol does.
+func DecodePacket(data []byte, newBodyFunc NewBodyFunc, protoFunc ...ProtoFunc) (*Packet, int, error) {
+	r := &decodeReader{data: data}
+	p := NewPacket(WithNewBody(newBodyFunc))
+	if err := getProto(protoFunc, r).Unpack(p); err != nil {
+		if r.exhausted {
+			return nil, 0, ErrNeedMore
+		}
+		return nil, 0, err
+	}
+	return p, int(p.Size()), nil
+}
+
+// Decoder reads the packets from a stream that is not a connection,
+// such as a file of the captured frames or a bytes.Buffer.
+type Decoder struct {
+	proto Proto
+}
+
+// NewDecoder returns a Decoder reading from r,
+// with the protocol of protoFunc, or the default protocol if not specified.
+// Note: the protocol may read ahead, so r should not be read by others after that.
+func NewDecoder(r io.Reader, protoFunc ...ProtoFunc) *Decoder {
+	return &Decoder{proto: getProto(protoFunc, readOnly{r})}
+}
+
+// Decode reads the next packet, whose body is created by newBodyFunc, as WithNewBody does.
+// It returns io.EOF if the stream ends between the packets,
+// or io.ErrUnexpectedEOF if it ends in a packet.
+func (d *Decoder) Decode(newBodyFunc NewBodyFunc) (*Packet, error) {
+	p := NewPacket(WithNewBody(newBodyFunc))
+	if err := d.proto.Unpack(p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Encoder writes the packets to a stream that is not a connection, such as a file.
+type Encoder struct {
+	proto Proto
+}
+
+// NewEncoder returns an Encoder writing to w,
+// with the protocol of protoFunc, or the default protocol if not specified.
+func NewEncoder(w io.Writer, protoFunc ...ProtoFunc) *Encoder {
+	return &Encoder{proto: getProto(protoFunc, writeOnly{w})}
+}
+
+// Encode writes the packet, which can be read back by Decoder.
+func (e *Encoder) Encode(p *Packet) error {
+	return e.proto.Pack(p)
+}
+
+// readOnly adapts an io.Reader to the protocol that is never written.
+type readOnly struct {
+	io.Reader
+}
+
+func (readOnly) Write([]byte) (int, error) {
+	return 0, io.ErrShortWrite
+}
+
+// writeOnly adapts an io.Writer to the protocol that is never read.
+type writeOnly struct {
+	io.Writer
+}
+
+func (writeOnly) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+// decodeReader reads data, and records whether more is wanted than data.
+type decodeReader struct {
+	data      []byte
+	exhausted bool
+}
+
+func (r *decodeReader) Read(b []byte) (int, error) {
+	if len(r.data) == 0 {
+		r.exhausted = true
+		return 0, io.EOF
+	}
+	n := copy(b, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func (r *decodeReader) Write([]byte) (int, error) {
+	return 0, io.ErrShortWrite
+}
+
+// countWriter counts and discards the written bytes.
+type countWriter int64
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	*w += countWriter(len(b))
+	return len(b), nil
+}
+
+func (w *countWriter) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
 // Size returns the size of packet.
 func (p *Packet) Size() uint32 {
 	return p.size
@@ -358,6 +1090,7 @@ const packetFormat = `
 {
   "seq": %q,
   "ptype": %d,
+  "type_name": %q,
   "uri": %q,
   "meta": %q,
   "body_codec": %d,
@@ -373,12 +1106,18 @@ func (p *Packet) String() string {
 		xferPipeIds[i] = int(id)
 	}
 	idsBytes, _ := json.Marshal(xferPipeIds)
-	b, _ := json.Marshal(p.body)
+	var b []byte
+	if n := bodySize(p.body); n > StringBodyLimit() {
+		b = []byte(fmt.Sprintf(`"<%d bytes omitted>"`, n))
+	} else {
+		b, _ = json.Marshal(p.body)
+	}
 	dst := bytes.NewBuffer(make([]byte, 0, len(b)*2))
 	json.Indent(dst, goutil.StringToBytes(
 		fmt.Sprintf(packetFormat,
 			p.seq,
 			p.ptype,
+			PtypeName(p.ptype),
 			p.uri,
 			p.meta.QueryString(),
 			p.bodyCodec,
@@ -390,6 +1129,267 @@ func (p *Packet) String() string {
 	return goutil.BytesToString(dst.Bytes())
 }
 
+// packetJSON is the JSON representation of Packet.
+type packetJSON struct {
+	Seq       string          `json:"seq"`
+	Ptype     json.RawMessage `json:"ptype"`
+	TypeName  string          `json:"type_name,omitempty"`
+	Uri       string          `json:"uri"`
+	Meta      string          `json:"meta"`
+	BodyCodec byte            `json:"body_codec"`
+	Body      []byte          `json:"body"`
+	XferPipe  []int           `json:"xfer_pipe"`
+}
+
+// MarshalJSON encodes the packet as JSON with the field names,
+// the body is encoded by its body codec and then base64.
+// Note:
+//  the packet type is also rendered as `type_name` when the name is registered;
+//  only for debugging and storing, the wire format is unchanged.
+func (p *Packet) MarshalJSON() ([]byte, error) {
+	bodyBytes, err := p.MarshalBody()
+	if err != nil {
+		return nil, err
+	}
+	var xferPipeIds = make([]int, p.xferPipe.Len())
+	for i, id := range p.xferPipe.Ids() {
+		xferPipeIds[i] = int(id)
+	}
+	return json.Marshal(&packetJSON{
+		Seq:       p.seq,
+		Ptype:     json.RawMessage(strconv.Itoa(int(p.ptype))),
+		TypeName:  PtypeName(p.ptype),
+		Uri:       p.Uri(),
+		Meta:      goutil.BytesToString(p.meta.QueryString()),
+		BodyCodec: p.bodyCodec,
+		Body:      bodyBytes,
+		XferPipe:  xferPipeIds,
+	})
+}
+
+// UnmarshalJSON decodes the packet from JSON.
+// Note:
+//  `ptype` can be either the number or the registered name;
+//  the body is unmarshalled into the body object set by the newBodyFunc or Body.
+func (p *Packet) UnmarshalJSON(data []byte) error {
+	var pj packetJSON
+	err := json.Unmarshal(data, &pj)
+	if err != nil {
+		return err
+	}
+	ptype, err := parsePtype(pj.Ptype)
+	if err != nil {
+		return err
+	}
+	p.seq = pj.Seq
+	p.ptype = ptype
+	p.SetUri(pj.Uri)
+	p.meta.Reset()
+	p.meta.Parse(pj.Meta)
+	p.bodyCodec = pj.BodyCodec
+	p.xferPipe.Reset()
+	for _, id := range pj.XferPipe {
+		if id < 0 || id > math.MaxUint8 {
+			return fmt.Errorf("invalid xfer filter id %d", id)
+		}
+		if err = p.xferPipe.Append(byte(id)); err != nil {
+			return err
+		}
+	}
+	return p.UnmarshalBody(pj.Body)
+}
+
+func parsePtype(raw json.RawMessage) (byte, error) {
+	if len(raw) == 0 {
+		return 0, nil
+	}
+	if raw[0] == '"' {
+		var name string
+		if err := json.Unmarshal(raw, &name); err != nil {
+			return 0, err
+		}
+		ptype, ok := PtypeByName(name)
+		if !ok {
+			return 0, fmt.Errorf("unknown packet type name %q", name)
+		}
+		return ptype, nil
+	}
+	var ptype byte
+	if err := json.Unmarshal(raw, &ptype); err != nil {
+		return 0, err
+	}
+	return ptype, nil
+}
+
+var ptypeNames = struct {
+	sync.RWMutex
+	names    map[byte]string
+	types    map[string]byte
+	reserved map[byte]bool
+}{
+	names: map[byte]string{
+		PtypeHeartbeat: "HEARTBEAT",
+		PtypeNegotiate: "NEGOTIATE",
+		PtypeMux:       "MUX",
+	},
+	types: map[string]byte{
+		"HEARTBEAT": PtypeHeartbeat,
+		"NEGOTIATE": PtypeNegotiate,
+		"MUX":       PtypeMux,
+	},
+	reserved: map[byte]bool{
+		PtypeHeartbeat: true,
+		PtypeNegotiate: true,
+		PtypeMux:       true,
+	},
+}
+
+// RegPtypeName registers the name of the packet type,
+// it's used by the String output and the JSON representation of Packet.
+// Note:
+//  the reserved PtypeHeartbeat, PtypeNegotiate and PtypeMux are pre-registered,
+//  and the upper layer reserves its types by ReservePtypeName, such as the request, response and push types;
+//  panic if the type or the name is reserved;
+//  the name registered for another type is moved to this type.
+func RegPtypeName(ptype byte, name string) {
+	ptypeNames.Lock()
+	defer ptypeNames.Unlock()
+	regPtypeName(ptype, name)
+}
+
+// ReservePtypeName registers the name of the packet type as RegPtypeName,
+// and reserves both, so that they can not be registered again.
+// Note: panic if the type or the name is reserved already.
+func ReservePtypeName(ptype byte, name string) {
+	ptypeNames.Lock()
+	defer ptypeNames.Unlock()
+	regPtypeName(ptype, name)
+	ptypeNames.reserved[ptype] = true
+}
+
+// regPtypeName registers the name of the packet type, ptypeNames must be locked.
+func regPtypeName(ptype byte, name string) {
+	if ptypeNames.reserved[ptype] {
+		panic(fmt.Sprintf("socket: RegPtypeName: the packet type %d is reserved", ptype))
+	}
+	if other, ok := ptypeNames.types[name]; ok && ptypeNames.reserved[other] {
+		panic(fmt.Sprintf("socket: RegPtypeName: the name %q is reserved", name))
+	} else if ok {
+		delete(ptypeNames.names, other)
+	}
+	if old, ok := ptypeNames.names[ptype]; ok {
+		delete(ptypeNames.types, old)
+	}
+	ptypeNames.names[ptype] = name
+	ptypeNames.types[name] = ptype
+}
+
+// PtypeName returns the registered name of the packet type.
+// If the type is not registered returns "".
+func PtypeName(ptype byte) string {
+	ptypeNames.RLock()
+	defer ptypeNames.RUnlock()
+	return ptypeNames.names[ptype]
+}
+
+// PtypeByName returns the packet type registered under the name.
+func PtypeByName(name string) (byte, bool) {
+	ptypeNames.RLock()
+	defer ptypeNames.RUnlock()
+	ptype, ok := ptypeNames.types[name]
+	return ptype, ok
+}
+
+var stringBodyLimit = 4096
+
+// StringBodyLimit returns the body size upper limit of Packet.String,
+// the bigger body is printed as a placeholder.
+func StringBodyLimit() int {
+	return stringBodyLimit
+}
+
+// SetStringBodyLimit sets the body size upper limit of Packet.String.
+// If n<0, the body is always printed.
+func SetStringBodyLimit(n int) {
+	if n < 0 {
+		stringBodyLimit = math.MaxInt32
+	} else {
+		stringBodyLimit = n
+	}
+}
+
+// bodySize returns the body size, it is estimated if the body is not a stream of bytes.
+// Note: the estimation stops once the size is bigger than StringBodyLimit.
+func bodySize(body interface{}) int {
+	switch b := body.(type) {
+	case nil:
+		return 0
+	case []byte:
+		return len(b)
+	case *[]byte:
+		if b == nil {
+			return 0
+		}
+		return len(*b)
+	case string:
+		return len(b)
+	}
+	return estimateSize(reflect.ValueOf(body), 0, StringBodyLimit(), make(map[uintptr]struct{}))
+}
+
+// estimateSize roughly estimates the encoding size of the value without marshalling it.
+// It returns as soon as the size is bigger than budget,
+// and counts the value of a pointer once, which bounds the walk of a self-referencing body.
+func estimateSize(v reflect.Value, depth, budget int, visited map[uintptr]struct{}) int {
+	if depth > 32 {
+		return 0
+	}
+	depth++
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return 4
+		}
+		if v.Kind() == reflect.Ptr {
+			if _, ok := visited[v.Pointer()]; ok {
+				return 4
+			}
+			visited[v.Pointer()] = struct{}{}
+		}
+		return estimateSize(v.Elem(), depth, budget, visited)
+	case reflect.String:
+		return v.Len() + 2
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return v.Len()
+		}
+		n := 2
+		for i := 0; i < v.Len() && n <= budget; i++ {
+			n += estimateSize(v.Index(i), depth, budget-n, visited) + 1
+		}
+		return n
+	case reflect.Map:
+		n := 2
+		iter := v.MapRange()
+		for n <= budget && iter.Next() {
+			n += estimateSize(iter.Key(), depth, budget-n, visited) + 2
+			n += estimateSize(iter.Value(), depth, budget-n, visited)
+		}
+		return n
+	case reflect.Struct:
+		n := 2
+		t := v.Type()
+		for i := 0; i < v.NumField() && n <= budget; i++ {
+			n += len(t.Field(i).Name) + estimateSize(v.Field(i), depth, budget-n, visited) + 4
+		}
+		return n
+	case reflect.Invalid:
+		return 4
+	default:
+		return 8
+	}
+}
+
 // PacketSetting is a pipe function type for setting socket package.
 type PacketSetting func(*Packet)
 
@@ -407,6 +1407,21 @@ func WithSeq(seq string) PacketSetting {
 	}
 }
 
+// WithAutoSeq sets the packet sequence to the next one of the socket.
+func WithAutoSeq(s Socket) PacketSetting {
+	return func(p *Packet) {
+		p.seq = strconv.FormatUint(s.NextSeq(), 10)
+	}
+}
+
+// WithEchoSeq sets the packet sequence to the one of the request packet,
+// it's used for replying.
+func WithEchoSeq(req Header) PacketSetting {
+	return func(p *Packet) {
+		p.seq = req.Seq()
+	}
+}
+
 // WithPtype sets the packet type.
 func WithPtype(ptype byte) PacketSetting {
 	return func(p *Packet) {
@@ -461,12 +1476,84 @@ func WithBodyCodec(bodyCodec byte) PacketSetting {
 }
 
 // WithBody sets the body object.
+// Note:
+//  for writing, it is the object to be marshalled with the body codec;
+//  for reading, the body is unmarshalled into it, and newBodyFunc is not called.
 func WithBody(body interface{}) PacketSetting {
 	return func(p *Packet) {
 		p.body = body
 	}
 }
 
+// WithBodyReclaim sets the function that PutPacket hands the body to,
+// such as the Put method of a sync.Pool the body came from.
+// Note:
+//  it is called once, and Reset clears it without calling it;
+//  the body must not be referenced after it is reclaimed.
+func WithBodyReclaim(reclaim func(body interface{})) PacketSetting {
+	return func(p *Packet) {
+		p.bodyReclaim = reclaim
+	}
+}
+
+// WithBodyPool sets the pool that PutPacket returns the body to.
+// Note: see SetBodyPool.
+func WithBodyPool(pool BodyPool) PacketSetting {
+	return func(p *Packet) {
+		p.SetBodyPool(pool)
+	}
+}
+
+// WithLazyBody makes the reading keep the body bytes, after the transfer filters,
+// instead of unmarshalling them, until DecodeBody is called.
+// Note:
+//  it saves the decoding of the bodies discarded after routing on the header;
+//  neither the body is unmarshalled nor newBodyFunc is called before DecodeBody;
+//  Reset clears it.
+func WithLazyBody() PacketSetting {
+	return func(p *Packet) {
+		p.lazy.enabled = true
+	}
+}
+
+// WithReuseBodyBuffer makes the reading decode the *[]byte body into its existing capacity,
+// instead of a new slice, so a NewBodyFunc can return the same buffer for every packet.
+// Note:
+//  the caller owns the buffer, and must not reuse it while a previous body is still referenced;
+//  Reset clears it.
+func WithReuseBodyBuffer() PacketSetting {
+	return func(p *Packet) {
+		p.reuseBodyBuffer = true
+	}
+}
+
+// WithKeepRawBody makes the reading keep a copy of the body bytes, after the transfer filters,
+// besides unmarshalling them, so that RawBody returns them for the typed body as well,
+// such as for forwarding the body verbatim after inspecting it.
+// Note:
+//  the bytes are valid until the packet is reset;
+//  Reset clears it.
+func WithKeepRawBody() PacketSetting {
+	return func(p *Packet) {
+		p.keepRawBody = true
+	}
+}
+
+// WithNewBodyCheck sets the function that creates the body by the decoded header
+// and the length of the body bytes, or rejects the packet by returning an error,
+// such as for the unauthorized URI or the oversized body.
+// Note:
+//  the rejected frame is consumed whole, so the connection can still be read,
+//  and the error is returned by the reading with the header decoded;
+//  it is called before newBodyFunc, which is used if it returns a nil body;
+//  it is called at reading even if WithLazyBody;
+//  Reset clears it.
+func WithNewBodyCheck(fn NewBodyCheckFunc) PacketSetting {
+	return func(p *Packet) {
+		p.newBodyCheck = fn
+	}
+}
+
 // WithNewBody resets the function of geting body.
 func WithNewBody(newBodyFunc NewBodyFunc) PacketSetting {
 	return func(p *Packet) {
@@ -474,6 +1561,45 @@ func WithNewBody(newBodyFunc NewBodyFunc) PacketSetting {
 	}
 }
 
+// TypeBodyRegistry maps the packet types to the factories of the bodies,
+// which replaces the switch on Ptype in a NewBodyFunc by the registration.
+// Note: it is safe for concurrent use.
+type TypeBodyRegistry struct {
+	mu        sync.RWMutex
+	factories map[byte]func() interface{}
+}
+
+// Register registers the factory of the body of the packet type.
+// Note: panic if the packet type is already registered, or the factory is nil.
+func (r *TypeBodyRegistry) Register(ptype byte, factory func() interface{}) {
+	if factory == nil {
+		panic(fmt.Sprintf("socket: the body factory of the packet type %d is nil", ptype))
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.factories[ptype]; ok {
+		panic(fmt.Sprintf("socket: multi-register the body factory of the packet type %d", ptype))
+	}
+	if r.factories == nil {
+		r.factories = make(map[byte]func() interface{})
+	}
+	r.factories[ptype] = factory
+}
+
+// NewBodyFunc returns the NewBodyFunc that creates the body by the factory of the packet type,
+// or returns nil if the type is not registered, such as for WithNewBody.
+func (r *TypeBodyRegistry) NewBodyFunc() NewBodyFunc {
+	return func(header Header) interface{} {
+		r.mu.RLock()
+		factory := r.factories[header.Ptype()]
+		r.mu.RUnlock()
+		if factory == nil {
+			return nil
+		}
+		return factory()
+	}
+}
+
 // WithXferPipe sets transfer filter pipe.
 // NOTE:
 //  panic if the filterId is not registered
@@ -485,6 +1611,66 @@ func WithXferPipe(filterId ...byte) PacketSetting {
 	}
 }
 
+// WithBodyCompress appends the compression transfer filter registered by the name,
+// which compresses the body at the level.
+// NOTE:
+//  panic if the filter is not registered, has no compression level,
+//  or the level is out of its range, see xfer.GetLevel;
+//  the peer decompresses it with the filter registered by the same id.
+func WithBodyCompress(algo string, level int) PacketSetting {
+	filter, err := xfer.GetLevel(algo, level)
+	if err != nil {
+		panic(err)
+	}
+	return func(p *Packet) {
+		if err := p.xferPipe.AppendFilter(filter); err != nil {
+			panic(err)
+		}
+	}
+}
+
+var defaultBodyCodec byte = codec.ID_JSON
+
+var unsafeStringDecode int32
+
+// UnsafeStringDecode returns whether the seq and URI strings of the read packets
+// alias the read buffer instead of being copied.
+func UnsafeStringDecode() bool {
+	return atomic.LoadInt32(&unsafeStringDecode) == 1
+}
+
+// SetUnsafeStringDecode sets whether the seq and URI strings of the read packets
+// alias the read buffer instead of being copied, which saves the allocations
+// of the read-heavy servers that route on the URI and then recycle the packet.
+// Note:
+//  DANGER! the strings, including the parsed URI object and query,
+//  are only valid until the packet is reset, put back by PutPacket or read again,
+//  and then they change silently, so they must not be retained, such as in a map key;
+//  copy them, such as by string([]byte(s)), to keep them;
+//  Clone and ResetKeep copy them already;
+//  the default is false.
+func SetUnsafeStringDecode(unsafe bool) {
+	if unsafe {
+		atomic.StoreInt32(&unsafeStringDecode, 1)
+	} else {
+		atomic.StoreInt32(&unsafeStringDecode, 0)
+	}
+}
+
+// DefaultBodyCodec returns the codec id used when a body is set
+// but the body codec is not.
+func DefaultBodyCodec() byte {
+	return defaultBodyCodec
+}
+
+// SetDefaultBodyCodec sets the codec used when a body is set
+// but the body codec is not.
+// NOTE:
+//  panic if the codec name is not registered
+func SetDefaultBodyCodec(codecName string) {
+	defaultBodyCodec = codec.MustGetByName(codecName).Id()
+}
+
 var (
 	packetSizeLimit uint32 = math.MaxUint32
 	// ErrExceedPacketSizeLimit error
@@ -512,3 +1698,49 @@ func checkPacketSize(packetSize uint32) error {
 	}
 	return nil
 }
+
+var (
+	maxHeaderLength int64 = 1 << 20
+	// ErrHeaderTooLarge error
+	ErrHeaderTooLarge = errors.New("Size of header exceeds limit.")
+)
+
+// MaxHeaderLength gets the header size upper limit of reading.
+func MaxHeaderLength() int {
+	return int(atomic.LoadInt64(&maxHeaderLength))
+}
+
+// SetMaxHeaderLength sets max header size.
+// If n<=0, set it to the default 1MB.
+func SetMaxHeaderLength(n int) {
+	if n <= 0 {
+		n = 1 << 20
+	}
+	atomic.StoreInt64(&maxHeaderLength, int64(n))
+}
+
+var (
+	maxBodyLength int64 = 1 << 26
+	// ErrBodyTooLarge error
+	ErrBodyTooLarge = errors.New("Size of body exceeds limit.")
+	// ErrOversizedFrameDrained the oversized frame is discarded to keep the connection in sync,
+	// so the next packet can still be read.
+	ErrOversizedFrameDrained = errors.New("socket: the oversized frame is discarded")
+)
+
+// MaxBodyLength gets the body size upper limit of reading.
+func MaxBodyLength() int64 {
+	return maxBodyLength
+}
+
+// SetMaxBodyLength sets max body size.
+// If n<=0, set it to the default 64MB.
+// Note:
+//  it can be overridden per socket by Socket.SetMaxBodyLength.
+func SetMaxBodyLength(n int64) {
+	if n <= 0 {
+		maxBodyLength = 1 << 26
+	} else {
+		maxBodyLength = n
+	}
+}
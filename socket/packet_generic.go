@@ -0,0 +1,41 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build go1.18
+
+package socket
+
+import (
+	"fmt"
+)
+
+// BodyAs returns the body of the packet as T, with a descriptive error
+// naming the actual type if the body is not a T.
+// Note:
+//  if the body is a *T, such as the one created by newBodyFunc, it is dereferenced;
+//  a nil body returns the zero T and an error.
+func BodyAs[T any](p *Packet) (T, error) {
+	var zero T
+	switch body := p.Body().(type) {
+	case T:
+		return body, nil
+	case *T:
+		if body != nil {
+			return *body, nil
+		}
+	case nil:
+		return zero, fmt.Errorf("socket: the body is nil, want %T", zero)
+	}
+	return zero, fmt.Errorf("socket: the body is %T, want %T", p.Body(), zero)
+}
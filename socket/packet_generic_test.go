@@ -0,0 +1,38 @@
+// +build go1.18
+
+package socket
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBodyAs(t *testing.T) {
+	type user struct{ Name string }
+	u, err := BodyAs[user](NewPacket(WithBody(user{Name: "a"})))
+	if err != nil || u.Name != "a" {
+		t.Fatalf("user: %+v, error: %v", u, err)
+	}
+	// the pointer body read by newBodyFunc
+	u, err = BodyAs[user](NewPacket(WithBody(&user{Name: "b"})))
+	if err != nil || u.Name != "b" {
+		t.Fatalf("user: %+v, error: %v", u, err)
+	}
+	up, err := BodyAs[*user](NewPacket(WithBody(&user{Name: "c"})))
+	if err != nil || up.Name != "c" {
+		t.Fatalf("user: %+v, error: %v", up, err)
+	}
+
+	_, err = BodyAs[user](NewPacket(WithBody(map[string]string{"Name": "d"})))
+	if err == nil || !strings.Contains(err.Error(), "map[string]string") || !strings.Contains(err.Error(), "socket.user") {
+		t.Fatalf("the error should name both types: %v", err)
+	}
+	_, err = BodyAs[user](NewPacket(WithBody((*user)(nil))))
+	if err == nil || !strings.Contains(err.Error(), "*socket.user") {
+		t.Fatalf("the nil pointer body should fail: %v", err)
+	}
+
+	if _, err = BodyAs[*user](NewPacket()); err == nil || !strings.Contains(err.Error(), "nil") {
+		t.Fatalf("the nil body should fail: %v", err)
+	}
+}
@@ -1,7 +1,21 @@
 package socket
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/url"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/henrylee2cn/teleport/codec"
 )
 
 func TestPacketString(t *testing.T) {
@@ -19,3 +33,806 @@ func TestPacketString(t *testing.T) {
 	t.Logf("%%#v:%#v", p)
 	t.Logf("%%+v:%+v", p)
 }
+
+func TestPacketStringTypeName(t *testing.T) {
+	// a fresh type for each run, the registration can not be undone
+	ptype := byte(0xe2)
+	for PtypeName(ptype) != "" {
+		ptype++
+	}
+	p := NewPacket(WithPtype(ptype))
+	if !strings.Contains(p.String(), `"type_name": ""`) {
+		t.Fatalf("the unregistered type should have no name: %s", p.String())
+	}
+	RegPtypeName(ptype, "CUSTOM")
+	if !strings.Contains(p.String(), `"type_name": "CUSTOM"`) {
+		t.Fatalf("the registered type name should be printed: %s", p.String())
+	}
+	if PtypeName(PtypeHeartbeat) != "HEARTBEAT" || PtypeName(PtypeNegotiate) != "NEGOTIATE" {
+		t.Fatal("the reserved types should be pre-registered")
+	}
+}
+
+func TestRegPtypeName(t *testing.T) {
+	RegPtypeName(0xd0, "MOVED")
+	RegPtypeName(0xd1, "MOVED")
+	if PtypeName(0xd0) != "" || PtypeName(0xd1) != "MOVED" {
+		t.Fatalf("got names %q and %q", PtypeName(0xd0), PtypeName(0xd1))
+	}
+	if ptype, ok := PtypeByName("MOVED"); !ok || ptype != 0xd1 {
+		t.Fatalf("got type %d, %v", ptype, ok)
+	}
+	for _, reg := range []func(){
+		func() { RegPtypeName(PtypeHeartbeat, "PING") },
+		func() { RegPtypeName(0xd2, "MUX") },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("the reserved type and name should not be overwritten")
+				}
+			}()
+			reg()
+		}()
+	}
+	if PtypeName(PtypeHeartbeat) != "HEARTBEAT" || PtypeName(PtypeMux) != "MUX" || PtypeName(0xd2) != "" {
+		t.Fatal("the reserved types should keep their names")
+	}
+
+	// the types reserved by the upper layer
+	if PtypeName(0xd3) != "RESERVED" {
+		ReservePtypeName(0xd3, "RESERVED")
+	}
+	for _, reg := range []func(){
+		func() { RegPtypeName(0xd3, "X") },
+		func() { RegPtypeName(0xd4, "RESERVED") },
+		func() { ReservePtypeName(0xd3, "RESERVED") },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("the reserved type and name should not be registered again")
+				}
+			}()
+			reg()
+		}()
+	}
+}
+
+func TestPacketBodyCodecNotFilled(t *testing.T) {
+	p := NewPacket(WithBody(map[string]int{"a": 1}))
+	_ = p.String()
+	if _, err := json.Marshal(p); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.TotalSize(); err != nil {
+		t.Fatal(err)
+	}
+	if p.BodyCodec() != codec.NilCodecId {
+		t.Fatalf("the body codec is set by the reading methods: %d", p.BodyCodec())
+	}
+}
+
+func TestPacketStringBodyLimit(t *testing.T) {
+	p := NewPacket(WithBody(map[string]string{"a": "b"}))
+	if !strings.Contains(p.String(), `"a": "b"`) {
+		t.Fatalf("the small body should be printed: %s", p.String())
+	}
+	p.SetBody(make([]byte, 10000))
+	if !strings.Contains(p.String(), `"body": "<10000 bytes omitted>"`) {
+		t.Fatalf("the large body should be omitted: %s", p.String())
+	}
+	p.SetBody(map[string][]string{"a": make([]string, 5000)})
+	if s := p.String(); !strings.Contains(s, "bytes omitted") || !strings.Contains(s, `"seq": ""`) {
+		t.Fatalf("the large body should be omitted: %s", s)
+	}
+
+	SetStringBodyLimit(-1)
+	defer SetStringBodyLimit(4096)
+	if strings.Contains(p.String(), "bytes omitted") {
+		t.Fatal("the body should not be omitted")
+	}
+}
+
+type stringTestNode struct {
+	L, R *stringTestNode
+	Name string
+}
+
+func TestPacketStringBodyEstimate(t *testing.T) {
+	// the nodes are shared by both branches, so a full walk takes 2^64 steps
+	var node *stringTestNode
+	for i := 0; i < 64; i++ {
+		node = &stringTestNode{L: node, R: node, Name: strings.Repeat("n", 500)}
+	}
+	if n := bodySize(node); n <= StringBodyLimit() {
+		t.Fatalf("the estimated size %d should be bigger than %d", n, StringBodyLimit())
+	}
+	// the walk stops once the budget is exceeded
+	if n := bodySize(make([]int, 1<<20)); n > StringBodyLimit()+32 {
+		t.Fatalf("the estimation should stop early, got size %d", n)
+	}
+}
+
+func TestPacketSettings(t *testing.T) {
+	p := GetPacket(
+		WithSeq("7"),
+		WithPtype(1),
+		WithUri("/a/b?x=1"),
+		WithQuery("y", "2"),
+		WithSetMeta("k", "v"),
+	)
+	defer PutPacket(p)
+	if p.Seq() != "7" || p.Ptype() != 1 || p.UriObject().Path != "/a/b" {
+		t.Fatalf("seq: %q, ptype: %d, uri: %q", p.Seq(), p.Ptype(), p.Uri())
+	}
+	if q := p.UriObject().Query(); q.Get("x") != "1" || q.Get("y") != "2" {
+		t.Fatalf("query: %v", q)
+	}
+	if string(p.Meta().Peek("k")) != "v" {
+		t.Fatalf("meta: %s", p.Meta().String())
+	}
+
+	p.Reset(WithSeq("8"), WithUri("/c"))
+	if p.Seq() != "8" || p.Ptype() != 0 || p.Uri() != "/c" || p.Meta().Len() != 0 {
+		t.Fatalf("after reset, seq: %q, ptype: %d, uri: %q, meta: %s", p.Seq(), p.Ptype(), p.Uri(), p.Meta().String())
+	}
+}
+
+func TestMaxFreePackets(t *testing.T) {
+	defer SetMaxFreePackets(MaxFreePackets())
+
+	SetMaxFreePackets(0)
+	a := GetPacket(WithSeq("a"))
+	PutPacket(a)
+	if a.Seq() != "a" {
+		t.Fatal("the dropped packet should not be reset")
+	}
+	if b := GetPacket(); b == a {
+		t.Fatal("pooling should be disabled")
+	}
+
+	SetMaxFreePackets(1)
+	// ignore the idle packets put back by the other tests
+	atomic.StoreInt64(&freePackets, 0)
+	PutPacket(a)
+	if a.Seq() != "" {
+		t.Fatal("the pooled packet should be reset")
+	}
+	c := NewPacket(WithSeq("c"))
+	PutPacket(c)
+	if c.Seq() != "c" {
+		t.Fatal("the packet should be dropped when the packet stack is full")
+	}
+}
+
+// lockedPacketStack is the previous mutex-guarded free list, kept for benchmarking.
+type lockedPacketStack struct {
+	freePacket *lockedPacket
+	mu         sync.Mutex
+}
+
+type lockedPacket struct {
+	*Packet
+	next *lockedPacket
+}
+
+func (s *lockedPacketStack) get() *lockedPacket {
+	s.mu.Lock()
+	p := s.freePacket
+	if p == nil {
+		p = &lockedPacket{Packet: NewPacket()}
+	} else {
+		s.freePacket = p.next
+	}
+	s.mu.Unlock()
+	return p
+}
+
+func (s *lockedPacketStack) put(p *lockedPacket) {
+	s.mu.Lock()
+	p.Reset()
+	p.next = s.freePacket
+	s.freePacket = p
+	s.mu.Unlock()
+}
+
+func BenchmarkLockedPacketStack(b *testing.B) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(32))
+	var s lockedPacketStack
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			p := s.get()
+			p.SetSeq("1")
+			s.put(p)
+		}
+	})
+}
+
+func BenchmarkPacketPool(b *testing.B) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(32))
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			p := GetPacket()
+			p.SetSeq("1")
+			PutPacket(p)
+		}
+	})
+}
+
+func TestReadPacketPoolStats(t *testing.T) {
+	defer SetMaxFreePackets(MaxFreePackets())
+	SetMaxFreePackets(0)
+	before := ReadPacketPoolStats()
+	PutPacket(GetPacket())
+	after := ReadPacketPoolStats()
+	if after.Gets-before.Gets != 1 || after.Misses-before.Misses != 1 || after.Puts-before.Puts != 1 {
+		t.Fatalf("before: %+v, after: %+v", before, after)
+	}
+}
+
+func TestDoublePutPacket(t *testing.T) {
+	p := GetPacket()
+	PutPacket(p)
+	PutPacket(p)
+
+	defer SetDebugPool(DebugPool())
+	SetDebugPool(true)
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expect panic on double PutPacket")
+		}
+	}()
+	PutPacket(p)
+}
+
+func TestPacketClone(t *testing.T) {
+	p := GetPacket(
+		WithSeq("1"),
+		WithPtype(2),
+		WithUri("/a/b?c=d"),
+		WithSetMeta("k", "v"),
+		WithBodyCodec('j'),
+		WithBody("body"),
+	)
+	p.SetSize(10)
+	c := p.Clone()
+	PutPacket(p)
+	if c.Seq() != "1" || c.Ptype() != 2 || c.Uri() != "/a/b?c=d" ||
+		string(c.Meta().Peek("k")) != "v" || c.BodyCodec() != 'j' ||
+		c.Body() != "body" || c.Size() != 10 {
+		t.Fatalf("the clone is changed: %s", c.String())
+	}
+}
+
+func TestPutPacketReleaseBody(t *testing.T) {
+	var released = make(chan struct{})
+	body := new([]byte)
+	*body = make([]byte, 1<<20)
+	runtime.SetFinalizer(body, func(*[]byte) { close(released) })
+	p := GetPacket(WithUri("/a"), WithBody(body))
+	body = nil
+	PutPacket(p)
+	for i := 0; i < 10; i++ {
+		runtime.GC()
+		select {
+		case <-released:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	t.Fatal("the body is still referenced after PutPacket")
+}
+
+func TestWithBodyReclaim(t *testing.T) {
+	var reclaimed []interface{}
+	reclaim := func(body interface{}) {
+		reclaimed = append(reclaimed, body)
+	}
+	body := new(struct{ A int })
+	p := GetPacket(WithBody(body), WithBodyReclaim(reclaim))
+	PutPacket(p)
+	PutPacket(p)
+	if len(reclaimed) != 1 || reclaimed[0] != body {
+		t.Fatalf("reclaimed: %v", reclaimed)
+	}
+
+	// Reset clears it
+	p = GetPacket(WithBody(body), WithBodyReclaim(reclaim))
+	p.Reset()
+	PutPacket(p)
+	if len(reclaimed) != 1 {
+		t.Fatalf("reclaimed: %v", reclaimed)
+	}
+}
+
+func TestUnmarshalBodyReuse(t *testing.T) {
+	buf := make([]byte, 0, 16)
+	p := NewPacket(WithReuseBodyBuffer(), WithBody(&buf))
+	if err := p.UnmarshalBody([]byte("teleport")); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "teleport" || cap(buf) != 16 {
+		t.Fatalf("body: %q, cap: %d", buf, cap(buf))
+	}
+	// the previous body is not overwritten by default
+	prev := buf
+	p.Reset(WithBody(&buf))
+	if err := p.UnmarshalBody([]byte("next")); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "next" || string(prev) != "teleport" {
+		t.Fatalf("body: %q, previous body: %q", buf, prev)
+	}
+}
+
+func benchmarkUnmarshalBody(b *testing.B, newBody func() *[]byte) {
+	data := make([]byte, 1024)
+	p := NewPacket(WithReuseBodyBuffer())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.SetBody(newBody())
+		if err := p.UnmarshalBody(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalBodyFresh(b *testing.B) {
+	benchmarkUnmarshalBody(b, func() *[]byte { return new([]byte) })
+}
+
+func BenchmarkUnmarshalBodyReused(b *testing.B) {
+	buf := new([]byte)
+	benchmarkUnmarshalBody(b, func() *[]byte { return buf })
+}
+
+func TestPacketJSON(t *testing.T) {
+	RegPtypeName(0xe1, "TEST")
+	p := NewPacket(
+		WithSeq("9"),
+		WithPtype(0xe1),
+		WithUri("/a/b?x=1"),
+		WithSetMeta("k", "v"),
+		WithBodyCodec(codec.ID_JSON),
+		WithBody(map[string]int{"a": 1}),
+		WithXferPipe('z'),
+	)
+	b, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"ptype":225,"type_name":"TEST"`) {
+		t.Fatalf("json: %s", b)
+	}
+
+	check := func(data []byte) {
+		var body map[string]int
+		q := NewPacket(WithBody(&body))
+		if err := json.Unmarshal(data, q); err != nil {
+			t.Fatal(err)
+		}
+		if q.Seq() != "9" || q.Ptype() != 0xe1 || q.Uri() != "/a/b?x=1" ||
+			string(q.Meta().Peek("k")) != "v" || q.BodyCodec() != codec.ID_JSON ||
+			body["a"] != 1 || q.XferPipe().Len() != 1 {
+			t.Fatalf("unmarshal %s: %s", data, q.String())
+		}
+	}
+	check(b)
+	check([]byte(strings.Replace(string(b), `"ptype":225`, `"ptype":"TEST"`, 1)))
+
+	err = json.Unmarshal([]byte(`{"ptype":"NOPE"}`), NewPacket())
+	if err == nil {
+		t.Fatal("expect unknown packet type name error")
+	}
+}
+
+func TestPacketEqual(t *testing.T) {
+	newPacket := func(settings ...PacketSetting) *Packet {
+		return NewPacket(append([]PacketSetting{
+			WithSeq("1"),
+			WithPtype(2),
+			WithUri("/a/b"),
+			WithSetMeta("k", "v"),
+			WithBodyCodec('j'),
+			WithBody(map[string]int{"n": 1}),
+		}, settings...)...)
+	}
+	p := newPacket()
+	if q := newPacket(WithContext(context.Background())); !p.Equal(q) {
+		t.Fatalf("the packets should be equal: %s", p.Diff(q))
+	}
+	if !p.Equal(p.Clone()) {
+		t.Fatal("the clone should be equal")
+	}
+	cases := []struct {
+		q    *Packet
+		diff string
+	}{
+		{newPacket(WithSeq("2")), `seq: "1" != "2"`},
+		{newPacket(WithUri("/a/c")), `uri: "/a/b" != "/a/c"`},
+		{newPacket(WithSetMeta("k", "x")), `meta: "k=v" != "k=x"`},
+		{newPacket(WithBody(map[string]int{"n": 2})), `body: map[string]int{"n":1} != map[string]int{"n":2}`},
+	}
+	for _, c := range cases {
+		if p.Equal(c.q) {
+			t.Fatalf("the packets should not be equal: %s", c.diff)
+		}
+		if diff := p.Diff(c.q); diff != c.diff {
+			t.Fatalf("got diff %q, want %q", diff, c.diff)
+		}
+	}
+
+	// the URI objects are compared by their strings
+	a, b := NewPacket(), NewPacket()
+	a.SetUriObject(&url.URL{Path: "/a/b"})
+	b.SetUriObject(&url.URL{Path: "/a/c"})
+	if diff := a.Diff(b); diff != `uri: "/a/b" != "/a/c"` {
+		t.Fatalf("got diff %q", diff)
+	}
+	b.SetUriObject(&url.URL{Path: "/a/b"})
+	if !a.Equal(b) {
+		t.Fatalf("the packets should be equal: %s", a.Diff(b))
+	}
+}
+
+func TestPacketResetKeep(t *testing.T) {
+	newPacket := func() *Packet {
+		return NewPacket(
+			WithSeq("1"),
+			WithPtype(2),
+			WithUri("/a/b"),
+			WithSetMeta("k", "v"),
+			WithBodyCodec('j'),
+			WithBody("body"),
+		)
+	}
+	p := newPacket()
+	p.ResetKeep(KeepSeq)
+	if p.Seq() != "1" {
+		t.Fatalf("the seq should be kept: %q", p.Seq())
+	}
+	if want := NewPacket(WithSeq("1")); !p.Equal(want) {
+		t.Fatalf("the others should be reset: %s", p.Diff(want))
+	}
+
+	p = newPacket()
+	p.ResetKeep(KeepUri|KeepPtype|KeepMeta, WithBody("next"))
+	if want := NewPacket(WithPtype(2), WithUri("/a/b"), WithSetMeta("k", "v"), WithBody("next")); !p.Equal(want) {
+		t.Fatalf("the uri, ptype and meta should be kept: %s", p.Diff(want))
+	}
+	if p.UriObject().Path != "/a/b" {
+		t.Fatalf("the uri object should be kept: %v", p.UriObject())
+	}
+}
+
+func TestEncodeDecodePacket(t *testing.T) {
+	newBody := func(Header) interface{} { return new(map[string]int) }
+	p := NewPacket(WithSeq("1"), WithPtype(2), WithUri("/a/b"), WithSetMeta("k", "v"),
+		WithXferPipe('z'), WithBody(map[string]int{"n": 1}))
+	frame, err := p.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := NewPacket(WithSeq("2"), WithBody(map[string]int{"n": 2}))
+	frame2, err := next.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := append(append([]byte(nil), frame...), frame2...)
+
+	for i, want := range []*Packet{p, next} {
+		q, n, err := DecodePacket(data, newBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int(want.Size()) {
+			t.Fatalf("packet %d: consumed %d bytes, want %d", i, n, want.Size())
+		}
+		want.SetBody(&map[string]int{"n": i + 1})
+		// the resolved body codec is written into the frame
+		want.SetBodyCodec(DefaultBodyCodec())
+		// the gzip filter is skipped for the small payload, but the frame still lists it
+		if want.XferPipe().Len() > 0 && !q.XferPipe().Skipped(0) {
+			t.Fatalf("packet %d: the gzip filter should be skipped", i)
+		}
+		if !q.Equal(want) {
+			t.Fatalf("packet %d: %s", i, q.Diff(want))
+		}
+		data = data[n:]
+	}
+	if len(data) != 0 {
+		t.Fatalf("%d bytes left", len(data))
+	}
+
+	// partial buffer
+	for _, n := range []int{0, 3, len(frame) - 1} {
+		if _, _, err := DecodePacket(frame[:n], newBody); err != ErrNeedMore {
+			t.Fatalf("%d of %d bytes: got error %v, want %v", n, len(frame), err, ErrNeedMore)
+		}
+	}
+}
+
+func TestEncoderDecoder(t *testing.T) {
+	newBody := func(Header) interface{} { return new(map[string]int) }
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	var written []*Packet
+	for i := 1; i <= 3; i++ {
+		p := NewPacket(WithSeq(strconv.Itoa(i)), WithPtype(byte(i)), WithUri("/a/b"),
+			WithSetMeta("k", "v"), WithBody(map[string]int{"n": i}))
+		if err := enc.Encode(p); err != nil {
+			t.Fatal(err)
+		}
+		p.SetBody(&map[string]int{"n": i})
+		// the resolved body codec is written into the frame
+		p.SetBodyCodec(DefaultBodyCodec())
+		written = append(written, p)
+	}
+	size := buf.Len()
+
+	dec := NewDecoder(bytes.NewReader(buf.Bytes()))
+	for i, want := range written {
+		q, err := dec.Decode(newBody)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if !q.Equal(want) {
+			t.Fatalf("packet %d: %s", i, q.Diff(want))
+		}
+	}
+	if _, err := dec.Decode(newBody); err != io.EOF {
+		t.Fatalf("got error %v at the end, want %v", err, io.EOF)
+	}
+
+	// the stream ends in a packet
+	dec = NewDecoder(bytes.NewReader(buf.Bytes()[:size-1]))
+	for i := 0; i < 2; i++ {
+		if _, err := dec.Decode(newBody); err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+	}
+	if _, err := dec.Decode(newBody); err != io.ErrUnexpectedEOF {
+		t.Fatalf("got error %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+// countPool counts the returned bodies.
+type countPool struct {
+	sync.Pool
+	puts []interface{}
+}
+
+func (p *countPool) Put(body interface{}) {
+	p.puts = append(p.puts, body)
+	p.Pool.Put(body)
+}
+
+func TestSetBodyPool(t *testing.T) {
+	type body struct{ A int }
+	var _ BodyPool = new(sync.Pool)
+	pool := &countPool{Pool: sync.Pool{New: func() interface{} { return new(body) }}}
+	p := GetPacket(WithBodyCodec(codec.ID_JSON), WithNewBody(func(Header) interface{} { return pool.Get() }), WithBodyPool(pool))
+	if err := p.UnmarshalBody([]byte(`{"A":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	b := p.Body()
+	PutPacket(p)
+	PutPacket(p)
+	if len(pool.puts) != 1 || pool.puts[0] != b {
+		t.Fatalf("the body should be returned once: %v", pool.puts)
+	}
+
+	// nil body
+	p = GetPacket()
+	p.SetBodyPool(pool)
+	PutPacket(p)
+	if len(pool.puts) != 1 {
+		t.Fatalf("the nil body should not be returned: %v", pool.puts)
+	}
+
+	// Reset clears it
+	p = GetPacket(WithBody(new(body)), WithBodyPool(pool))
+	p.Reset()
+	PutPacket(p)
+	if len(pool.puts) != 1 {
+		t.Fatalf("the body should not be returned after Reset: %v", pool.puts)
+	}
+}
+
+func TestPacketUriHelpers(t *testing.T) {
+	cases := []struct {
+		uri   string
+		path  string
+		query url.Values
+	}{
+		{"/a/b?n=1&m=x&m=y", "/a/b", url.Values{"n": {"1"}, "m": {"x", "y"}}},
+		{"/a/b", "/a/b", url.Values{}},
+		{"/a/b?", "/a/b", url.Values{}},
+		{"%zz?n=1", "", url.Values{}},
+	}
+	for _, c := range cases {
+		p := NewPacket(WithUri(c.uri))
+		if p.UriPath() != c.path {
+			t.Fatalf("%q: got path %q, want %q", c.uri, p.UriPath(), c.path)
+		}
+		if !reflect.DeepEqual(p.UriQuery(), c.query) {
+			t.Fatalf("%q: got query %v, want %v", c.uri, p.UriQuery(), c.query)
+		}
+		if want := c.query.Get("m"); p.UriParam("m") != want {
+			t.Fatalf("%q: got param %q, want %q", c.uri, p.UriParam("m"), want)
+		}
+	}
+
+	// the query is cached until it changes
+	p := NewPacket(WithUri("/a/b?n=1"))
+	q := p.UriQuery()
+	if reflect.ValueOf(p.UriQuery()).Pointer() != reflect.ValueOf(q).Pointer() {
+		t.Fatal("the query should be cached")
+	}
+	WithQuery("n", "2")(p)
+	if got := p.UriQuery()["n"]; !reflect.DeepEqual(got, []string{"1", "2"}) {
+		t.Fatalf("the query should be refreshed: %v", got)
+	}
+	p.SetUri("/c")
+	if p.UriParam("n") != "" || p.UriPath() != "/c" {
+		t.Fatalf("the query should be refreshed: %v", p.UriQuery())
+	}
+	p.Reset(WithUri("/d?k=v"))
+	if p.UriParam("k") != "v" {
+		t.Fatalf("the query should be refreshed after Reset: %v", p.UriQuery())
+	}
+}
+
+func TestBodyCodecMismatch(t *testing.T) {
+	var w countWriter
+	p := NewPacket(WithBodyCodec(codec.ID_PROTOBUF), WithBody(map[string]int{"a": 1}))
+	err := NewRawProtoFunc(&w).Pack(p)
+	e, ok := err.(*ErrBodyCodecMismatch)
+	if !ok {
+		t.Fatalf("got error %v, want *ErrBodyCodecMismatch", err)
+	}
+	if e.Codec != codec.NAME_PROTOBUF || e.BodyType != reflect.TypeOf(map[string]int{}) {
+		t.Fatalf("codec: %q, body type: %v", e.Codec, e.BodyType)
+	}
+	if msg := err.Error(); !strings.Contains(msg, codec.NAME_PROTOBUF) || !strings.Contains(msg, "map[string]int") {
+		t.Fatalf("the error should name the codec and the body type: %s", msg)
+	}
+
+	for _, p := range []*Packet{
+		NewPacket(WithBodyCodec(codec.ID_PROTOBUF), WithBody(new(codec.PbEmpty))),
+		NewPacket(WithBodyCodec(codec.ID_JSON), WithBody(map[string]int{"a": 1})),
+		NewPacket(WithBodyCodec(codec.ID_PLAIN), WithBody(42)),
+	} {
+		if err := NewRawProtoFunc(&w).Pack(p); err != nil {
+			t.Fatalf("codec %d: %v", p.BodyCodec(), err)
+		}
+	}
+}
+
+func TestPacketContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p := GetPacket(WithContext(ctx))
+	if p.Context().Err() != context.Canceled {
+		t.Fatalf("got context error %v, want %v", p.Context().Err(), context.Canceled)
+	}
+	p.Reset()
+	if p.Context() != context.Background() {
+		t.Fatal("Reset should clear the context")
+	}
+	p.Reset(WithContext(ctx))
+	PutPacket(p)
+	if q := GetPacket(); q.Context().Err() != nil {
+		t.Fatalf("the recycled packet should not carry the cancelled context: %v", q.Context().Err())
+	}
+}
+
+// BenchmarkPacketReset resets a packet holding a typical request header,
+// and an idle one whose fields are zero already.
+func BenchmarkPacketReset(b *testing.B) {
+	body := new([]byte)
+	b.Run("request", func(b *testing.B) {
+		p := NewPacket()
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			p.seq = "12"
+			p.ptype = 1
+			p.uri = "/home/test?peer_id=110"
+			p.bodyCodec = codec.ID_JSON
+			p.body = body
+			p.size = 128
+			p.Reset()
+		}
+	})
+	b.Run("zero", func(b *testing.B) {
+		p := NewPacket()
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			p.Reset()
+		}
+	})
+}
+
+func TestTypeBodyRegistry(t *testing.T) {
+	type (
+		callArg struct{ A int }
+		pushArg struct{ B string }
+	)
+	var reg TypeBodyRegistry
+	reg.Register(1, func() interface{} { return new(callArg) })
+	reg.Register(2, func() interface{} { return new(pushArg) })
+	newBody := reg.NewBodyFunc()
+
+	var buf bytes.Buffer
+	proto := NewRawProtoFunc(&buf)
+	for _, p := range []*Packet{
+		NewPacket(WithPtype(1), WithBody(&callArg{A: 1})),
+		NewPacket(WithPtype(2), WithBody(&pushArg{B: "b"})),
+		NewPacket(WithPtype(3), WithBody(map[string]int{"c": 3})),
+	} {
+		if err := proto.Pack(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []interface{}{&callArg{A: 1}, &pushArg{B: "b"}, nil} {
+		p := NewPacket(WithNewBody(newBody))
+		if err := proto.Unpack(p); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(p.Body(), want) {
+			t.Fatalf("ptype %d: got body %#v, want %#v", p.Ptype(), p.Body(), want)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("multi-register should panic")
+		}
+	}()
+	reg.Register(1, func() interface{} { return new(callArg) })
+}
+
+func TestSemanticKey(t *testing.T) {
+	p := NewPacket(WithSeq("1"), WithPtype(1), WithUri("/a?x=1"),
+		WithSetMeta("b", "2"), WithAddMeta("a", "1"), WithAddMeta("a", "0"), WithBody([]byte("x")))
+	q := NewPacket(WithSeq("2"), WithPtype(1), WithUri("/a?x=1"),
+		WithAddMeta("a", "1"), WithAddMeta("a", "0"), WithSetMeta("b", "2"), WithXferPipe('z'),
+		WithSetMeta(MetaTraceId, "0a"), WithSetMeta(MetaSpanId, "0b"), WithSetMeta(MetaAcceptBodyCodec, "j"),
+		WithSetMeta(MetaStream, "1"), WithSetMeta(MetaStreamId, "3"), WithSetMeta(MetaStreamFlag, muxEnd))
+	if p.SemanticKey() != q.SemanticKey() {
+		t.Fatalf("the keys of the packets differing in the transport fields:\n%q\n%q", p.SemanticKey(), q.SemanticKey())
+	}
+	for name, other := range map[string]*Packet{
+		"uri":        NewPacket(WithPtype(1), WithUri("/b?x=1"), WithSetMeta("b", "2"), WithAddMeta("a", "1"), WithAddMeta("a", "0")),
+		"ptype":      NewPacket(WithPtype(2), WithUri("/a?x=1"), WithSetMeta("b", "2"), WithAddMeta("a", "1"), WithAddMeta("a", "0")),
+		"meta order": NewPacket(WithPtype(1), WithUri("/a?x=1"), WithSetMeta("b", "2"), WithAddMeta("a", "0"), WithAddMeta("a", "1")),
+		"meta":       NewPacket(WithPtype(1), WithUri("/a?x=1"), WithSetMeta("b", "2"), WithAddMeta("a", "1")),
+	} {
+		if other.SemanticKey() == p.SemanticKey() {
+			t.Fatalf("%s: the keys should differ: %q", name, p.SemanticKey())
+		}
+	}
+	// the lengths tell the fields apart
+	a := NewPacket(WithUri("/a"), WithSetMeta("k|1:v", ""))
+	b := NewPacket(WithUri("/a"), WithSetMeta("k", "v"))
+	if a.SemanticKey() == b.SemanticKey() {
+		t.Fatalf("the keys should differ: %q", a.SemanticKey())
+	}
+}
+
+func TestRegTransportMetaKey(t *testing.T) {
+	p := NewPacket(WithUri("/a"), WithSetMeta("X-Test-Sent", "1"))
+	q := NewPacket(WithUri("/a"), WithSetMeta("X-Test-Sent", "2"))
+	RegTransportMetaKey("X-Test-Sent")
+	if p.SemanticKey() != q.SemanticKey() {
+		t.Fatalf("the keys of the packets differing in the registered metadata:\n%q\n%q", p.SemanticKey(), q.SemanticKey())
+	}
+}
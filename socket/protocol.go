@@ -16,12 +16,21 @@ package socket
 
 import (
 	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"io"
+	"io/ioutil"
+	"net"
 	"sync"
+	"sync/atomic"
 
-	"github.com/henrylee2cn/goutil"
 	"github.com/henrylee2cn/teleport/utils"
 )
 
@@ -61,13 +70,56 @@ type rawProto struct {
 	id   byte
 	name string
 	r    io.Reader
-	w    io.Writer
-	rMu  sync.Mutex
+	// src stores the readerHolder under r, which is switched by ResetConn
+	src atomic.Value
+	// w stores the writerHolder of the frames, which is switched by ResetConn
+	w   atomic.Value
+	rMu sync.Mutex
+	// lengthOrder is the byte order of the frame length prefix
+	lengthOrder binary.ByteOrder
+	// maxBodyLength overrides the package-level MaxBodyLength if >0
+	maxBodyLength int64
+	// maxDecompressedBytes overrides the package-level xfer.MaxDecompressedBytes if >0
+	maxDecompressedBytes int64
+	// onReadError stores func(*Packet, error) bool
+	onReadError atomic.Value
+	// hmacKey stores the []byte key of the frame signature
+	hmacKey atomic.Value
+	// aead stores the aeadHolder of the frame encryption
+	aead atomic.Value
+	// reuseReadBuffer is 1 if readBuffer is used instead of a pooled buffer
+	reuseReadBuffer int32
+	// readBuffer is the read scratch, guarded by readBufferMu
+	readBuffer   utils.ByteBuffer
+	readBufferMu sync.Mutex
+	// compressHeader is 1 if the header is prefixed by the compression flag
+	compressHeader int32
+	// drainLimit is the byte upper limit of discarding the rest of an oversized frame,
+	// 0 if it is not discarded
+	drainLimit int64
 }
 
 // NewRawProtoFunc is creation function of fast socket protocol.
 // NOTE: it is the default protocol.
 var NewRawProtoFunc = func(rw io.ReadWriter) Proto {
+	return newRawProto(rw, binary.BigEndian)
+}
+
+// NewRawProtoFuncWithByteOrder returns the creation function of the raw protocol
+// whose frame length prefix is encoded in the byte order, for the interoperation.
+// Note:
+//  only the 4-byte frame length prefix is affected,
+//  the lengths in the header are always big-endian;
+//  both sides must use the same byte order, otherwise the frame size
+//  is misread and the reading fails with an error;
+//  NewRawProtoFunc uses binary.BigEndian.
+func NewRawProtoFuncWithByteOrder(order binary.ByteOrder) ProtoFunc {
+	return func(rw io.ReadWriter) Proto {
+		return newRawProto(rw, order)
+	}
+}
+
+func newRawProto(rw io.ReadWriter, lengthOrder binary.ByteOrder) *rawProto {
 	var (
 		rawProtoReadBufioSize     int
 		readBufferSize, isDefault = ReadBuffer()
@@ -79,12 +131,52 @@ var NewRawProtoFunc = func(rw io.ReadWriter) Proto {
 	} else {
 		rawProtoReadBufioSize = readBufferSize / 2
 	}
-	return &rawProto{
-		id:   'r',
-		name: "raw",
-		r:    bufio.NewReaderSize(rw, rawProtoReadBufioSize),
-		w:    rw,
+	r := &rawProto{
+		id:          'r',
+		name:        "raw",
+		lengthOrder: lengthOrder,
+	}
+	r.r = bufio.NewReaderSize(srcReader{r}, rawProtoReadBufioSize)
+	r.ResetConn(rw, rw)
+	return r
+}
+
+// readerHolder holds the reader under the read buffer.
+type readerHolder struct {
+	io.Reader
+}
+
+// srcReader reads from the current reader under the read buffer of the protocol.
+type srcReader struct {
+	r *rawProto
+}
+
+func (s srcReader) Read(b []byte) (int, error) {
+	return s.r.src.Load().(readerHolder).Read(b)
+}
+
+// writerHolder holds the writer of the frames.
+type writerHolder struct {
+	io.Writer
+	// writev is true if it writes net.Buffers with one system call
+	writev bool
+}
+
+func (r *rawProto) writer() writerHolder {
+	return r.w.Load().(writerHolder)
+}
+
+// ResetConn switches the reads and writes onto the wrappers of the connection,
+// such as of the buffered writing,
+// keeping the settings and the bytes already in the read buffer.
+func (r *rawProto) ResetConn(rd io.Reader, w io.Writer) {
+	r.src.Store(readerHolder{rd})
+	h := writerHolder{Writer: w}
+	switch w.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		h.writev = true
 	}
+	r.w.Store(h)
 }
 
 // Version returns the protocol's id and name.
@@ -92,26 +184,358 @@ func (r *rawProto) Version() (byte, string) {
 	return r.id, r.name
 }
 
+// SetMaxBodyLength sets the body length upper limit of reading.
+// If n<=0, the package-level MaxBodyLength is used.
+func (r *rawProto) SetMaxBodyLength(n int64) {
+	atomic.StoreInt64(&r.maxBodyLength, n)
+}
+
+// SetMaxDecompressedBytes sets the size upper limit of the data decompressed by the transfer filters.
+// If n<=0, the package-level xfer.MaxDecompressedBytes is used.
+func (r *rawProto) SetMaxDecompressedBytes(n int64) {
+	atomic.StoreInt64(&r.maxDecompressedBytes, n)
+}
+
+// SetOnReadError sets the handler of the error that occurs after a frame is read completely.
+// If it returns true, the frame is discarded and the next one is read.
+func (r *rawProto) SetOnReadError(fn func(*Packet, error) (skip bool)) {
+	r.onReadError.Store(fn)
+}
+
+// SetHMACKey sets the shared key of the HMAC-SHA256 frame signature.
+// If the key is empty, the frames are neither signed nor verified.
+func (r *rawProto) SetHMACKey(key []byte) {
+	r.hmacKey.Store(append([]byte(nil), key...))
+}
+
+// SetReuseReadBuffer sets whether the frames are read into a scratch buffer
+// owned by the protocol, which grows to the largest frame read.
+func (r *rawProto) SetReuseReadBuffer(reuse bool) {
+	if reuse {
+		atomic.StoreInt32(&r.reuseReadBuffer, 1)
+	} else {
+		atomic.StoreInt32(&r.reuseReadBuffer, 0)
+	}
+}
+
+// SetHeaderCompression sets whether the header is prefixed by a compression flag byte,
+// and deflated if it is long enough to get smaller.
+func (r *rawProto) SetHeaderCompression(enable bool) {
+	if enable {
+		atomic.StoreInt32(&r.compressHeader, 1)
+	} else {
+		atomic.StoreInt32(&r.compressHeader, 0)
+	}
+}
+
+// SetDrainOversizedFrame sets the byte upper limit of discarding the rest of a frame
+// rejected by its size, instead of leaving the connection out of sync.
+// If limit<=0, the frame is not discarded.
+func (r *rawProto) SetDrainOversizedFrame(limit int64) {
+	if limit < 0 {
+		limit = 0
+	}
+	atomic.StoreInt64(&r.drainLimit, limit)
+}
+
+func (r *rawProto) getHMACKey() []byte {
+	key, _ := r.hmacKey.Load().([]byte)
+	return key
+}
+
+// ErrSignatureInvalid the frame signature mismatch error.
+var ErrSignatureInvalid = errors.New("socket: invalid packet signature")
+
+// signatureLength is the length of the HMAC-SHA256 frame signature.
+const signatureLength = sha256.Size
+
+// appendSignature appends the signature of the frame without the size prefix.
+func appendSignature(b []byte, key []byte, frame []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(frame)
+	return mac.Sum(b)
+}
+
+// verifySignature checks the signature at the end of data,
+// and returns the data without it.
+func (r *rawProto) verifySignature(key []byte, data []byte, p *Packet) ([]byte, error) {
+	n := len(data) - signatureLength
+	if n < 0 {
+		return nil, ErrSignatureInvalid
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(appendXferPipe([]byte{r.id}, p.XferPipe().Ids(), p.XferPipe().Skipped))
+	mac.Write(data[:n])
+	if !hmac.Equal(mac.Sum(nil), data[n:]) {
+		return nil, ErrSignatureInvalid
+	}
+	return data[:n], nil
+}
+
+// aeadHolder holds the nil-able cipher.AEAD in atomic.Value.
+type aeadHolder struct {
+	aead cipher.AEAD
+}
+
+// SetAESKey sets the shared key of the AES-GCM frame encryption,
+// the key must be 16, 24 or 32 bytes to select AES-128, AES-192 or AES-256.
+// If the key is empty, the frames are neither encrypted nor decrypted.
+func (r *rawProto) SetAESKey(key []byte) error {
+	if len(key) == 0 {
+		r.aead.Store(aeadHolder{})
+		return nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	r.aead.Store(aeadHolder{aead: aead})
+	return nil
+}
+
+func (r *rawProto) getAEAD() cipher.AEAD {
+	h, _ := r.aead.Load().(aeadHolder)
+	return h.aead
+}
+
+// ErrDecryptFailed the frame decryption error, caused by a wrong key or a broken ciphertext.
+var ErrDecryptFailed = errors.New("socket: failed to decrypt the packet")
+
+// seal encrypts b[payloadStart:] in place, prepending a random nonce,
+// and authenticates b[frameStart:payloadStart] as the additional data.
+func seal(aead cipher.AEAD, b []byte, frameStart, payloadStart int) ([]byte, error) {
+	plaintext := append([]byte(nil), b[payloadStart:]...)
+	b = b[:payloadStart]
+	nonceSize := aead.NonceSize()
+	for i := 0; i < nonceSize; i++ {
+		b = append(b, 0)
+	}
+	nonce := b[payloadStart:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(b, nonce, plaintext, b[frameStart:payloadStart]), nil
+}
+
+// open decrypts the data in place, and returns the plaintext.
+func (r *rawProto) open(aead cipher.AEAD, data []byte, p *Packet) ([]byte, error) {
+	nonceSize := aead.NonceSize()
+	if len(data) < nonceSize+aead.Overhead() {
+		return nil, ErrDecryptFailed
+	}
+	ad := appendXferPipe([]byte{r.id}, p.XferPipe().Ids(), p.XferPipe().Skipped)
+	ciphertext := data[nonceSize:]
+	plaintext, err := aead.Open(ciphertext[:0], data[:nonceSize], ciphertext, ad)
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+	return plaintext, nil
+}
+
+// MaxBodyLength returns the body length upper limit of reading.
+func (r *rawProto) MaxBodyLength() int64 {
+	return r.getMaxBodyLength()
+}
+
+func (r *rawProto) getMaxBodyLength() int64 {
+	if n := atomic.LoadInt64(&r.maxBodyLength); n > 0 {
+		return n
+	}
+	return MaxBodyLength()
+}
+
+var packBufferSize int
+
+// PackBufferSize returns the initial capacity of the pooled buffer used to pack a packet.
+func PackBufferSize() int {
+	return packBufferSize
+}
+
+// SetPackBufferSize sets the initial capacity of the pooled buffer used to pack a packet,
+// so that the typical packets are packed without growing the buffer.
+// Note:
+//  if n<0, it is set to 0;
+//  the default is 0, which means the buffer grows on demand.
+func SetPackBufferSize(n int) {
+	if n < 0 {
+		n = 0
+	}
+	packBufferSize = n
+}
+
+// maxPooledPackBufferSize is the capacity upper limit of the pooled pack buffer,
+// the bigger one is dropped to avoid holding the memory of the rare large packets.
+const maxPooledPackBufferSize = 1 << 20
+
+var packBufferPool sync.Pool
+
+// acquirePackBuffer returns an empty buffer from the pool with at least PackBufferSize capacity.
+func acquirePackBuffer() *utils.ByteBuffer {
+	n := packBufferSize
+	if v := packBufferPool.Get(); v != nil {
+		bb := v.(*utils.ByteBuffer)
+		if cap(bb.B) >= n {
+			return bb
+		}
+	}
+	return &utils.ByteBuffer{B: make([]byte, 0, n)}
+}
+
+// releasePackBuffer returns the buffer to the pool.
+func releasePackBuffer(bb *utils.ByteBuffer) {
+	if cap(bb.B) > maxPooledPackBufferSize {
+		return
+	}
+	bb.Reset()
+	packBufferPool.Put(bb)
+}
+
 // Pack writes the Packet into the connection.
 // Note: Make sure to write only once or there will be package contamination!
 func (r *rawProto) Pack(p *Packet) error {
-	bb := utils.AcquireByteBuffer()
-	defer utils.ReleaseByteBuffer(bb)
+	bb := acquirePackBuffer()
+	defer releasePackBuffer(bb)
+
+	if w := r.writer(); w.writev && p.XferPipe().Len() == 0 && len(r.getHMACKey()) == 0 && r.getAEAD() == nil {
+		if body := rawBodyBytes(p); len(body) >= writevMinBodySize {
+			return r.packWritev(w.Writer, bb, p, body)
+		}
+	}
+
+	err := r.appendPacket(bb, p)
+	if err != nil {
+		return err
+	}
+
+	// real write
+	return r.write(bb.B)
+}
+
+// partialWriteError is the error of a frame written partially,
+// which breaks the stream.
+type partialWriteError struct {
+	err error
+}
+
+func (e *partialWriteError) Error() string {
+	return e.err.Error()
+}
+
+// write writes the frames, and reports the partial write by *partialWriteError.
+func (r *rawProto) write(b []byte) error {
+	n, err := r.writer().Write(b)
+	if err != nil && n > 0 {
+		return &partialWriteError{err: err}
+	}
+	return err
+}
+
+// writevMinBodySize is the body size lower limit of packWritev,
+// copying the smaller body is cheaper than the scatter write.
+const writevMinBodySize = 64 << 10
+
+// rawBodyBytes returns the body if it is a stream of bytes.
+func rawBodyBytes(p *Packet) []byte {
+	switch body := p.Body().(type) {
+	case []byte:
+		return body
+	case *[]byte:
+		if body != nil {
+			return *body
+		}
+	}
+	return nil
+}
+
+// packWritev writes the frame prefix and header in bb and the body
+// as the separate segments of one scatter write, without copying the body.
+// Note: the packet must have no transfer filter.
+func (r *rawProto) packWritev(w io.Writer, bb *utils.ByteBuffer, p *Packet, body []byte) error {
+	bb.B = appendUint32(bb.B, 0)
+	bb.WriteByte(r.id)
+	bb.WriteByte(0)
+	err := r.writeHeader(bb, p)
+	if err != nil {
+		return err
+	}
+	bb.WriteByte(p.BodyCodec())
+
+	err = p.SetSize(uint32(bb.Len() + len(body)))
+	if err != nil {
+		return err
+	}
+	r.lengthOrder.PutUint32(bb.B, p.Size())
+
+	bufs := net.Buffers{bb.B, body}
+	n, err := bufs.WriteTo(w)
+	if err != nil && n > 0 {
+		return &partialWriteError{err: err}
+	}
+	return err
+}
+
+// PackBytes packs the packet into a new frame without writing it.
+func (r *rawProto) PackBytes(p *Packet) ([]byte, error) {
+	bb := acquirePackBuffer()
+	defer releasePackBuffer(bb)
+	if err := r.appendPacket(bb, p); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), bb.B...), nil
+}
+
+// PackBatch writes the packets into the connection with only one write.
+// It stops at the first packet that fails to be packed,
+// writes the previous ones, and returns the number of packets written.
+func (r *rawProto) PackBatch(ps []*Packet) (int, error) {
+	bb := acquirePackBuffer()
+	defer releasePackBuffer(bb)
+
+	var n int
+	var packErr error
+	for _, p := range ps {
+		start := bb.Len()
+		if packErr = r.appendPacket(bb, p); packErr != nil {
+			bb.B = bb.B[:start]
+			break
+		}
+		n++
+	}
+	if n > 0 {
+		if err := r.write(bb.B); err != nil {
+			return 0, err
+		}
+	}
+	return n, packErr
+}
+
+// appendPacket appends the frame of the packet to bb.
+func (r *rawProto) appendPacket(bb *utils.ByteBuffer, p *Packet) error {
+	start := bb.Len()
 
 	// fake size
-	err := binary.Write(bb, binary.BigEndian, uint32(0))
+	bb.B = appendUint32(bb.B, 0)
 
 	// protocol version
 	bb.WriteByte(r.id)
 
-	// transfer pipe
+	// transfer pipe, reserve the space
 	bb.WriteByte(byte(p.XferPipe().Len()))
 	bb.Write(p.XferPipe().Ids())
+	if n := p.XferPipe().Len(); n < xferSkippedFlag {
+		for i := xferMaskLen(n); i > 0; i-- {
+			bb.WriteByte(0)
+		}
+	}
 
 	prefixLen := bb.Len()
 
 	// header
-	err = r.writeHeader(bb, p)
+	err := r.writeHeader(bb, p)
 	if err != nil {
 		return err
 	}
@@ -123,148 +547,436 @@ func (r *rawProto) Pack(p *Packet) error {
 	}
 
 	// do transfer pipe
-	payload, err := p.XferPipe().OnPack(bb.B[prefixLen:])
+	payload, skipped, err := p.XferPipe().OnPackSkip(bb.B[prefixLen:])
 	if err != nil {
 		return err
 	}
-	bb.B = append(bb.B[:prefixLen], payload...)
+
+	// transfer pipe, with the skipped filters marked, the pipe of the packet is not changed
+	if l := getLogger(); l != nil && skipped != nil {
+		l.Debugf("socket: the transfer filters are skipped for the payload of %d bytes: %v", len(bb.B)-prefixLen, skipped)
+	}
+	bb.B = bb.B[:start+4+1]
+	bb.B = appendXferPipe(bb.B, p.XferPipe().Ids(), func(i int) bool { return skipped != nil && skipped[i] })
+	payloadStart := bb.Len()
+	bb.B = append(bb.B, payload...)
+
+	// encrypt the filtered, such as compressed, header and body
+	if aead := r.getAEAD(); aead != nil {
+		bb.B, err = seal(aead, bb.B, start+4, payloadStart)
+		if err != nil {
+			return err
+		}
+	}
+
+	// signature
+	if key := r.getHMACKey(); len(key) > 0 {
+		bb.B = appendSignature(bb.B, key, bb.B[start+4:])
+	}
 
 	// set and check packet size
-	err = p.SetSize(uint32(bb.Len()))
+	err = p.SetSize(uint32(bb.Len() - start))
 	if err != nil {
 		return err
 	}
 
 	// reset real size
-	binary.BigEndian.PutUint32(bb.B, p.Size())
+	r.lengthOrder.PutUint32(bb.B[start:], p.Size())
+	return nil
+}
 
-	// real write
-	_, err = r.w.Write(bb.B)
-	if err != nil {
+func (r *rawProto) writeHeader(bb *utils.ByteBuffer, p *Packet) error {
+	if atomic.LoadInt32(&r.compressHeader) == 0 {
+		bb.B = appendRawHeader(bb.B, p)
+		return nil
+	}
+	start := bb.Len()
+	bb.WriteByte(headerPlain)
+	bb.B = appendRawHeader(bb.B, p)
+	header := bb.B[start+1:]
+	if len(header) < headerCompressMinBytes {
+		return nil
+	}
+	zb := utils.AcquireByteBuffer()
+	defer utils.ReleaseByteBuffer(zb)
+	if err := deflateHeader(zb, header); err != nil {
 		return err
 	}
+	// the flag and the length prefix are 5 bytes
+	if zb.Len()+4 >= len(header) {
+		if l := getLogger(); l != nil {
+			l.Debugf("socket: the header of %d bytes is not compressed, since the deflated is %d bytes", len(header), zb.Len())
+		}
+		return nil
+	}
+	bb.B = append(bb.B[:start], headerDeflated)
+	bb.B = appendUint32(bb.B, uint32(zb.Len()))
+	bb.B = append(bb.B, zb.B...)
+	return nil
+}
 
-	return err
+// The header compression flags, which prefix the header if SetHeaderCompression.
+const (
+	headerPlain    byte = 0
+	headerDeflated byte = 1
+)
+
+// headerCompressMinBytes is the minimum header size to compress.
+const headerCompressMinBytes = 128
+
+var headerWriterPool = sync.Pool{
+	New: func() interface{} {
+		fw, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return fw
+	},
 }
 
-func (r *rawProto) writeHeader(bb *utils.ByteBuffer, p *Packet) error {
-	seqBytes := goutil.StringToBytes(p.Seq())
-	binary.Write(bb, binary.BigEndian, uint32(len(seqBytes)))
-	bb.Write(seqBytes)
+func deflateHeader(bb *utils.ByteBuffer, header []byte) error {
+	fw := headerWriterPool.Get().(*flate.Writer)
+	defer headerWriterPool.Put(fw)
+	fw.Reset(bb)
+	if _, err := fw.Write(header); err != nil {
+		return err
+	}
+	return fw.Close()
+}
+
+// inflateHeader returns the decompressed header in a new buffer,
+// so the unsafe decoded strings can alias it.
+func inflateHeader(data []byte) ([]byte, error) {
+	fr := flate.NewReader(bytes.NewReader(data))
+	defer fr.Close()
+	maxLen := atomic.LoadInt64(&maxHeaderLength)
+	header, err := ioutil.ReadAll(io.LimitReader(fr, maxLen+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(header)) > maxLen {
+		return nil, ErrHeaderTooLarge
+	}
+	return header, nil
+}
 
-	bb.WriteByte(p.Ptype())
+// appendRawHeader appends the raw proto header of the packet to b,
+// and returns the extended buffer.
+// Note: b is grown as needed, so a reused buffer avoids allocation.
+func appendRawHeader(b []byte, p *Packet) []byte {
+	seq := p.Seq()
+	b = appendUint32(b, uint32(len(seq)))
+	b = append(b, seq...)
 
-	uriBytes := goutil.StringToBytes(p.Uri())
-	binary.Write(bb, binary.BigEndian, uint32(len(uriBytes)))
-	bb.Write(uriBytes)
+	b = append(b, p.Ptype())
+
+	uri := p.Uri()
+	b = appendUint32(b, uint32(len(uri)))
+	b = append(b, uri...)
 
 	metaBytes := p.Meta().QueryString()
-	binary.Write(bb, binary.BigEndian, uint32(len(metaBytes)))
-	bb.Write(metaBytes)
-	return nil
+	b = appendUint32(b, uint32(len(metaBytes)))
+	return append(b, metaBytes...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
 }
 
 func (r *rawProto) writeBody(bb *utils.ByteBuffer, p *Packet) error {
-	bb.WriteByte(p.BodyCodec())
-	bodyBytes, err := p.MarshalBody()
+	bodyCodec, err := p.ResolveBodyCodec()
 	if err != nil {
 		return err
 	}
-	bb.Write(bodyBytes)
-	return nil
+	bb.WriteByte(bodyCodec)
+	return p.MarshalBodyTo(bb)
 }
 
 // Unpack reads bytes from the connection to the Packet.
 // Note: Concurrent unsafe!
 func (r *rawProto) Unpack(p *Packet) error {
-	bb := utils.AcquireByteBuffer()
-	defer utils.ReleaseByteBuffer(bb)
+	var bb *utils.ByteBuffer
+	switch {
+	case UnsafeStringDecode():
+		// the header strings alias bb, so it is released with the packet
+		bb = utils.AcquireByteBuffer()
+		p.setReadBuffer(bb)
+	case atomic.LoadInt32(&r.reuseReadBuffer) == 1:
+		// the scratch is used until the frame is decoded
+		r.readBufferMu.Lock()
+		defer r.readBufferMu.Unlock()
+		bb = &r.readBuffer
+	default:
+		bb = utils.AcquireByteBuffer()
+		defer utils.ReleaseByteBuffer(bb)
+	}
+	var (
+		body            = p.body
+		newBodyFunc     = p.newBodyFunc
+		newBodyCheck    = p.newBodyCheck
+		bodyReclaim     = p.bodyReclaim
+		ctx             = p.ctx
+		lazy            = p.lazy.enabled
+		keepRawBody     = p.keepRawBody
+		reuseBodyBuffer = p.reuseBodyBuffer
+	)
+	for {
+		// read packet
+		err := r.readPacket(bb, p)
+		if err != nil {
+			return err
+		}
+		data := bb.B
+		if key := r.getHMACKey(); len(key) > 0 {
+			data, err = r.verifySignature(key, data, p)
+		}
+		if aead := r.getAEAD(); err == nil && aead != nil {
+			data, err = r.open(aead, data, p)
+		}
+		if err == nil {
+			err = r.unpack(data, p)
+		}
+		if err == nil {
+			return nil
+		}
+		if l := getLogger(); l != nil {
+			l.Errorf("socket: failed to decode the frame of %d bytes: %v", p.Size(), err)
+		}
+		// the frame has been read completely, so it can be skipped
+		onReadError, _ := r.onReadError.Load().(func(*Packet, error) bool)
+		if onReadError == nil || !onReadError(p, err) {
+			return err
+		}
+		if l := getLogger(); l != nil {
+			l.Debugf("socket: skip the frame of %d bytes", p.Size())
+		}
+		// bb is still used for the next frame
+		readBuffer := p.readBuffer
+		p.readBuffer = nil
+		p.Reset(WithBody(body), WithNewBody(newBodyFunc), WithNewBodyCheck(newBodyCheck), WithBodyReclaim(bodyReclaim), WithContext(ctx))
+		p.readBuffer = readBuffer
+		p.lazy.enabled = lazy
+		p.keepRawBody = keepRawBody
+		p.reuseBodyBuffer = reuseBodyBuffer
+	}
+}
 
-	// read packet
-	err := r.readPacket(bb, p)
+func (r *rawProto) unpack(data []byte, p *Packet) error {
+	// do transfer pipe
+	data, err := p.XferPipe().OnUnpackLimit(data, atomic.LoadInt64(&r.maxDecompressedBytes))
 	if err != nil {
 		return err
 	}
-	// do transfer pipe
-	data, err := p.XferPipe().OnUnpack(bb.B)
+	// header
+	data, err = r.readHeader(data, p)
 	if err != nil {
 		return err
 	}
-	// header
-	data = r.readHeader(data, p)
 	// body
 	return r.readBody(data, p)
 }
 
-var errProtoUnmatch = errors.New("mismatched protocol")
+var (
+	errProtoUnmatch  = errors.New("mismatched protocol")
+	errFrameTooShort = errors.New("frame size is smaller than its prefix")
+	errHeaderFlag    = errors.New("unknown header compression flag")
+)
+
+// xferSkippedFlag is set in the length byte of the transfer pipe in the frame,
+// if the bit mask of the filters skipped on packing follows the filter ids,
+// so that the reader keeps the whole pipe the sender set.
+const xferSkippedFlag = 0x80
+
+// xferMaskLen returns the length of the bit mask of the skipped filters in the frame.
+func xferMaskLen(n int) int {
+	return (n + 7) / 8
+}
+
+// appendXferPipe appends the transfer pipe of the frame to b,
+// which is the length, the filter ids, and the bit mask of the skipped filters if any.
+// Note: the pipe of more than 127 filters has no room for the flag, so only the applied ids are written.
+func appendXferPipe(b []byte, ids []byte, skipped func(int) bool) []byte {
+	var mask []byte
+	for i := range ids {
+		if skipped(i) {
+			if mask == nil {
+				mask = make([]byte, xferMaskLen(len(ids)))
+			}
+			mask[i/8] |= 1 << uint(i%8)
+		}
+	}
+	if mask == nil {
+		b = append(b, byte(len(ids)))
+		return append(b, ids...)
+	}
+	if len(ids) >= xferSkippedFlag {
+		n := len(b)
+		b = append(b, 0)
+		for i, id := range ids {
+			if !skipped(i) {
+				b = append(b, id)
+			}
+		}
+		b[n] = byte(len(b) - n - 1)
+		return b
+	}
+	b = append(b, byte(len(ids))|xferSkippedFlag)
+	b = append(b, ids...)
+	return append(b, mask...)
+}
 
 func (r *rawProto) readPacket(bb *utils.ByteBuffer, p *Packet) error {
 	r.rMu.Lock()
 	defer r.rMu.Unlock()
-	// size
-	var size uint32
-	err := binary.Read(r.r, binary.BigEndian, &size)
+	// size, protocol and the length of transfer pipe
+	bb.ChangeLen(4 + 1 + 1)
+	_, err := io.ReadFull(r.r, bb.B)
 	if err != nil {
 		return err
 	}
+	var size = r.lengthOrder.Uint32(bb.B)
 	if err = p.SetSize(size); err != nil {
 		return err
 	}
-	// protocol
-	bb.ChangeLen(1024)
-	_, err = io.ReadFull(r.r, bb.B[:1])
-	if err != nil {
-		return err
-	}
-	if bb.B[0] != r.id {
+	if bb.B[4] != r.id {
 		return errProtoUnmatch
 	}
 	// transfer pipe
-	_, err = io.ReadFull(r.r, bb.B[:1])
-	if err != nil {
-		return err
+	var xferLen, maskLen = int(bb.B[5]), 0
+	if xferLen&xferSkippedFlag != 0 {
+		xferLen &^= xferSkippedFlag
+		maskLen = xferMaskLen(xferLen)
 	}
-	var xferLen = bb.B[0]
 	if xferLen > 0 {
-		_, err = io.ReadFull(r.r, bb.B[:xferLen])
+		bb.ChangeLen(xferLen + maskLen)
+		_, err = io.ReadFull(r.r, bb.B)
 		if err != nil {
 			return err
 		}
-		err = p.XferPipe().Append(bb.B[:xferLen]...)
-		if err != nil {
-			return err
+		mask := bb.B[xferLen:]
+		for i, id := range bb.B[:xferLen] {
+			if maskLen > 0 && mask[i/8]&(1<<uint(i%8)) != 0 {
+				err = p.XferPipe().AppendSkipped(id)
+			} else {
+				err = p.XferPipe().Append(id)
+			}
+			if err != nil {
+				return err
+			}
 		}
 	}
 	// read last all
-	var lastLen = int(size) - 4 - 1 - 1 - int(xferLen)
+	var lastLen = int(size) - 4 - 1 - 1 - xferLen - maskLen
+	if lastLen < 0 {
+		return errFrameTooShort
+	}
+	// the exact body length is checked after reading the header,
+	// here only rejects the frame that can not fit in any case.
+	if int64(lastLen) > r.getMaxBodyLength()+atomic.LoadInt64(&maxHeaderLength)+1 {
+		if int64(lastLen) > atomic.LoadInt64(&r.drainLimit) {
+			return ErrBodyTooLarge
+		}
+		// the frame is skipped, so that the next one is read from its start
+		if _, err = io.CopyN(ioutil.Discard, r.r, int64(lastLen)); err != nil {
+			return err
+		}
+		return ErrOversizedFrameDrained
+	}
 	bb.ChangeLen(lastLen)
 	_, err = io.ReadFull(r.r, bb.B)
 	return err
 }
 
-func (r *rawProto) readHeader(data []byte, p *Packet) []byte {
-	// seq
-	seqLen := binary.BigEndian.Uint32(data)
+func (r *rawProto) readHeader(data []byte, p *Packet) ([]byte, error) {
+	if atomic.LoadInt32(&r.compressHeader) == 0 {
+		return readRawHeader(data, p)
+	}
+	if len(data) < 1 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	flag := data[0]
+	data = data[1:]
+	switch flag {
+	case headerPlain:
+		return readRawHeader(data, p)
+	case headerDeflated:
+	default:
+		return nil, errHeaderFlag
+	}
+	if len(data) < 4 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	n := binary.BigEndian.Uint32(data)
 	data = data[4:]
-	p.SetSeq(string(data[:seqLen]))
-	data = data[seqLen:]
+	if uint64(n) > uint64(len(data)) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	header, err := inflateHeader(data[:n])
+	if err != nil {
+		return nil, err
+	}
+	if _, err = readRawHeader(header, p); err != nil {
+		return nil, err
+	}
+	return data[n:], nil
+}
+
+func readRawHeader(data []byte, p *Packet) ([]byte, error) {
+	var (
+		maxLen    = uint64(atomic.LoadInt64(&maxHeaderLength))
+		headerLen uint64
+	)
+	readField := func() ([]byte, error) {
+		if len(data) < 4 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		// compared as uint64, since the length may not fit in the int of 32-bit builds
+		fieldLen := uint64(binary.BigEndian.Uint32(data))
+		data = data[4:]
+		headerLen += 4
+		if headerLen+fieldLen > maxLen {
+			return nil, ErrHeaderTooLarge
+		}
+		if fieldLen > uint64(len(data)) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		field := data[:fieldLen]
+		data = data[fieldLen:]
+		headerLen += fieldLen
+		return field, nil
+	}
+	// seq
+	seq, err := readField()
+	if err != nil {
+		return nil, err
+	}
+	p.SetSeq(p.decodeString(seq))
 	// type
+	if len(data) < 1 {
+		return nil, io.ErrUnexpectedEOF
+	}
 	p.SetPtype(data[0])
 	data = data[1:]
+	headerLen++
 	// uri
-	uriLen := binary.BigEndian.Uint32(data)
-	data = data[4:]
-	p.SetUri(string(data[:uriLen]))
-	data = data[uriLen:]
+	uri, err := readField()
+	if err != nil {
+		return nil, err
+	}
+	p.SetUri(p.decodeString(uri))
 	// meta
-	metaLen := binary.BigEndian.Uint32(data)
-	data = data[4:]
-	p.Meta().ParseBytes(data[:metaLen])
-	data = data[metaLen:]
-	return data
+	meta, err := readField()
+	if err != nil {
+		return nil, err
+	}
+	p.Meta().ParseBytes(meta)
+	return data, nil
 }
 
 func (r *rawProto) readBody(data []byte, p *Packet) error {
+	if len(data) < 1 {
+		return io.ErrUnexpectedEOF
+	}
+	if int64(len(data)-1) > r.getMaxBodyLength() {
+		return ErrBodyTooLarge
+	}
 	p.SetBodyCodec(data[0])
 	return p.UnmarshalBody(data[1:])
 }
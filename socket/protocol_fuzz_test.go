@@ -0,0 +1,31 @@
+// +build go1.18
+
+package socket
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzRawProtoUnpack(f *testing.F) {
+	seeds := []*Packet{
+		NewPacket(),
+		NewPacket(WithSeq("1"), WithPtype(1), WithUri("/a/b?n=1"), WithBody([]byte("body"))),
+		NewPacket(WithSeq("2"), WithSetMeta("token", "abc"), WithXferPipe('z'), WithBody([]byte("compressed"))),
+	}
+	for _, p := range seeds {
+		var rw bytes.Buffer
+		if err := NewRawProtoFunc(&rw).Pack(p); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(rw.Bytes())
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		proto := NewRawProtoFunc(bytes.NewBuffer(data))
+		var body []byte
+		p := GetPacket(WithNewBody(func(Header) interface{} { return &body }))
+		defer PutPacket(p)
+		// it must return an error instead of panicking on the malformed frame
+		_ = proto.Unpack(p)
+	})
+}
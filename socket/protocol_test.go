@@ -0,0 +1,1445 @@
+package socket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/henrylee2cn/teleport/codec"
+	"github.com/henrylee2cn/teleport/utils"
+	"github.com/henrylee2cn/teleport/xfer"
+	"github.com/henrylee2cn/teleport/xfer/gzip"
+)
+
+func TestRawProtoMeta(t *testing.T) {
+	var rw bytes.Buffer
+	proto := NewRawProtoFunc(&rw)
+
+	p := GetPacket(WithSetMeta("token", "abc"), WithAddMeta("tenant", "t1"))
+	defer PutPacket(p)
+	if err := proto.Pack(p); err != nil {
+		t.Fatal(err)
+	}
+	q := GetPacket()
+	defer PutPacket(q)
+	if err := proto.Unpack(q); err != nil {
+		t.Fatal(err)
+	}
+	if string(q.Meta().Peek("token")) != "abc" || string(q.Meta().Peek("tenant")) != "t1" {
+		t.Fatalf("meta: %s", q.Meta().String())
+	}
+
+	q.Reset()
+	if q.Meta().Len() != 0 {
+		t.Fatalf("meta should be cleared by Reset, got: %s", q.Meta().String())
+	}
+}
+
+func TestRawProtoBodyCodec(t *testing.T) {
+	var rw bytes.Buffer
+	proto := NewRawProtoFunc(&rw)
+
+	p := GetPacket(WithBodyCodec('j'), WithBody(map[string]int{"a": 1}))
+	defer PutPacket(p)
+	if err := proto.Pack(p); err != nil {
+		t.Fatal(err)
+	}
+	var codecId byte
+	q := GetPacket(WithNewBody(func(h Header) interface{} {
+		codecId = h.(Body).BodyCodec()
+		return new(map[string]int)
+	}))
+	defer PutPacket(q)
+	if err := proto.Unpack(q); err != nil {
+		t.Fatal(err)
+	}
+	if codecId != 'j' {
+		t.Fatalf("body codec should be set before newBodyFunc, got: %d", codecId)
+	}
+	if m := *q.Body().(*map[string]int); m["a"] != 1 {
+		t.Fatalf("body: %v", m)
+	}
+}
+
+func init() {
+	gzip.Reg('z', "gzip-test", 5)
+}
+
+func TestRawProtoSkipXfer(t *testing.T) {
+	for _, body := range []string{"small", strings.Repeat("large", 200)} {
+		var rw bytes.Buffer
+		proto := NewRawProtoFunc(&rw)
+		p := GetPacket(WithXferPipe('z'), WithBody([]byte(body)))
+		// the packet is reusable, its transfer pipe is not changed by the skip
+		for i := 0; i < 2; i++ {
+			if err := proto.Pack(p); err != nil {
+				t.Fatal(err)
+			}
+			if p.XferPipe().Len() != 1 {
+				t.Fatalf("the transfer pipe of the packet is changed: %v", p.XferPipe().Names())
+			}
+		}
+		PutPacket(p)
+		for i := 0; i < 2; i++ {
+			var got []byte
+			q := GetPacket(WithNewBody(func(Header) interface{} { return &got }))
+			if err := proto.Unpack(q); err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != body {
+				t.Fatalf("want %q, have %q", body, got)
+			}
+			// the skipped filter is kept in the pipe read, such as for the reply
+			if compressed := len(body) >= gzip.CompressMinBytes(); q.XferPipe().Len() != 1 || compressed == q.XferPipe().Skipped(0) {
+				t.Fatalf("size: %d, transfer filters: %v, skipped: %v", len(body), q.XferPipe().Names(), q.XferPipe().Skipped(0))
+			}
+			PutPacket(q)
+		}
+	}
+}
+
+func TestWithBodyCompress(t *testing.T) {
+	for _, c := range []struct {
+		algo  string
+		level int
+	}{
+		{"unknown", 5},
+		{"gzip-test", 10},
+		{"gzip-test", -3},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("%s: expect panic for level %d", c.algo, c.level)
+				}
+			}()
+			WithBodyCompress(c.algo, c.level)
+		}()
+	}
+	var rw bytes.Buffer
+	proto := NewRawProtoFunc(&rw)
+	body := bytes.Repeat([]byte("teleport"), 4<<20/8)
+	p := GetPacket(WithBodyCompress("gzip-test", 9), WithBody(body))
+	if ids := p.XferPipe().Ids(); !bytes.Equal(ids, []byte{'z'}) {
+		t.Fatalf("transfer filters: %v", ids)
+	}
+	if err := proto.Pack(p); err != nil {
+		t.Fatal(err)
+	}
+	PutPacket(p)
+	if rw.Len() >= len(body)/10 {
+		t.Fatalf("the body is not compressed: %d", rw.Len())
+	}
+	var got []byte
+	q := GetPacket(WithNewBody(func(Header) interface{} { return &got }))
+	defer PutPacket(q)
+	if err := proto.Unpack(q); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, body) {
+		t.Fatal("the body is changed")
+	}
+}
+
+func TestRawProtoDefaultBodyCodec(t *testing.T) {
+	var rw bytes.Buffer
+	proto := NewRawProtoFunc(&rw)
+	unpack := func() *Packet {
+		q := GetPacket(WithNewBody(func(Header) interface{} {
+			return new(map[string]int)
+		}))
+		if err := proto.Unpack(q); err != nil {
+			t.Fatal(err)
+		}
+		return q
+	}
+
+	// body set with nil codec uses the default
+	p := GetPacket(WithBody(map[string]int{"a": 1}))
+	defer PutPacket(p)
+	if err := proto.Pack(p); err != nil {
+		t.Fatal(err)
+	}
+	q := unpack()
+	if q.BodyCodec() != DefaultBodyCodec() {
+		t.Fatalf("body codec: got %d, want %d", q.BodyCodec(), DefaultBodyCodec())
+	}
+	if m := *q.Body().(*map[string]int); m["a"] != 1 {
+		t.Fatalf("body: %v", m)
+	}
+	PutPacket(q)
+
+	// explicit codec overrides the default
+	SetDefaultBodyCodec("form")
+	defer SetDefaultBodyCodec("json")
+	p.Reset(WithBodyCodec('j'), WithBody(map[string]int{"a": 2}))
+	if err := proto.Pack(p); err != nil {
+		t.Fatal(err)
+	}
+	q = unpack()
+	if q.BodyCodec() != 'j' {
+		t.Fatalf("body codec: got %d, want %d", q.BodyCodec(), 'j')
+	}
+	PutPacket(q)
+
+	// nil body with nil codec writes nothing
+	p.Reset()
+	if err := proto.Pack(p); err != nil {
+		t.Fatal(err)
+	}
+	q = unpack()
+	if q.BodyCodec() != 0 {
+		t.Fatalf("body codec: got %d, want 0", q.BodyCodec())
+	}
+	if m := *q.Body().(*map[string]int); len(m) != 0 {
+		t.Fatalf("body should be empty, got: %v", m)
+	}
+	PutPacket(q)
+}
+
+// streamBody is encoded as N bytes of 'x' by streamCodec.
+type streamBody struct{ N int }
+
+// streamCodec only supports streaming encoding.
+type streamCodec struct{ encoded int }
+
+func (*streamCodec) Id() byte     { return 0xe0 }
+func (*streamCodec) Name() string { return "test-stream" }
+
+func (*streamCodec) Marshal(v interface{}) ([]byte, error) {
+	return nil, errors.New("Marshal should not be called")
+}
+
+func (*streamCodec) Unmarshal(data []byte, v interface{}) error {
+	v.(*streamBody).N = len(data)
+	return nil
+}
+
+func (c *streamCodec) EncodeTo(w io.Writer, v interface{}) error {
+	chunk := bytes.Repeat([]byte{'x'}, 4096)
+	for n := v.(*streamBody).N; n > 0; n -= len(chunk) {
+		if n < len(chunk) {
+			chunk = chunk[:n]
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		c.encoded += len(chunk)
+	}
+	return nil
+}
+
+func (*streamCodec) DecodeFrom(r io.Reader, v interface{}) error {
+	n, err := io.Copy(ioutil.Discard, r)
+	v.(*streamBody).N = int(n)
+	return err
+}
+
+var testStreamCodec = new(streamCodec)
+
+func init() {
+	codec.Reg(testStreamCodec)
+}
+
+type namedBody map[string]int
+
+func (namedBody) CodecName() string { return "msgpack" }
+
+type unknownNamedBody map[string]int
+
+func (unknownNamedBody) CodecName() string { return "unknown" }
+
+func TestRawProtoCodecNamer(t *testing.T) {
+	var rw bytes.Buffer
+	proto := NewRawProtoFunc(&rw)
+
+	// the body names its codec
+	p := GetPacket(WithBody(namedBody{"a": 1}))
+	defer PutPacket(p)
+	if err := proto.Pack(p); err != nil {
+		t.Fatal(err)
+	}
+	q := GetPacket(WithNewBody(func(Header) interface{} { return new(map[string]int) }))
+	defer PutPacket(q)
+	if err := proto.Unpack(q); err != nil {
+		t.Fatal(err)
+	}
+	if q.BodyCodec() != codec.ID_MSGPACK {
+		t.Fatalf("body codec: got %d, want %d", q.BodyCodec(), codec.ID_MSGPACK)
+	}
+	if m := *q.Body().(*map[string]int); m["a"] != 1 {
+		t.Fatalf("body: %v", m)
+	}
+
+	// the explicit codec wins
+	p.Reset(WithBodyCodec(codec.ID_JSON), WithBody(namedBody{"a": 1}))
+	if id, err := p.ResolveBodyCodec(); err != nil || id != codec.ID_JSON {
+		t.Fatalf("body codec: got %d, want %d, error: %v", id, codec.ID_JSON, err)
+	}
+
+	// the body does not name its codec
+	p.Reset(WithBody(map[string]int{"a": 1}))
+	if id, err := p.ResolveBodyCodec(); err != nil || id != DefaultBodyCodec() {
+		t.Fatalf("body codec: got %d, want %d, error: %v", id, DefaultBodyCodec(), err)
+	}
+	// marshalling does not change the packet
+	if _, err := p.MarshalBody(); err != nil || p.BodyCodec() != codec.NilCodecId {
+		t.Fatalf("body codec: got %d after marshalling, want %d, error: %v", p.BodyCodec(), codec.NilCodecId, err)
+	}
+
+	// the named codec is not registered
+	p.Reset(WithBody(unknownNamedBody{"a": 1}))
+	if _, err := p.MarshalBody(); err == nil {
+		t.Fatal("want the unsupported codec error")
+	}
+}
+
+func TestRawProtoStreamCodec(t *testing.T) {
+	var rw bytes.Buffer
+	proto := NewRawProtoFunc(&rw)
+
+	const size = 4 << 20
+	testStreamCodec.encoded = 0
+	p := GetPacket(WithBodyCodec(0xe0), WithBody(&streamBody{N: size}))
+	defer PutPacket(p)
+	if err := proto.Pack(p); err != nil {
+		t.Fatal(err)
+	}
+	if testStreamCodec.encoded != size {
+		t.Fatalf("encoded through EncodeTo: got %d, want %d", testStreamCodec.encoded, size)
+	}
+	q := GetPacket(WithNewBody(func(Header) interface{} {
+		return new(streamBody)
+	}))
+	defer PutPacket(q)
+	if err := proto.Unpack(q); err != nil {
+		t.Fatal(err)
+	}
+	if q.BodyCodec() != 0xe0 || q.Body().(*streamBody).N != size {
+		t.Fatalf("body codec: %d, body size: %d", q.BodyCodec(), q.Body().(*streamBody).N)
+	}
+}
+
+// rawFrame builds a raw proto frame without transfer filters.
+func rawFrame(header []byte) []byte {
+	frame := make([]byte, 4, 4+2+len(header)+1)
+	frame = append(frame, 'r', 0)
+	frame = append(frame, header...)
+	frame = append(frame, codec.NilCodecId)
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)))
+	return frame
+}
+
+// rawHeader builds a raw proto header with the given field length prefixes.
+func rawHeader(seqLen, uriLen uint32, uri string) []byte {
+	b := make([]byte, 4+1+4+len(uri)+4)
+	binary.BigEndian.PutUint32(b, seqLen)
+	b[4] = 1
+	binary.BigEndian.PutUint32(b[5:], uriLen)
+	copy(b[9:], uri)
+	return b
+}
+
+func TestRawProtoMaxHeaderLength(t *testing.T) {
+	defer SetMaxHeaderLength(0)
+	var cases = []struct {
+		maxLen int
+		header []byte
+		err    error
+	}{
+		{0, rawHeader(0, 4, "/a/b"), nil},
+		{0, rawHeader(math.MaxUint32, 0, ""), ErrHeaderTooLarge},
+		{0, rawHeader(0, 1<<20, ""), ErrHeaderTooLarge},
+		{0, rawHeader(0, 1<<10, "/a/b"), io.ErrUnexpectedEOF},
+		{0, rawHeader(0, 0, "")[:6], io.ErrUnexpectedEOF},
+		{17, rawHeader(0, 4, "/a/b"), nil},
+		{17, rawHeader(0, 5, "/a/bc"), ErrHeaderTooLarge},
+	}
+	for i, c := range cases {
+		SetMaxHeaderLength(c.maxLen)
+		proto := NewRawProtoFunc(bytes.NewBuffer(rawFrame(c.header)))
+		p := GetPacket()
+		err := proto.Unpack(p)
+		PutPacket(p)
+		if err != c.err {
+			t.Fatalf("case %d: got error %v, want %v", i, err, c.err)
+		}
+	}
+}
+
+func TestRawProtoMaxBodyLength(t *testing.T) {
+	SetMaxBodyLength(1 << 10)
+	defer SetMaxBodyLength(0)
+	var rw bytes.Buffer
+	proto := NewRawProtoFunc(&rw)
+	for _, size := range []int{1 << 10, 1<<10 + 1, 1 << 10} {
+		p := GetPacket(WithBody(make([]byte, size)))
+		if err := proto.Pack(p); err != nil {
+			t.Fatal(err)
+		}
+		PutPacket(p)
+	}
+	body := new([]byte)
+	p := GetPacket()
+	defer PutPacket(p)
+	for i, want := range []error{nil, ErrBodyTooLarge, nil} {
+		p.Reset(WithBody(body))
+		if err := proto.Unpack(p); err != want {
+			t.Fatalf("frame %d: got error %v, want %v", i, err, want)
+		}
+		if want == nil && len(*body) != 1<<10 {
+			t.Fatalf("frame %d: body length: got %d, want %d", i, len(*body), 1<<10)
+		}
+	}
+
+	// a frame claiming a huge body is rejected before reading it
+	frame := rawFrame(rawHeader(0, 0, ""))
+	binary.BigEndian.PutUint32(frame, math.MaxUint32)
+	allocs := testing.AllocsPerRun(10, func() {
+		p.Reset()
+		proto := NewRawProtoFunc(bytes.NewBuffer(frame))
+		if err := proto.Unpack(p); err != ErrBodyTooLarge {
+			t.Fatalf("got error %v, want %v", err, ErrBodyTooLarge)
+		}
+	})
+	if allocs > 10 {
+		t.Fatalf("too many allocations: %v", allocs)
+	}
+}
+
+func TestSocketMaxBodyLength(t *testing.T) {
+	var rw bytes.Buffer
+	s := &socket{protocol: NewRawProtoFunc(&rw)}
+	p := GetPacket(WithBody(make([]byte, 16)))
+	defer PutPacket(p)
+	for i := 0; i < 2; i++ {
+		if err := s.WritePacket(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.SetMaxBodyLength(15)
+	p.Reset(WithBody(new([]byte)))
+	if err := s.ReadPacket(p); err != ErrBodyTooLarge {
+		t.Fatalf("got error %v, want %v", err, ErrBodyTooLarge)
+	}
+	s.SetMaxBodyLength(0)
+	p.Reset(WithBody(new([]byte)))
+	if err := s.ReadPacket(p); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSocketMaxDecompressedBytes(t *testing.T) {
+	var rw bytes.Buffer
+	s := &socket{protocol: NewRawProtoFunc(&rw)}
+	p := GetPacket(WithXferPipe('z'), WithBody(make([]byte, 4<<10)))
+	defer PutPacket(p)
+	for i := 0; i < 2; i++ {
+		if err := s.WritePacket(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the limit of the socket overrides the package-level one
+	s.SetMaxDecompressedBytes(1 << 10)
+	p.Reset(WithBody(new([]byte)))
+	if err := s.ReadPacket(p); err != xfer.ErrDecompressedTooLarge {
+		t.Fatalf("got error %v, want %v", err, xfer.ErrDecompressedTooLarge)
+	}
+	s.SetMaxDecompressedBytes(0)
+	p.Reset(WithBody(new([]byte)))
+	if err := s.ReadPacket(p); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSocketDrainOversizedFrame(t *testing.T) {
+	SetMaxBodyLength(1 << 10)
+	defer SetMaxBodyLength(0)
+	SetMaxHeaderLength(1 << 10)
+	defer SetMaxHeaderLength(0)
+	var rw bytes.Buffer
+	s := &socket{protocol: NewRawProtoFunc(&rw)}
+	for i, size := range []int{16, 1 << 12, 16, 1 << 16, 16} {
+		p := GetPacket(WithSeq(strconv.Itoa(i)), WithBody(make([]byte, size)))
+		if err := s.WritePacket(p); err != nil {
+			t.Fatal(err)
+		}
+		PutPacket(p)
+	}
+	s.SetDrainOversizedFrame(1 << 13)
+	body := new([]byte)
+	p := GetPacket()
+	defer PutPacket(p)
+	// the frame over the drain limit is left unread, so the last frame is not checked
+	for i, want := range []error{nil, ErrOversizedFrameDrained, nil, ErrBodyTooLarge} {
+		p.Reset(WithBody(body))
+		if err := s.ReadPacket(p); err != want {
+			t.Fatalf("frame %d: got error %v, want %v", i, err, want)
+		}
+		if want == nil && (p.Seq() != strconv.Itoa(i) || len(*body) != 16) {
+			t.Fatalf("frame %d: got seq %q, %d body bytes", i, p.Seq(), len(*body))
+		}
+	}
+}
+
+func TestRawProtoMalformedHeader(t *testing.T) {
+	rd := rand.New(rand.NewSource(1))
+	valid := rawHeader(0, 4, "/a/b")
+	for i := 0; i < 10000; i++ {
+		header := append([]byte(nil), valid[:rd.Intn(len(valid)+1)]...)
+		for j := rd.Intn(4); j > 0 && len(header) > 0; j-- {
+			header[rd.Intn(len(header))] = byte(rd.Intn(256))
+		}
+		func() {
+			defer func() {
+				if e := recover(); e != nil {
+					t.Fatalf("header %x: panic: %v", header, e)
+				}
+			}()
+			p := GetPacket()
+			defer PutPacket(p)
+			NewRawProtoFunc(bytes.NewBuffer(rawFrame(header))).Unpack(p)
+		}()
+	}
+}
+
+type captureLogger struct {
+	mu     sync.Mutex
+	debugs []string
+	errors []string
+}
+
+func (l *captureLogger) Debugf(format string, a ...interface{}) {
+	l.mu.Lock()
+	l.debugs = append(l.debugs, fmt.Sprintf(format, a...))
+	l.mu.Unlock()
+}
+
+func (l *captureLogger) Errorf(format string, a ...interface{}) {
+	l.mu.Lock()
+	l.errors = append(l.errors, fmt.Sprintf(format, a...))
+	l.mu.Unlock()
+}
+
+func (l *captureLogger) logged(logs *[]string, substr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, log := range *logs {
+		if strings.Contains(log, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLogger(t *testing.T) {
+	l := new(captureLogger)
+	SetLogger(l)
+	defer SetLogger(nil)
+
+	// the uri length exceeds the header
+	frame := rawFrame(rawHeader(0, 100, "/a/b"))
+	if err := NewRawProtoFunc(bytes.NewBuffer(frame)).Unpack(NewPacket()); err == nil {
+		t.Fatal("the malformed frame should fail")
+	}
+	if !l.logged(&l.errors, "failed to decode the frame") {
+		t.Fatalf("errors: %q", l.errors)
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go NewSocket(c2).WritePacket(NewPacket(WithSeq("1"), WithUri("/log")))
+	if err := NewSocket(c1).ReadPacket(NewPacket()); err != nil {
+		t.Fatal(err)
+	}
+	if !l.logged(&l.debugs, `uri="/log"`) {
+		t.Fatalf("debugs: %q", l.debugs)
+	}
+}
+
+func TestPacketTotalSize(t *testing.T) {
+	for _, xferPipe := range [][]byte{nil, {'z'}} {
+		p := GetPacket(
+			WithSeq("1"),
+			WithUri("/a/b"),
+			WithXferPipe(xferPipe...),
+			WithBody(strings.Repeat("teleport", 1024)),
+		)
+		size, err := p.TotalSize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rw bytes.Buffer
+		if err = NewRawProtoFunc(&rw).Pack(p); err != nil {
+			t.Fatal(err)
+		}
+		if size != int64(rw.Len()) {
+			t.Fatalf("xfer pipe %v: TotalSize got %d, written %d", xferPipe, size, rw.Len())
+		}
+		if size != int64(p.Size()) {
+			t.Fatalf("xfer pipe %v: TotalSize got %d, size %d", xferPipe, size, p.Size())
+		}
+		PutPacket(p)
+	}
+}
+
+func TestAppendRawHeader(t *testing.T) {
+	p := GetPacket(WithSeq("1"), WithPtype(1), WithUri("/a/b"), WithSetMeta("k", "v"))
+	defer PutPacket(p)
+	b := appendRawHeader(nil, p)
+	q := GetPacket()
+	defer PutPacket(q)
+	if _, err := new(rawProto).readHeader(b, q); err != nil {
+		t.Fatal(err)
+	}
+	if q.Seq() != "1" || q.Ptype() != 1 || q.Uri() != "/a/b" || string(q.Meta().Peek("k")) != "v" {
+		t.Fatalf("header: %s", q.String())
+	}
+	buf := make([]byte, 0, len(b))
+	allocs := testing.AllocsPerRun(100, func() {
+		buf = appendRawHeader(buf[:0], p)
+	})
+	if allocs != 0 || !bytes.Equal(buf, b) {
+		t.Fatalf("allocs: %v, header: %x, want: %x", allocs, buf, b)
+	}
+}
+
+func TestReadRawHeaderReuse(t *testing.T) {
+	p := GetPacket(WithSeq("1"), WithPtype(1))
+	for i := 0; i < 10; i++ {
+		p.Meta().Set(fmt.Sprintf("key%d", i), "value")
+	}
+	b := appendRawHeader(nil, p)
+	PutPacket(p)
+	q := GetPacket()
+	defer PutPacket(q)
+	// the metadata storage is kept by Reset
+	allocs := testing.AllocsPerRun(100, func() {
+		q.Reset()
+		if _, err := new(rawProto).readHeader(b, q); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 || q.Meta().Len() != 10 {
+		t.Fatalf("allocs: %v, meta: %s", allocs, q.Meta().String())
+	}
+}
+
+func BenchmarkRawProtoPack(b *testing.B) {
+	proto := NewRawProtoFunc(new(countWriter))
+	p := GetPacket(
+		WithSeq("1"),
+		WithPtype(1),
+		WithUri("/a/b?x=1"),
+		WithSetMeta("k", "v"),
+		WithBody([]byte("teleport")),
+	)
+	defer PutPacket(p)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := proto.Pack(p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRawProtoPackMeta(b *testing.B) {
+	proto := NewRawProtoFunc(new(countWriter))
+	p := GetPacket(
+		WithSeq("1"),
+		WithPtype(1),
+		WithUri("/a/b?x=1"),
+		WithBody([]byte("teleport")),
+	)
+	defer PutPacket(p)
+	for i := 0; i < 10; i++ {
+		p.Meta().Set("X-Key-"+strconv.Itoa(i), "value-"+strconv.Itoa(i))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := proto.Pack(p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// repeatReader reads the same data repeatedly.
+type repeatReader struct {
+	data []byte
+	off  int
+}
+
+func (r *repeatReader) Read(b []byte) (int, error) {
+	n := copy(b, r.data[r.off:])
+	r.off = (r.off + n) % len(r.data)
+	return n, nil
+}
+
+func (r *repeatReader) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func BenchmarkRawProtoUnpack(b *testing.B) {
+	benchmarkRawProtoUnpack(b, false)
+}
+
+func BenchmarkRawProtoUnpackUnsafeString(b *testing.B) {
+	benchmarkRawProtoUnpack(b, true)
+}
+
+func benchmarkRawProtoUnpack(b *testing.B, unsafeString bool) {
+	defer SetUnsafeStringDecode(UnsafeStringDecode())
+	SetUnsafeStringDecode(unsafeString)
+	var frame bytes.Buffer
+	p := GetPacket(
+		WithSeq("1"),
+		WithPtype(1),
+		WithUri("/a/b?x=1"),
+		WithSetMeta("k", "v"),
+		WithSetMeta("trace", "0123456789abcdef"),
+		WithBody([]byte("teleport")),
+	)
+	defer PutPacket(p)
+	if err := NewRawProtoFunc(&frame).Pack(p); err != nil {
+		b.Fatal(err)
+	}
+	proto := NewRawProtoFunc(&repeatReader{data: frame.Bytes()})
+	body := new([]byte)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.Reset(WithBody(body))
+		if err := proto.Unpack(p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRawProtoUnsafeStringDecode(t *testing.T) {
+	defer SetUnsafeStringDecode(UnsafeStringDecode())
+	SetUnsafeStringDecode(true)
+	var frames bytes.Buffer
+	proto := NewRawProtoFunc(&frames)
+	for _, seq := range []string{"12345", "67890"} {
+		p := NewPacket(WithSeq(seq), WithUri("/a/b?seq="+seq), WithBody([]byte("body")))
+		if err := proto.Pack(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := GetPacket(WithBody(new([]byte)))
+	if err := proto.Unpack(p); err != nil {
+		t.Fatal(err)
+	}
+	if p.readBuffer == nil {
+		t.Fatal("the packet should hold the read buffer")
+	}
+	if p.Seq() != "12345" || p.UriPath() != "/a/b" || p.UriParam("seq") != "12345" {
+		t.Fatalf("seq: %q, uri: %q", p.Seq(), p.Uri())
+	}
+	c := p.Clone()
+	// the next read replaces the buffer
+	if err := proto.Unpack(p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Seq() != "67890" || p.UriParam("seq") != "67890" {
+		t.Fatalf("seq: %q, uri: %q", p.Seq(), p.Uri())
+	}
+	p.ResetKeep(KeepSeq | KeepUri)
+	if p.readBuffer != nil {
+		t.Fatal("the read buffer should be released")
+	}
+	// overwrite the released buffers
+	for i := 0; i < 4; i++ {
+		bb := utils.AcquireByteBuffer()
+		bb.ChangeLen(cap(bb.B))
+		for j := range bb.B {
+			bb.B[j] = 'x'
+		}
+		defer utils.ReleaseByteBuffer(bb)
+	}
+	if p.Seq() != "67890" || p.Uri() != "/a/b?seq=67890" {
+		t.Fatalf("the kept fields are changed: seq: %q, uri: %q", p.Seq(), p.Uri())
+	}
+	if c.Seq() != "12345" || c.Uri() != "/a/b?seq=12345" {
+		t.Fatalf("the clone is changed: seq: %q, uri: %q", c.Seq(), c.Uri())
+	}
+	PutPacket(p)
+}
+
+func TestRawProtoReuseReadBuffer(t *testing.T) {
+	var frames bytes.Buffer
+	proto := NewRawProtoFunc(&frames)
+	proto.(*rawProto).SetReuseReadBuffer(true)
+	bodies := []string{"small", strings.Repeat("large", 100), "tiny"}
+	for i, body := range bodies {
+		p := NewPacket(WithSeq(fmt.Sprint(i)), WithUri("/reuse"), WithSetMeta("k", body), WithBody([]byte(body)))
+		if err := proto.Pack(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []*Packet
+	for range bodies {
+		p := NewPacket(WithBody(new([]byte)))
+		if err := proto.Unpack(p); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, p)
+	}
+	// the frames read later must not change the earlier packets
+	for i, p := range got {
+		body := bodies[i]
+		if p.Seq() != fmt.Sprint(i) || p.Uri() != "/reuse" || string(p.Meta().Peek("k")) != body || string(p.RawBody()) != body {
+			t.Fatalf("packet %d: %s", i, p)
+		}
+	}
+	if size := cap(proto.(*rawProto).readBuffer.B); size < len(bodies[1]) {
+		t.Fatalf("the scratch should grow to the largest frame, got %d", size)
+	}
+}
+
+// BenchmarkRawProtoUnpackReuseReadBuffer reads the fixed-size frames without allocation.
+func BenchmarkRawProtoUnpackReuseReadBuffer(b *testing.B) {
+	var frame bytes.Buffer
+	p := NewPacket(WithSeq("1"), WithPtype(1), WithBody(bytes.Repeat([]byte("teleport"), 64)))
+	if err := NewRawProtoFunc(&frame).Pack(p); err != nil {
+		b.Fatal(err)
+	}
+	proto := NewRawProtoFunc(&repeatReader{data: frame.Bytes()})
+	proto.(*rawProto).SetReuseReadBuffer(true)
+	body := new([]byte)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.Reset(WithBody(body))
+		if err := proto.Unpack(p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+type lazyTestBody struct {
+	Name  string
+	Items []int
+}
+
+func TestRawProtoLazyBody(t *testing.T) {
+	var frame bytes.Buffer
+	proto := NewRawProtoFunc(&frame)
+	want := lazyTestBody{Name: "lazy", Items: []int{1, 2, 3}}
+	if err := proto.Pack(NewPacket(WithUri("/a"), WithBody(want), WithXferPipe('z'))); err != nil {
+		t.Fatal(err)
+	}
+	var newBodyCalls int
+	p := NewPacket(WithLazyBody(), WithNewBody(func(Header) interface{} {
+		newBodyCalls++
+		return new(lazyTestBody)
+	}))
+	if err := proto.Unpack(p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Uri() != "/a" || p.Body() != nil || newBodyCalls != 0 {
+		t.Fatalf("the body should not be decoded: uri: %q, body: %v, newBody calls: %d", p.Uri(), p.Body(), newBodyCalls)
+	}
+	for i := 0; i < 2; i++ {
+		if err := p.DecodeBody(); err != nil {
+			t.Fatal(err)
+		}
+		if got := p.Body().(*lazyTestBody); !reflect.DeepEqual(*got, want) || newBodyCalls != 1 {
+			t.Fatalf("call %d: body: %+v, newBody calls: %d", i, *got, newBodyCalls)
+		}
+	}
+
+	// the error is kept
+	frame.Reset()
+	if err := proto.Pack(NewPacket(WithBody([]byte("{")), WithBodyCodec(codec.ID_JSON))); err != nil {
+		t.Fatal(err)
+	}
+	p.Reset(WithLazyBody(), WithBody(new(lazyTestBody)))
+	if err := proto.Unpack(p); err != nil {
+		t.Fatal(err)
+	}
+	err := p.DecodeBody()
+	if err == nil || p.DecodeBody() != err {
+		t.Fatalf("the same error is expected: %v", err)
+	}
+
+	// Reset clears it
+	frame.Reset()
+	if err := proto.Pack(NewPacket(WithBody(want))); err != nil {
+		t.Fatal(err)
+	}
+	p.Reset(WithBody(new(lazyTestBody)))
+	if err := proto.Unpack(p); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.Body().(*lazyTestBody); got.Name != want.Name || p.DecodeBody() != nil {
+		t.Fatalf("the body should be decoded eagerly: %+v", *got)
+	}
+}
+
+func BenchmarkRawProtoUnpackEagerBody(b *testing.B) {
+	benchmarkRawProtoUnpackBody(b, false)
+}
+
+// BenchmarkRawProtoUnpackLazyBody decodes only 10% of the bodies.
+func BenchmarkRawProtoUnpackLazyBody(b *testing.B) {
+	benchmarkRawProtoUnpackBody(b, true)
+}
+
+func benchmarkRawProtoUnpackBody(b *testing.B, lazy bool) {
+	var frame bytes.Buffer
+	body := lazyTestBody{Name: "teleport", Items: make([]int, 64)}
+	if err := NewRawProtoFunc(&frame).Pack(NewPacket(WithUri("/a/b"), WithBody(body))); err != nil {
+		b.Fatal(err)
+	}
+	proto := NewRawProtoFunc(&repeatReader{data: frame.Bytes()})
+	p := NewPacket()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if lazy {
+			p.Reset(WithLazyBody(), WithBody(new(lazyTestBody)))
+		} else {
+			p.Reset(WithBody(new(lazyTestBody)))
+		}
+		if err := proto.Unpack(p); err != nil {
+			b.Fatal(err)
+		}
+		if i%10 == 0 {
+			if err := p.DecodeBody(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestRawProtoOnReadError(t *testing.T) {
+	var frames bytes.Buffer
+	for _, seq := range []string{"1", "2"} {
+		p := GetPacket(WithSeq(seq), WithBody([]byte(seq)))
+		if err := NewRawProtoFunc(&frames).Pack(p); err != nil {
+			t.Fatal(err)
+		}
+		PutPacket(p)
+		if seq == "1" {
+			// a malformed frame, whose framing is intact
+			frames.Write(rawFrame(rawHeader(0, 0, "")[:6]))
+		}
+	}
+	data := frames.Bytes()
+
+	for _, skip := range []bool{true, false} {
+		proto := NewRawProtoFunc(bytes.NewBuffer(data))
+		var handled []error
+		proto.(*rawProto).SetOnReadError(func(p *Packet, err error) bool {
+			handled = append(handled, err)
+			return skip
+		})
+		body := new([]byte)
+		p := GetPacket(WithBody(body))
+		if err := proto.Unpack(p); err != nil || p.Seq() != "1" {
+			t.Fatalf("skip=%v: seq: %q, error: %v", skip, p.Seq(), err)
+		}
+		p.Reset(WithBody(body))
+		err := proto.Unpack(p)
+		if skip {
+			if err != nil || p.Seq() != "2" || string(*body) != "2" || p.Body() != body {
+				t.Fatalf("skip=%v: seq: %q, body: %q, error: %v", skip, p.Seq(), *body, err)
+			}
+		} else if err != io.ErrUnexpectedEOF {
+			t.Fatalf("skip=%v: got error %v, want %v", skip, err, io.ErrUnexpectedEOF)
+		}
+		if len(handled) != 1 || handled[0] != io.ErrUnexpectedEOF {
+			t.Fatalf("skip=%v: handled errors: %v", skip, handled)
+		}
+		PutPacket(p)
+	}
+}
+
+func TestRawProtoOnReadErrorKeepSettings(t *testing.T) {
+	var frames bytes.Buffer
+	for _, body := range []interface{}{map[string]string{"a": "b"}, []byte("body")} {
+		// the malformed frame is skipped before the good one
+		frames.Write(rawFrame(rawHeader(0, 0, "")[:6]))
+		p := GetPacket(WithSeq("1"), WithBody(body))
+		if err := NewRawProtoFunc(&frames).Pack(p); err != nil {
+			t.Fatal(err)
+		}
+		PutPacket(p)
+	}
+
+	proto := NewRawProtoFunc(&frames)
+	proto.(*rawProto).SetOnReadError(func(*Packet, error) bool { return true })
+	body := new(map[string]string)
+	q := GetPacket(WithKeepRawBody(), WithBody(body))
+	defer PutPacket(q)
+	if err := proto.Unpack(q); err != nil || q.Seq() != "1" || (*body)["a"] != "b" {
+		t.Fatalf("seq: %q, body: %v, error: %v", q.Seq(), *body, err)
+	}
+	if string(q.RawBody()) != `{"a":"b"}` {
+		t.Fatalf("the raw body is not kept after the skip: %q", q.RawBody())
+	}
+
+	buf := make([]byte, 0, 16)
+	head := buf[:1]
+	q.Reset(WithReuseBodyBuffer(), WithBody(&buf))
+	if err := proto.Unpack(q); err != nil || string(buf) != "body" {
+		t.Fatalf("body: %q, error: %v", buf, err)
+	}
+	if &buf[0] != &head[0] {
+		t.Fatal("the body buffer is not reused after the skip")
+	}
+}
+
+func TestRawProtoForwardRawBody(t *testing.T) {
+	// the body codec 0xe1 is not registered
+	const bodyCodec = 0xe1
+	var in, out bytes.Buffer
+	p := GetPacket(WithSeq("1"), WithBodyCodec(bodyCodec), WithBody([]byte{1, 2, 3}))
+	defer PutPacket(p)
+	if err := NewRawProtoFunc(&in).Pack(p); err != nil {
+		t.Fatal(err)
+	}
+
+	// proxy
+	relay := GetPacket(WithBody(new([]byte)))
+	defer PutPacket(relay)
+	if err := NewRawProtoFunc(&in).Unpack(relay); err != nil {
+		t.Fatal(err)
+	}
+	forward := GetPacket(WithSeq(relay.Seq()), WithBodyCodec(relay.BodyCodec()), WithBody(relay.RawBody()))
+	defer PutPacket(forward)
+	if err := NewRawProtoFunc(&out).Pack(forward); err != nil {
+		t.Fatal(err)
+	}
+
+	q := GetPacket(WithBody(new([]byte)))
+	defer PutPacket(q)
+	if err := NewRawProtoFunc(&out).Unpack(q); err != nil {
+		t.Fatal(err)
+	}
+	if q.BodyCodec() != bodyCodec || !bytes.Equal(q.RawBody(), []byte{1, 2, 3}) {
+		t.Fatalf("body codec: %d, body: %v", q.BodyCodec(), q.RawBody())
+	}
+}
+
+func TestRawProtoKeepRawBody(t *testing.T) {
+	var rw bytes.Buffer
+	proto := NewRawProtoFunc(&rw)
+	for i := 0; i < 2; i++ {
+		p := GetPacket(WithXferPipe('z'), WithBody(map[string]string{"a": strings.Repeat("b", 1024)}))
+		if err := proto.Pack(p); err != nil {
+			t.Fatal(err)
+		}
+		PutPacket(p)
+	}
+	body := new(map[string]string)
+	q := GetPacket(WithKeepRawBody(), WithBody(body))
+	defer PutPacket(q)
+	if err := proto.Unpack(q); err != nil {
+		t.Fatal(err)
+	}
+	// the kept bytes are after the gzip filter, the same as Marshal
+	want, _ := json.Marshal(*body)
+	if (*body)["a"] == "" || !bytes.Equal(q.RawBody(), want) {
+		t.Fatalf("body: %v, raw body: %q", *body, q.RawBody())
+	}
+	q.Reset(WithBody(new(map[string]string)))
+	if err := proto.Unpack(q); err != nil {
+		t.Fatal(err)
+	}
+	if q.RawBody() != nil {
+		t.Fatalf("the raw body is kept without WithKeepRawBody: %q", q.RawBody())
+	}
+}
+
+func TestRawProtoHeaderCompression(t *testing.T) {
+	longUri := "/api/v1/users/" + strings.Repeat("profile/", 64) + "?fields=" + strings.Repeat("name,", 32)
+	for _, uri := range []string{"/a", longUri} {
+		var plain, frame bytes.Buffer
+		p := NewPacket(WithSeq("1"), WithUri(uri), WithSetMeta("trace", strings.Repeat("0123456789", 10)), WithBody([]byte("body")))
+		if err := NewRawProtoFunc(&plain).Pack(p); err != nil {
+			t.Fatal(err)
+		}
+		proto := NewRawProtoFunc(&frame)
+		proto.(*rawProto).SetHeaderCompression(true)
+		if err := proto.Pack(p); err != nil {
+			t.Fatal(err)
+		}
+		if uri == longUri && frame.Len() >= plain.Len()/2 {
+			t.Fatalf("the long header should be compressed: %d bytes, %d bytes uncompressed", frame.Len(), plain.Len())
+		}
+		if uri != longUri && frame.Len() != plain.Len()+1 {
+			t.Fatalf("the short header should only be prefixed by the flag: %d bytes, %d bytes uncompressed", frame.Len(), plain.Len())
+		}
+		q := NewPacket(WithBody(new([]byte)))
+		if err := proto.Unpack(q); err != nil {
+			t.Fatal(err)
+		}
+		if q.Uri() != uri || q.Meta().String() != p.Meta().String() || string(q.RawBody()) != "body" {
+			t.Fatalf("uri: %q, meta: %q, body: %q", q.Uri(), q.Meta().String(), q.RawBody())
+		}
+	}
+
+	// both sides must set the same
+	var frame bytes.Buffer
+	proto := NewRawProtoFunc(&frame)
+	if err := proto.Pack(NewPacket(WithSeq("1"), WithUri("/a"))); err != nil {
+		t.Fatal(err)
+	}
+	proto.(*rawProto).SetHeaderCompression(true)
+	if err := proto.Unpack(NewPacket()); err == nil {
+		t.Fatal("the frame without the flag should fail")
+	}
+}
+
+func BenchmarkRawProtoPackHeaderCompression(b *testing.B) {
+	benchmarkRawProtoPackHeader(b, true)
+}
+
+func BenchmarkRawProtoPackHeaderUncompressed(b *testing.B) {
+	benchmarkRawProtoPackHeader(b, false)
+}
+
+// benchmarkRawProtoPackHeader writes the packets with the similar verbose headers,
+// and reports the frame size.
+func benchmarkRawProtoPackHeader(b *testing.B, compress bool) {
+	var w countWriter
+	proto := NewRawProtoFunc(&w)
+	proto.(*rawProto).SetHeaderCompression(compress)
+	p := NewPacket(
+		WithPtype(1),
+		WithSetMeta("X-Trace-Id", "4bf92f3577b34da6a3ce929d0e0e4736"),
+		WithSetMeta("X-User-Agent", "teleport-client/5.0 (linux; amd64)"),
+		WithBody([]byte("ok")),
+	)
+	for _, k := range []string{"X-Tenant", "X-Region", "X-Client-Version", "X-Request-Source", "X-Locale"} {
+		p.Meta().Set(k, strings.Repeat(strings.ToLower(k[2:]), 3))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.SetSeq(strconv.Itoa(i))
+		p.SetUri("/api/v1/organizations/teleport/projects/socket/packets/" + strconv.Itoa(i%16) + "?fields=seq,ptype,uri,meta,body")
+		if err := proto.Pack(p); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(w)/float64(b.N), "frame-bytes/op")
+}
+
+func TestRawProtoNewBodyCheck(t *testing.T) {
+	errUnauthorized := errors.New("unauthorized")
+	errTooLarge := errors.New("too large")
+	check := func(header Header, bodyLength int) (interface{}, error) {
+		if strings.HasPrefix(header.Uri(), "/admin/") {
+			return nil, errUnauthorized
+		}
+		if bodyLength > 16 {
+			return nil, errTooLarge
+		}
+		return new([]byte), nil
+	}
+	var frames bytes.Buffer
+	proto := NewRawProtoFunc(&frames)
+	for _, p := range []*Packet{
+		NewPacket(WithSeq("1"), WithUri("/admin/delete"), WithBody([]byte("all"))),
+		NewPacket(WithSeq("2"), WithUri("/upload"), WithBody(bytes.Repeat([]byte("x"), 17))),
+		NewPacket(WithSeq("3"), WithUri("/upload"), WithBody([]byte("small"))),
+	} {
+		if err := proto.Pack(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []struct {
+		seq  string
+		err  error
+		body string
+	}{
+		{"1", errUnauthorized, ""},
+		{"2", errTooLarge, ""},
+		{"3", nil, "small"},
+	} {
+		p := NewPacket(WithNewBodyCheck(check))
+		// the rejected frames are consumed, so the next one is read
+		if err := proto.Unpack(p); err != want.err {
+			t.Fatalf("seq %s: got error %v, want %v", want.seq, err, want.err)
+		}
+		if p.Seq() != want.seq || string(p.RawBody()) != want.body {
+			t.Fatalf("seq: %q, body: %q", p.Seq(), p.RawBody())
+		}
+	}
+}
+
+func TestRawProtoSetBodyBytes(t *testing.T) {
+	body := map[string]interface{}{"a": 1, "b": []string{"x", "y"}}
+	var marshalled, cached bytes.Buffer
+	p := GetPacket(WithSeq("1"), WithUri("/cache"), WithBodyCodec(codec.ID_JSON), WithBody(body))
+	if err := NewRawProtoFunc(&marshalled).Pack(p); err != nil {
+		t.Fatal(err)
+	}
+	// the bytes cached from the marshalling of the writer
+	var data bytes.Buffer
+	if err := p.MarshalBodyTo(&data); err != nil {
+		t.Fatal(err)
+	}
+	PutPacket(p)
+
+	p = GetPacket(WithSeq("1"), WithUri("/cache"))
+	p.SetBodyBytes(codec.ID_JSON, data.Bytes())
+	if err := NewRawProtoFunc(&cached).Pack(p); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cached.Bytes(), marshalled.Bytes()) {
+		t.Fatalf("frame:\n%q\nwant:\n%q", cached.Bytes(), marshalled.Bytes())
+	}
+	p.Reset()
+	if p.Body() != nil || p.BodyCodec() != codec.NilCodecId {
+		t.Fatalf("the body bytes should be cleared: codec: %d, body: %v", p.BodyCodec(), p.Body())
+	}
+	PutPacket(p)
+}
+
+func BenchmarkRawProtoPackBufferSize(b *testing.B) {
+	body := bytes.Repeat([]byte("x"), 2000)
+	for _, size := range []int{0, 4096} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			SetPackBufferSize(size)
+			defer SetPackBufferSize(0)
+			proto := NewRawProtoFunc(new(countWriter))
+			p := GetPacket(WithSeq("1"), WithUri("/a/b"), WithBody(body))
+			defer PutPacket(p)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// drop the pooled buffers to simulate a cold pool
+				packBufferPool = sync.Pool{}
+				if err := proto.Pack(p); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestRawProtoByteOrder(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+		var rw bytes.Buffer
+		proto := NewRawProtoFuncWithByteOrder(order)(&rw)
+		p := GetPacket(WithSeq("1"), WithBody([]byte("teleport")))
+		if err := proto.Pack(p); err != nil {
+			t.Fatal(err)
+		}
+		if size := order.Uint32(rw.Bytes()); size != p.Size() {
+			t.Fatalf("%v: the length prefix is %d, want %d", order, size, p.Size())
+		}
+		q := GetPacket(WithBody(new([]byte)))
+		if err := proto.Unpack(q); err != nil {
+			t.Fatal(err)
+		}
+		if q.Seq() != "1" || string(*q.Body().(*[]byte)) != "teleport" {
+			t.Fatalf("%v: seq: %q, body: %q", order, q.Seq(), *q.Body().(*[]byte))
+		}
+		PutPacket(p)
+		PutPacket(q)
+	}
+
+	// mismatch
+	var rw bytes.Buffer
+	if err := NewRawProtoFuncWithByteOrder(binary.LittleEndian)(&rw).Pack(NewPacket(WithBody([]byte("x")))); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewRawProtoFunc(&rw).Unpack(NewPacket(WithBody(new([]byte)))); err == nil {
+		t.Fatal("reading with the mismatched byte order should fail")
+	}
+}
+
+func TestRawProtoHMAC(t *testing.T) {
+	key := []byte("secret")
+	pack := func(body string) []byte {
+		var rw bytes.Buffer
+		proto := NewRawProtoFunc(&rw)
+		proto.(ifaceSetHMACKey).SetHMACKey(key)
+		p := GetPacket(WithSeq("1"), WithXferPipe('z'), WithBody([]byte(body)))
+		defer PutPacket(p)
+		if err := proto.Pack(p); err != nil {
+			t.Fatal(err)
+		}
+		return rw.Bytes()
+	}
+	unpack := func(frame []byte, key []byte) (string, error) {
+		proto := NewRawProtoFunc(bytes.NewBuffer(frame))
+		proto.(ifaceSetHMACKey).SetHMACKey(key)
+		var got []byte
+		q := GetPacket(WithNewBody(func(Header) interface{} { return &got }))
+		defer PutPacket(q)
+		err := proto.Unpack(q)
+		return string(got), err
+	}
+	for _, body := range []string{"small", strings.Repeat("large", 200)} {
+		// valid signature
+		got, err := unpack(pack(body), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != body {
+			t.Fatalf("want %q, have %q", body, got)
+		}
+		// tampered body
+		frame := pack(body)
+		frame[len(frame)-signatureLength-1] ^= 0xff
+		if _, err = unpack(frame, key); err != ErrSignatureInvalid {
+			t.Fatalf("tampered body: got error %v, want %v", err, ErrSignatureInvalid)
+		}
+		// wrong key
+		if _, err = unpack(pack(body), []byte("wrong")); err != ErrSignatureInvalid {
+			t.Fatalf("wrong key: got error %v, want %v", err, ErrSignatureInvalid)
+		}
+	}
+}
+
+func TestRawProtoAES(t *testing.T) {
+	key := bytes.Repeat([]byte("k"), 32)
+	pack := func(body string) []byte {
+		var rw bytes.Buffer
+		proto := NewRawProtoFunc(&rw)
+		if err := proto.(ifaceSetAESKey).SetAESKey(key); err != nil {
+			t.Fatal(err)
+		}
+		p := GetPacket(WithSeq("1"), WithXferPipe('z'), WithBody([]byte(body)))
+		defer PutPacket(p)
+		if err := proto.Pack(p); err != nil {
+			t.Fatal(err)
+		}
+		return rw.Bytes()
+	}
+	unpack := func(frame []byte, key []byte) ([]byte, *xfer.XferPipe, error) {
+		proto := NewRawProtoFunc(bytes.NewBuffer(frame))
+		if err := proto.(ifaceSetAESKey).SetAESKey(key); err != nil {
+			t.Fatal(err)
+		}
+		var got []byte
+		q := GetPacket(WithNewBody(func(Header) interface{} { return &got }))
+		err := proto.Unpack(q)
+		return got, q.XferPipe(), err
+	}
+	for _, body := range []string{"small", strings.Repeat("large", 200)} {
+		frame := pack(body)
+		if bytes.Contains(frame, []byte(body)) {
+			t.Fatalf("the body is not encrypted: %q", frame)
+		}
+		// round trip, compressed then encrypted
+		got, pipe, err := unpack(frame, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != body {
+			t.Fatalf("want %q, have %q", body, got)
+		}
+		if compressed := len(body) >= gzip.CompressMinBytes(); pipe.Len() != 1 || compressed == pipe.Skipped(0) {
+			t.Fatalf("size: %d, transfer filters: %v, skipped: %v", len(body), pipe.Names(), pipe.Skipped(0))
+		}
+		// wrong key
+		if _, _, err = unpack(pack(body), bytes.Repeat([]byte("w"), 32)); err != ErrDecryptFailed {
+			t.Fatalf("wrong key: got error %v, want %v", err, ErrDecryptFailed)
+		}
+	}
+	// truncated ciphertext, with the frame size fixed up
+	frame := pack("small")
+	frame = frame[:len(frame)-1]
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)))
+	if _, _, err := unpack(frame, key); err != ErrDecryptFailed {
+		t.Fatalf("truncated ciphertext: got error %v, want %v", err, ErrDecryptFailed)
+	}
+	frame = frame[:4+1+1+8]
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)))
+	if _, _, err := unpack(frame, key); err != ErrDecryptFailed {
+		t.Fatalf("truncated nonce: got error %v, want %v", err, ErrDecryptFailed)
+	}
+	// invalid key
+	if err := NewRawProtoFunc(new(bytes.Buffer)).(ifaceSetAESKey).SetAESKey([]byte("short")); err == nil {
+		t.Fatal("want the invalid key size error")
+	}
+}
+
+func TestRawProtoHasBody(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		codecId   byte
+		body      interface{}
+		bodyCodec byte
+		bodyLen   int
+	}{
+		// the codec of the nil body is not written
+		{name: "no body", codecId: codec.ID_JSON, body: nil, bodyCodec: codec.NilCodecId},
+		{name: "empty body", codecId: codec.ID_PROTOBUF, body: &codec.PbEmpty{}, bodyCodec: codec.ID_PROTOBUF},
+		{name: "populated body", codecId: codec.ID_JSON, body: map[string]int{"a": 1}, bodyCodec: codec.ID_JSON, bodyLen: len("{\"a\":1}")},
+	} {
+		var buf bytes.Buffer
+		p := GetPacket(WithSeq("1"), WithUri("/body"), WithBodyCodec(c.codecId), WithBody(c.body))
+		if err := NewRawProtoFunc(&buf).Pack(p); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		PutPacket(p)
+
+		var body []byte
+		p = GetPacket(WithBody(&body))
+		if err := NewRawProtoFunc(&buf).Unpack(p); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if p.HasBody() != (c.body != nil) {
+			t.Fatalf("%s: got HasBody %v, want %v", c.name, p.HasBody(), c.body != nil)
+		}
+		if p.BodyCodec() != c.bodyCodec || len(body) != c.bodyLen {
+			t.Fatalf("%s: got codec %d, body %q, want codec %d, %d bytes", c.name, p.BodyCodec(), body, c.bodyCodec, c.bodyLen)
+		}
+		PutPacket(p)
+	}
+
+	// the bytes body is sent without the codec
+	p := GetPacket(WithBody([]byte("raw")))
+	if !p.HasBody() {
+		t.Fatal("the bytes body without the codec should be a body")
+	}
+	p.SetBody([]byte{})
+	if p.HasBody() {
+		t.Fatal("the empty bytes body without the codec should not be a body")
+	}
+	// the empty struct is written with the default codec
+	p.SetBody(&struct{}{})
+	if !p.HasBody() {
+		t.Fatal("the empty struct body without the codec should be a body")
+	}
+	PutPacket(p)
+
+	// the body created for reading is not a body received
+	var buf bytes.Buffer
+	p = GetPacket(WithSeq("1"))
+	if err := NewRawProtoFunc(&buf).Pack(p); err != nil {
+		t.Fatal(err)
+	}
+	PutPacket(p)
+	p = GetPacket(WithNewBody(func(Header) interface{} { return new(struct{}) }))
+	defer PutPacket(p)
+	if err := NewRawProtoFunc(&buf).Unpack(p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Body() == nil || p.HasBody() {
+		t.Fatalf("got body %v, HasBody %v, want no body", p.Body(), p.HasBody())
+	}
+}
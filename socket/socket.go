@@ -17,6 +17,7 @@
 package socket
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
@@ -39,6 +40,9 @@ type (
 		// The file descriptor fd is guaranteed to remain valid while
 		// f executes but not after f returns.
 		ControlFD(f func(fd uintptr)) error
+		// Conn returns the underlying net.Conn, or nil after the pooled socket is closed.
+		// Note: reading or writing it directly bypasses the protocol.
+		Conn() net.Conn
 		// LocalAddr returns the local network address.
 		LocalAddr() net.Addr
 		// RemoteAddr returns the remote network address.
@@ -70,11 +74,32 @@ type (
 		// A zero value for t means Write will not time out.
 		SetWriteDeadline(t time.Time) error
 		// WritePacket writes header and body to the connection.
-		// Note: must be safe for concurrent use by multiple goroutines.
+		// Note:
+		//  if a frame is written partially, such as by the write deadline,
+		//  the later writes return ErrSocketBroken until Reset;
+		//  must be safe for concurrent use by multiple goroutines.
 		WritePacket(packet *Packet) error
+		// WritePacketBatch writes the packets to the connection,
+		// coalescing them into one write if the protocol supports it.
+		// It stops at the first packet that fails to be written,
+		// and returns the number of packets written.
+		// Note: must be safe for concurrent use by multiple goroutines.
+		WritePacketBatch(packets []*Packet) (int, error)
+		// WritePacketRetry is like WritePacket, but retries the write
+		// on the temporary network errors according to the policy.
+		// Note: must be safe for concurrent use by multiple goroutines.
+		WritePacketRetry(packet *Packet, policy RetryPolicy) error
 		// ReadPacket reads header and body from the connection.
 		// Note: must be safe for concurrent use by multiple goroutines.
 		ReadPacket(packet *Packet) error
+		// WritePacketContext is like WritePacket,
+		// but the write is aborted with ctx.Err() when ctx is done.
+		// Note: the write deadline is reset after it returns.
+		WritePacketContext(ctx context.Context, packet *Packet) error
+		// ReadPacketContext is like ReadPacket,
+		// but the read is aborted with ctx.Err() when ctx is done.
+		// Note: the read deadline is reset after it returns.
+		ReadPacketContext(ctx context.Context, packet *Packet) error
 		// Read reads data from the connection.
 		// Read can be made to time out and return an Error with Timeout() == true
 		// after a fixed time limit; see SetDeadline and SetReadDeadline.
@@ -86,6 +111,37 @@ type (
 		// Close closes the connection socket.
 		// Any blocked Read or Write operations will be unblocked and return errors.
 		Close() error
+		// SetBufferedWrite enables the buffered writing with the buffer size,
+		// and Flush must be called to write the buffered packets out.
+		// If size<=0, the buffered writing is disabled.
+		// Note:
+		//  the settings of the protocol are kept if it supports, such as the default raw protocol;
+		//  Close flushes the buffer automatically.
+		SetBufferedWrite(size int) error
+		// SetReadIdleTimeout sets the timeout of the reads that get no byte,
+		// so that a stalled peer is cut off, while a slow one that keeps sending is not.
+		// If d<=0, the reads have no idle timeout.
+		// Note:
+		//  the wait for the next packet is bounded as well;
+		//  the settings of the protocol are kept if it supports, such as the default raw protocol;
+		//  it should not be used with ReadPacketContext;
+		//  Reset disables it.
+		SetReadIdleTimeout(d time.Duration)
+		// SetWriteIdleTimeout sets the timeout of the writes that put no byte,
+		// so that a peer accepting the bytes too slowly is cut off, but a large body on a slow link is not.
+		// If d<=0, the writes have no idle timeout.
+		// Note:
+		//  the settings of the protocol are kept if it supports, such as the default raw protocol;
+		//  it should not be used with WritePacketContext;
+		//  Reset disables it.
+		SetWriteIdleTimeout(d time.Duration)
+		// Flush writes the packets buffered by SetBufferedWrite to the connection.
+		Flush() error
+		// CloseGracefully stops accepting new writes, waits for the in-flight writes
+		// to finish, and then closes the connection socket.
+		// If the timeout elapses first, the socket is closed anyway
+		// and ErrCloseGracefullyTimeout is returned.
+		CloseGracefully(timeout time.Duration) error
 		// Swap returns custom data swap of the socket.
 		Swap() goutil.Map
 		// SwapLen returns the amount of custom data of the socket.
@@ -96,29 +152,203 @@ type (
 		SetId(string)
 		// Reset reset net.Conn and ProtoFunc.
 		Reset(netConn net.Conn, protoFunc ...ProtoFunc)
+		// SetMaxBodyLength sets the body length upper limit of reading for the socket.
+		// If n<=0, the package-level MaxBodyLength is used.
+		// Note:
+		//  it only takes effect if the protocol supports it, such as the default raw protocol;
+		//  Reset clears it.
+		SetMaxBodyLength(n int64)
+		// SetMaxDecompressedBytes sets the size upper limit of the data decompressed
+		// by the transfer filters for the socket, such as gzip, zstd and snappy.
+		// If n<=0, the package-level xfer.MaxDecompressedBytes is used.
+		// Note:
+		//  it only takes effect if the protocol supports it, such as the default raw protocol;
+		//  Reset clears it.
+		SetMaxDecompressedBytes(n int64)
+		// SetHMACKey sets the shared key of the HMAC-SHA256 signature over the header and body,
+		// the written frames are signed, and the read ones are verified,
+		// if the signature mismatches, ReadPacket returns ErrSignatureInvalid.
+		// If the key is empty, the signing is disabled.
+		// Note:
+		//  both sides must set the same key;
+		//  it only takes effect if the protocol supports it, such as the default raw protocol;
+		//  Reset clears it.
+		SetHMACKey(key []byte)
+		// SetAESKey sets the shared key of the AES-GCM encryption of the header and body,
+		// the key must be 16, 24 or 32 bytes to select AES-128, AES-192 or AES-256.
+		// If the key is empty, the encryption is disabled.
+		// Note:
+		//  both sides must set the same key;
+		//  it only takes effect if the protocol supports it, such as the default raw protocol;
+		//  Reset clears it.
+		SetAESKey(key []byte) error
+		// SetOnReadError sets the handler of the error that occurs after a frame is read completely,
+		// such as a malformed header or an undecodable body.
+		// If it returns true, the frame is discarded and the next one is read,
+		// otherwise the error is returned by ReadPacket.
+		// Note:
+		//  it only takes effect if the protocol supports it, such as the default raw protocol;
+		//  Reset clears it.
+		SetOnReadError(fn func(*Packet, error) (skip bool))
+		// SetReuseReadBuffer sets whether the frames are read into a scratch buffer owned by the socket,
+		// instead of a pooled one, which saves the buffer getting for each ReadPacket.
+		// Note:
+		//  the scratch grows to the largest frame read, which is bounded by the max body length,
+		//  and is kept until the socket is reset;
+		//  it is ignored if UnsafeStringDecode, since the packet holds the buffer then;
+		//  it only takes effect if the protocol supports it, such as the default raw protocol;
+		//  Reset clears it.
+		SetReuseReadBuffer(reuse bool)
+		// SetHeaderCompression sets whether the packet header is compressed, apart from the body,
+		// a flag byte is put before the header to indicate whether the header is deflated.
+		// Note:
+		//  both sides must set the same, since the flag byte changes the frame layout;
+		//  the short header, or the one that does not get smaller, is left uncompressed;
+		//  it only takes effect if the protocol supports it, such as the default raw protocol;
+		//  Reset clears it.
+		SetHeaderCompression(enable bool)
+		// SetDrainOversizedFrame sets the byte upper limit of discarding the rest of a frame,
+		// which is too large to read by the max body length, so that the connection is kept in sync,
+		// and ReadPacket returns ErrOversizedFrameDrained, after which the next packet can be read.
+		// If limit<=0, which is the default, such a frame is not discarded,
+		// ReadPacket returns ErrBodyTooLarge, and the socket should be closed.
+		// Note:
+		//  the limit bounds the bytes read for nothing on a bogus frame length;
+		//  a frame whose exact body length is checked after it is read completely
+		//  is handled by SetOnReadError instead;
+		//  it only takes effect if the protocol supports it, such as the default raw protocol;
+		//  Reset clears it.
+		SetDrainOversizedFrame(limit int64)
+		// SetNoDelay controls whether the operating system should delay
+		// packet transmission of the connection (Nagle's algorithm),
+		// overriding the package-level SetNoDelay for the socket.
+		// Note:
+		//  it is a no-op if the connection does not support it, such as a non-TCP one;
+		//  Reset applies the package-level setting to the new connection.
+		SetNoDelay(noDelay bool) error
+		// SetKeepAlivePeriod enables the TCP keepalive of the connection with the period,
+		// overriding the package-level SetKeepAlive and SetKeepAlivePeriod for the socket.
+		// If d<=0, the keepalive is disabled.
+		// Note:
+		//  it is a no-op if the connection does not support it, such as a non-TCP one;
+		//  Reset applies the package-level settings to the new connection.
+		SetKeepAlivePeriod(d time.Duration) error
+		// SetMaxConsecutiveReadErrors sets the upper limit of the consecutive ReadPacket errors,
+		// when it is exceeded, the socket is closed and ReadPacket returns ErrTooManyReadErrors.
+		// A successful read resets the count.
+		// Note:
+		//  if n<=0, there is no limit, which is the default;
+		//  Reset clears it.
+		SetMaxConsecutiveReadErrors(n int)
+		// SetReadRateLimiter sets the limiter that ReadPacket waits for before reading each packet,
+		// such as *rate.Limiter of golang.org/x/time/rate,
+		// so that a single connection flooding packets is throttled.
+		// Note:
+		//  the wait is aborted by the context of ReadPacketContext;
+		//  if l is nil, the reads are not limited, which is the default;
+		//  Reset clears it.
+		SetReadRateLimiter(l RateLimiter)
+		// Negotiate exchanges the supported body codec ids and transfer filter ids
+		// with the peer, which must call Negotiate at the same time.
+		// If codecs or xfers is nil, all the registered ones are used.
+		// Note:
+		//  it must be the first exchange, before any other packet is read or written,
+		//  if the peer sends another packet first, *ErrNegotiatePacket is returned with it;
+		//  after that, WritePacket downgrades the packets to the negotiated ids.
+		Negotiate(codecs, xfers []byte) error
+		// NegotiateContext is like Negotiate,
+		// but the exchange is aborted with ctx.Err() when ctx is done.
+		NegotiateContext(ctx context.Context, codecs, xfers []byte) error
+		// NegotiatedCodecs returns the body codec ids supported by both sides,
+		// or nil if not negotiated.
+		NegotiatedCodecs() []byte
+		// NegotiatedXfers returns the transfer filter ids supported by both sides,
+		// or nil if not negotiated.
+		NegotiatedXfers() []byte
+		// NextSeq returns the next packet sequence of the socket,
+		// which is monotonically increasing and never zero.
+		// Note: Reset restarts it.
+		NextSeq() uint64
+		// SetOnWrite sets the callback invoked with the packet and its size
+		// after each successful packet write.
+		// Note: Reset clears it.
+		SetOnWrite(fn func(packet *Packet, n int))
+		// SetOnRead sets the callback invoked with the packet and its size
+		// after each successful packet read.
+		// Note: Reset clears it.
+		SetOnRead(fn func(packet *Packet, n int))
+		// StartHeartbeat sends a heartbeat packet every interval,
+		// and closes the socket if no packet arrives within timeout.
+		// Note:
+		//  the heartbeat packets are not returned by ReadPacket;
+		//  interval<=0 stops it, Close and Reset stop it too.
+		StartHeartbeat(interval, timeout time.Duration)
+		// LastActiveTime returns the time when a packet was read last,
+		// or when the socket was created or reset if no packet has been read.
+		LastActiveTime() time.Time
 	}
 	socket struct {
-		net.Conn
+		// seq is the last packet sequence, accessed atomically
+		seq uint64
+		// lastActive is the unix nanoseconds of the last read, accessed atomically
+		lastActive int64
+		// conn is embedded under an unexported name, so that Conn is left to the accessor
+		conn
 		protocol Proto
 		id       string
 		idMutex  sync.RWMutex
 		swap     goutil.Map
 		mu       sync.RWMutex
 		curState int32
+		// broken is 1 if a frame was written partially
+		broken int32
+		// readErrors is the number of consecutive read errors
+		readErrors    int32
+		maxReadErrors int32
 		fromPool bool
+		// negotiated is nil if not negotiated
+		negotiated *negotiated
+		onWrite    func(*Packet, int)
+		onRead     func(*Packet, int)
+		// readLimiter is nil if the reads are not limited
+		readLimiter RateLimiter
+		// heartbeatStop is closed to stop the heartbeat, nil if not started
+		heartbeatStop chan struct{}
+		// writeMu is read-locked by the in-flight writes
+		writeMu sync.RWMutex
+		// protoFuncs is used to recreate the protocol
+		protoFuncs []ProtoFunc
+		// buffered is nil if the writes are not buffered
+		buffered *bufferedConn
+		// idle is nil if there are no idle timeouts
+		idle *idleConn
 	}
 )
 
 const (
-	normal      int32 = 0
-	activeClose int32 = 1
+	normal        int32 = 0
+	activeClose   int32 = 1
+	gracefulClose int32 = 2
 )
 
 var _ net.Conn = Socket(nil)
 
+type conn = net.Conn
+
 // ErrProactivelyCloseSocket proactively close the socket error.
 var ErrProactivelyCloseSocket = errors.New("socket is closed proactively")
 
+// ErrSocketBroken the socket is unusable since a frame was written partially,
+// and the next frame would corrupt the stream.
+// Note: it is only detected if the protocol reports it, such as the default raw protocol.
+var ErrSocketBroken = errors.New("socket: broken by a partially written frame")
+
+// ErrTooManyReadErrors the socket is closed after too many consecutive read errors.
+var ErrTooManyReadErrors = errors.New("socket: closed after too many consecutive read errors")
+
+// ErrCloseGracefullyTimeout the in-flight writes are not finished before the socket is closed.
+var ErrCloseGracefullyTimeout = errors.New("socket: close gracefully timeout")
+
 // GetSocket gets a Socket from pool, and reset it.
 func GetSocket(c net.Conn, protoFunc ...ProtoFunc) Socket {
 	s := socketPool.Get().(*socket)
@@ -135,25 +365,36 @@ var socketPool = sync.Pool{
 }
 
 // NewSocket wraps a net.Conn as a Socket.
+// Note: any net.Conn is accepted, such as an endpoint of net.Pipe for testing.
 func NewSocket(c net.Conn, protoFunc ...ProtoFunc) Socket {
 	return newSocket(c, protoFunc)
 }
 
 func newSocket(c net.Conn, protoFuncs []ProtoFunc) *socket {
 	var s = &socket{
-		protocol: getProto(protoFuncs, c),
-		Conn:     c,
+		protocol:   getProto(protoFuncs, c),
+		protoFuncs: protoFuncs,
+		conn:       c,
 	}
+	s.touch()
 	s.optimize()
 	return s
 }
 
+// Conn returns the underlying net.Conn, or nil after the pooled socket is closed.
+func (s *socket) Conn() net.Conn {
+	s.mu.RLock()
+	c := s.conn
+	s.mu.RUnlock()
+	return c
+}
+
 // ControlFD invokes f on the underlying connection's file
 // descriptor or handle.
 // The file descriptor fd is guaranteed to remain valid while
 // f executes but not after f returns.
 func (s *socket) ControlFD(f func(fd uintptr)) error {
-	syscallConn, ok := s.Conn.(syscall.Conn)
+	syscallConn, ok := s.conn.(syscall.Conn)
 	if !ok {
 		return syscall.EINVAL
 	}
@@ -169,27 +410,364 @@ func (s *socket) ControlFD(f func(fd uintptr)) error {
 // after a fixed time limit; see SetDeadline and SetWriteDeadline.
 // Note:
 //  For the byte stream type of body, write directly, do not do any processing;
+//  if a frame is written partially, the later writes return ErrSocketBroken until Reset;
 //  Must be safe for concurrent use by multiple goroutines.
 func (s *socket) WritePacket(packet *Packet) error {
+	return s.writePacket(packet, nil)
+}
+
+// writePacket writes the packet as WritePacket,
+// but gives up if valid is not nil and returns false, which is called with s.mu read-locked.
+func (s *socket) writePacket(packet *Packet, valid func() bool) error {
+	if !s.beginWrite() {
+		return ErrProactivelyCloseSocket
+	}
+	defer s.writeMu.RUnlock()
+	if err := s.checkBroken(); err != nil {
+		return err
+	}
 	s.mu.RLock()
+	if valid != nil && !valid() {
+		s.mu.RUnlock()
+		return ErrProactivelyCloseSocket
+	}
 	protocol := s.protocol
+	negotiated := s.negotiated
+	onWrite := s.onWrite
 	s.mu.RUnlock()
-	err := protocol.Pack(packet)
-	if err != nil && s.isActiveClosed() {
-		err = ErrProactivelyCloseSocket
+	if negotiated != nil {
+		if err := negotiated.downgrade(packet); err != nil {
+			return err
+		}
+	}
+	if err := protocol.Pack(packet); err != nil {
+		return s.writeErr(err)
+	}
+	if onWrite != nil {
+		onWrite(packet, int(packet.Size()))
+	}
+	return nil
+}
+
+// checkBroken returns ErrSocketBroken if a frame was written partially.
+func (s *socket) checkBroken() error {
+	if atomic.LoadInt32(&s.broken) == 1 {
+		return ErrSocketBroken
+	}
+	return nil
+}
+
+// writeErr marks the socket broken if the frame was written partially,
+// and returns the error to the caller.
+func (s *socket) writeErr(err error) error {
+	if pe, ok := err.(*partialWriteError); ok {
+		atomic.StoreInt32(&s.broken, 1)
+		err = pe.err
+	}
+	if s.isActiveClosed() {
+		return ErrProactivelyCloseSocket
 	}
 	return err
 }
 
+// WritePacketBatch writes the packets to the connection,
+// coalescing them into one write if the protocol supports it,
+// such as the default raw protocol.
+// It stops at the first packet that fails to be written,
+// and returns the number of packets written.
+// Note:
+//  if the protocol does not support it, the packets are written one by one;
+//  Must be safe for concurrent use by multiple goroutines.
+func (s *socket) WritePacketBatch(packets []*Packet) (int, error) {
+	if !s.beginWrite() {
+		return 0, ErrProactivelyCloseSocket
+	}
+	defer s.writeMu.RUnlock()
+	if err := s.checkBroken(); err != nil {
+		return 0, err
+	}
+	s.mu.RLock()
+	protocol := s.protocol
+	negotiated := s.negotiated
+	onWrite := s.onWrite
+	s.mu.RUnlock()
+	var downgradeErr error
+	if negotiated != nil {
+		for i, packet := range packets {
+			if downgradeErr = negotiated.downgrade(packet); downgradeErr != nil {
+				packets = packets[:i]
+				break
+			}
+		}
+	}
+	var (
+		n   int
+		err error
+	)
+	if p, ok := protocol.(ifacePackBatch); ok {
+		n, err = p.PackBatch(packets)
+	} else {
+		for _, packet := range packets {
+			if err = protocol.Pack(packet); err != nil {
+				break
+			}
+			n++
+		}
+	}
+	if onWrite != nil {
+		for _, packet := range packets[:n] {
+			onWrite(packet, int(packet.Size()))
+		}
+	}
+	if err != nil {
+		return n, s.writeErr(err)
+	}
+	return n, downgradeErr
+}
+
+// RetryPolicy is the policy of WritePacketRetry.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of write attempts, including the first one.
+	// If MaxAttempts<=1, the write is not retried.
+	MaxAttempts int
+	// Backoff is the wait time before the first retry,
+	// and it doubles for each next retry.
+	Backoff time.Duration
+	// MaxBackoff is the upper limit of the wait time, no limit if <=0.
+	MaxBackoff time.Duration
+}
+
+// WritePacketRetry is like WritePacket, but retries the write
+// on the temporary network errors according to the policy,
+// and aborts on the permanent ones or when the socket is closed.
+// Note:
+//  the packet is packed only once and the rest of the frame is resent,
+//  if the protocol supports it, such as the default raw protocol,
+//  otherwise the packet is repacked for each attempt,
+//  and so is it if the writes are buffered;
+//  the other writes wait until the frame is written or the retry is aborted,
+//  so that they do not interleave with the rest of the frame;
+//  Must be safe for concurrent use by multiple goroutines.
+func (s *socket) WritePacketRetry(packet *Packet, policy RetryPolicy) error {
+	s.mu.RLock()
+	p, ok := s.protocol.(ifacePackBytes)
+	// the buffered packets must not be overtaken
+	buffered := s.buffered != nil
+	s.mu.RUnlock()
+	if !ok || buffered {
+		return s.retry(policy, func() error {
+			return s.WritePacket(packet)
+		})
+	}
+
+	if !s.beginExclusiveWrite() {
+		return ErrProactivelyCloseSocket
+	}
+	defer s.writeMu.Unlock()
+	if err := s.checkBroken(); err != nil {
+		return err
+	}
+	s.mu.RLock()
+	conn := s.protoConn()
+	negotiated := s.negotiated
+	onWrite := s.onWrite
+	s.mu.RUnlock()
+	if negotiated != nil {
+		if err := negotiated.downgrade(packet); err != nil {
+			return err
+		}
+	}
+	b, err := p.PackBytes(packet)
+	if err != nil {
+		return err
+	}
+	var written bool
+	err = s.retry(policy, func() error {
+		n, err := conn.Write(b)
+		b = b[n:]
+		written = written || n > 0
+		return err
+	})
+	if err != nil {
+		if written {
+			err = &partialWriteError{err: err}
+		}
+		return s.writeErr(err)
+	}
+	if onWrite != nil {
+		onWrite(packet, int(packet.Size()))
+	}
+	return nil
+}
+
+func (s *socket) retry(policy RetryPolicy, fn func() error) error {
+	backoff := policy.Backoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		netErr, ok := err.(net.Error)
+		if !ok || !netErr.Temporary() || attempt >= policy.MaxAttempts || s.isActiveClosed() {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
+
 // ReadPacket reads header and body from the connection.
 // Note:
 //  For the byte stream type of body, read directly, do not do any processing;
 //  Must be safe for concurrent use by multiple goroutines.
 func (s *socket) ReadPacket(packet *Packet) error {
+	return s.readPacket(context.Background(), packet)
+}
+
+func (s *socket) readPacket(ctx context.Context, packet *Packet) error {
 	s.mu.RLock()
 	protocol := s.protocol
+	onRead := s.onRead
+	readLimiter := s.readLimiter
 	s.mu.RUnlock()
-	return protocol.Unpack(packet)
+	if readLimiter != nil {
+		if err := readLimiter.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	body := packet.body
+	for {
+		err := protocol.Unpack(packet)
+		if err != nil {
+			return s.readErr(err)
+		}
+		atomic.StoreInt32(&s.readErrors, 0)
+		s.touch()
+		if l := getLogger(); l != nil {
+			l.Debugf("socket: read packet: ptype=%d, seq=%q, uri=%q, size=%d, remote=%s", packet.ptype, packet.seq, packet.Uri(), packet.Size(), s.RemoteAddr())
+		}
+		if onRead != nil {
+			onRead(packet, int(packet.Size()))
+		}
+		if packet.ptype != PtypeHeartbeat {
+			return nil
+		}
+		// discard the heartbeat, the header is overwritten by the next packet,
+		// while the transfer filters read are appended to the pipe
+		packet.body = body
+		packet.XferPipe().Reset()
+	}
+}
+
+// readErr closes the socket if there are too many consecutive read errors.
+func (s *socket) readErr(err error) error {
+	max := atomic.LoadInt32(&s.maxReadErrors)
+	if max > 0 && atomic.AddInt32(&s.readErrors, 1) > max {
+		s.Close()
+		return ErrTooManyReadErrors
+	}
+	return err
+}
+
+// SetMaxConsecutiveReadErrors sets the upper limit of the consecutive ReadPacket errors,
+// when it is exceeded, the socket is closed and ReadPacket returns ErrTooManyReadErrors,
+// so that a peer stuck sending garbage is cut off.
+// A successful read resets the count.
+// Note:
+//  if n<=0, there is no limit, which is the default;
+//  Reset clears it.
+func (s *socket) SetMaxConsecutiveReadErrors(n int) {
+	if n < 0 {
+		n = 0
+	}
+	atomic.StoreInt32(&s.maxReadErrors, int32(n))
+}
+
+// RateLimiter limits the rate of the events, such as *rate.Limiter of golang.org/x/time/rate.
+type RateLimiter interface {
+	// Wait blocks until the next event is allowed,
+	// it returns an error if ctx is done first.
+	Wait(ctx context.Context) error
+}
+
+// SetReadRateLimiter sets the limiter that ReadPacket waits for before reading each packet,
+// such as *rate.Limiter of golang.org/x/time/rate,
+// so that a single connection flooding packets is throttled.
+// Note:
+//  the wait is aborted by the context of ReadPacketContext;
+//  if l is nil, the reads are not limited, which is the default;
+//  Reset clears it.
+func (s *socket) SetReadRateLimiter(l RateLimiter) {
+	s.mu.Lock()
+	s.readLimiter = l
+	s.mu.Unlock()
+}
+
+// WritePacketContext is like WritePacket,
+// but the write is aborted with ctx.Err() when ctx is done.
+// Note:
+//  the write deadline is reset after it returns;
+//  an aborted write may leave a partial packet on the connection,
+//  so the socket should be closed then.
+func (s *socket) WritePacketContext(ctx context.Context, packet *Packet) error {
+	return s.withContext(ctx, s.SetWriteDeadline, func() error {
+		return s.WritePacket(packet)
+	})
+}
+
+// ReadPacketContext is like ReadPacket,
+// but the read is aborted with ctx.Err() when ctx is done.
+// Note:
+//  the read deadline is reset after it returns;
+//  an aborted read may leave a partial packet on the connection,
+//  so the socket should be closed then.
+func (s *socket) ReadPacketContext(ctx context.Context, packet *Packet) error {
+	return s.withContext(ctx, s.SetReadDeadline, func() error {
+		return s.readPacket(ctx, packet)
+	})
+}
+
+// aLongTimeAgo is a non-zero time, far in the past, used for immediate cancelation.
+var aLongTimeAgo = time.Unix(1, 0)
+
+func (s *socket) withContext(ctx context.Context, setDeadline func(time.Time) error, fn func() error) error {
+	if ctx.Done() == nil {
+		return fn()
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	deadline, hasDeadline := ctx.Deadline()
+	setDeadline(deadline)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			setDeadline(aLongTimeAgo)
+		case <-stop:
+		}
+	}()
+	err := fn()
+	close(stop)
+	<-stopped
+	setDeadline(time.Time{})
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		// the connection deadline may fire a little earlier than the context timer
+		if hasDeadline && !time.Now().Before(deadline) {
+			return context.DeadlineExceeded
+		}
+	}
+	return err
 }
 
 // Swap returns custom data swap of the socket.
@@ -226,54 +804,363 @@ func (s *socket) SetId(id string) {
 	s.idMutex.Unlock()
 }
 
+// NextSeq returns the next packet sequence of the socket,
+// which is monotonically increasing and never zero.
+// Note: Reset restarts it.
+func (s *socket) NextSeq() uint64 {
+	for {
+		if seq := atomic.AddUint64(&s.seq, 1); seq != 0 {
+			return seq
+		}
+	}
+}
+
+// SetOnWrite sets the callback invoked with the packet and its size
+// after each successful packet write, such as for metrics.
+// Note:
+//  it is not called for the failed writes;
+//  Reset clears it.
+func (s *socket) SetOnWrite(fn func(packet *Packet, n int)) {
+	s.mu.Lock()
+	s.onWrite = fn
+	s.mu.Unlock()
+}
+
+// SetOnRead sets the callback invoked with the packet and its size
+// after each successful packet read, such as for metrics.
+// Note:
+//  it is not called for the failed reads;
+//  Reset clears it.
+func (s *socket) SetOnRead(fn func(packet *Packet, n int)) {
+	s.mu.Lock()
+	s.onRead = fn
+	s.mu.Unlock()
+}
+
 // Reset reset net.Conn and ProtoFunc.
 func (s *socket) Reset(netConn net.Conn, protoFunc ...ProtoFunc) {
 	atomic.StoreInt32(&s.curState, activeClose)
-	if s.Conn != nil {
-		s.Conn.Close()
-	}
 	s.mu.Lock()
-	s.Conn = netConn
+	buffered, oldConn := s.buffered, s.conn
+	s.buffered = nil
+	s.idle = nil
+	s.mu.Unlock()
+	closeConn(oldConn, buffered, closeFlushTimeout)
+	s.mu.Lock()
+	s.conn = netConn
 	s.SetId("")
 	s.protocol = getProto(protoFunc, netConn)
+	s.protoFuncs = protoFunc
+	s.negotiated = nil
+	s.onWrite = nil
+	s.onRead = nil
+	s.readLimiter = nil
+	s.stopHeartbeat()
+	atomic.StoreUint64(&s.seq, 0)
+	atomic.StoreInt32(&s.broken, 0)
+	atomic.StoreInt32(&s.readErrors, 0)
+	atomic.StoreInt32(&s.maxReadErrors, 0)
+	s.touch()
 	atomic.StoreInt32(&s.curState, normal)
 	s.optimize()
 	s.mu.Unlock()
 }
 
+// maxBodyLength returns the body length upper limit of reading for the socket.
+func (s *socket) maxBodyLength() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if p, ok := s.protocol.(ifaceMaxBodyLength); ok {
+		return p.MaxBodyLength()
+	}
+	return MaxBodyLength()
+}
+
+// SetMaxBodyLength sets the body length upper limit of reading for the socket.
+// If n<=0, the package-level MaxBodyLength is used.
+// Note:
+//  it only takes effect if the protocol supports it, such as the default raw protocol;
+//  Reset clears it.
+func (s *socket) SetMaxBodyLength(n int64) {
+	s.mu.RLock()
+	if p, ok := s.protocol.(ifaceSetMaxBodyLength); ok {
+		p.SetMaxBodyLength(n)
+	}
+	s.mu.RUnlock()
+}
+
+// SetMaxDecompressedBytes sets the size upper limit of the data decompressed
+// by the transfer filters for the socket, such as gzip, zstd and snappy.
+// If n<=0, the package-level xfer.MaxDecompressedBytes is used.
+// Note:
+//  it only takes effect if the protocol supports it, such as the default raw protocol;
+//  Reset clears it.
+func (s *socket) SetMaxDecompressedBytes(n int64) {
+	s.mu.RLock()
+	if p, ok := s.protocol.(ifaceSetMaxDecompressedBytes); ok {
+		p.SetMaxDecompressedBytes(n)
+	}
+	s.mu.RUnlock()
+}
+
+// SetHMACKey sets the shared key of the HMAC-SHA256 signature over the header and body,
+// the written frames are signed, and the read ones are verified,
+// if the signature mismatches, ReadPacket returns ErrSignatureInvalid.
+// If the key is empty, the signing is disabled.
+// Note:
+//  it is opt-in per connection, both sides must set the same key,
+//  so the peers that do not sign are not broken unless they talk to a signing socket;
+//  it only takes effect if the protocol supports it, such as the default raw protocol;
+//  Reset clears it.
+func (s *socket) SetHMACKey(key []byte) {
+	s.mu.RLock()
+	if p, ok := s.protocol.(ifaceSetHMACKey); ok {
+		p.SetHMACKey(key)
+	}
+	s.mu.RUnlock()
+}
+
+// SetAESKey sets the shared key of the AES-GCM encryption of the header and body,
+// the key must be 16, 24 or 32 bytes to select AES-128, AES-192 or AES-256.
+// The frames are encrypted after the transfer filters, such as gzip, with a random nonce
+// prepended to the ciphertext, and decrypted before the transfer filters when reading;
+// if the decryption fails, ReadPacket returns ErrDecryptFailed.
+// If the key is empty, the encryption is disabled.
+// Note:
+//  it is opt-in per connection, both sides must set the same key;
+//  if SetHMACKey is also set, the ciphertext is signed;
+//  it only takes effect if the protocol supports it, such as the default raw protocol;
+//  Reset clears it.
+func (s *socket) SetAESKey(key []byte) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if p, ok := s.protocol.(ifaceSetAESKey); ok {
+		return p.SetAESKey(key)
+	}
+	return nil
+}
+
+// SetOnReadError sets the handler of the error that occurs after a frame is read completely,
+// such as a malformed header or an undecodable body.
+// If it returns true, the frame is discarded and the next one is read,
+// otherwise the error is returned by ReadPacket.
+// Note:
+//  it only takes effect if the protocol supports it, such as the default raw protocol;
+//  Reset clears it.
+func (s *socket) SetOnReadError(fn func(*Packet, error) (skip bool)) {
+	s.mu.RLock()
+	if p, ok := s.protocol.(ifaceSetOnReadError); ok {
+		p.SetOnReadError(fn)
+	}
+	s.mu.RUnlock()
+}
+
+// SetReuseReadBuffer sets whether the frames are read into a scratch buffer owned by the socket,
+// instead of a pooled one, which saves the buffer getting for each ReadPacket.
+// Note:
+//  the scratch grows to the largest frame read, which is bounded by the max body length,
+//  and is kept until the socket is reset, so it suits the long-lived busy connections;
+//  it is ignored if UnsafeStringDecode, since the packet holds the buffer then;
+//  it only takes effect if the protocol supports it, such as the default raw protocol;
+//  Reset clears it.
+func (s *socket) SetReuseReadBuffer(reuse bool) {
+	s.mu.RLock()
+	if p, ok := s.protocol.(ifaceSetReuseReadBuffer); ok {
+		p.SetReuseReadBuffer(reuse)
+	}
+	s.mu.RUnlock()
+}
+
+// SetHeaderCompression sets whether the packet header is compressed, apart from the body,
+// a flag byte is put before the header to indicate whether the header is deflated.
+// It suits the small packets with the verbose headers, such as long URIs and big metadata,
+// whose bodies are not compressed by the transfer filters like gzip.
+// Note:
+//  it is opt-in per connection, both sides must set the same,
+//  since the flag byte changes the frame layout;
+//  the short header, or the one that does not get smaller, is left uncompressed;
+//  it only takes effect if the protocol supports it, such as the default raw protocol;
+//  Reset clears it.
+func (s *socket) SetHeaderCompression(enable bool) {
+	s.mu.RLock()
+	if p, ok := s.protocol.(ifaceSetHeaderCompression); ok {
+		p.SetHeaderCompression(enable)
+	}
+	s.mu.RUnlock()
+}
+
+// SetDrainOversizedFrame sets the byte upper limit of discarding the rest of a frame,
+// which is too large to read by the max body length, so that the connection is kept in sync,
+// and ReadPacket returns ErrOversizedFrameDrained, after which the next packet can be read.
+// If limit<=0, which is the default, such a frame is not discarded,
+// ReadPacket returns ErrBodyTooLarge, and the socket should be closed.
+// Note:
+//  the limit bounds the bytes read for nothing on a bogus frame length;
+//  a frame whose exact body length is checked after it is read completely
+//  is handled by SetOnReadError instead;
+//  it only takes effect if the protocol supports it, such as the default raw protocol;
+//  Reset clears it.
+func (s *socket) SetDrainOversizedFrame(limit int64) {
+	s.mu.RLock()
+	if p, ok := s.protocol.(ifaceSetDrainOversizedFrame); ok {
+		p.SetDrainOversizedFrame(limit)
+	}
+	s.mu.RUnlock()
+}
+
+// SetNoDelay controls whether the operating system should delay
+// packet transmission of the connection (Nagle's algorithm),
+// overriding the package-level SetNoDelay for the socket.
+// Note:
+//  it is a no-op if the connection does not support it, such as a non-TCP one;
+//  Reset applies the package-level setting to the new connection.
+func (s *socket) SetNoDelay(noDelay bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if c, ok := s.conn.(ifaceSetNoDelay); ok {
+		return c.SetNoDelay(noDelay)
+	}
+	return nil
+}
+
+// SetKeepAlivePeriod enables the TCP keepalive of the connection with the period,
+// overriding the package-level SetKeepAlive and SetKeepAlivePeriod for the socket.
+// If d<=0, the keepalive is disabled.
+// Note:
+//  it is a no-op if the connection does not support it, such as a non-TCP one;
+//  Reset applies the package-level settings to the new connection.
+func (s *socket) SetKeepAlivePeriod(d time.Duration) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, ok := s.conn.(ifaceSetKeepAlive)
+	if !ok {
+		return nil
+	}
+	if d <= 0 {
+		return c.SetKeepAlive(false)
+	}
+	if err := c.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return c.SetKeepAlivePeriod(d)
+}
+
 // Close closes the connection socket.
 // Any blocked Read or Write operations will be unblocked and return errors.
 // If it is from 'GetSocket()' function(a pool), return itself to pool.
 func (s *socket) Close() error {
+	return s.close(closeFlushTimeout)
+}
+
+// close closes the connection socket, flushing the buffered packets within the timeout.
+func (s *socket) close(flushTimeout time.Duration) error {
+	return s.closeIf(flushTimeout, nil)
+}
+
+// closeIf closes the connection socket as close,
+// but gives up if valid is not nil and returns false, which is called with s.mu locked.
+func (s *socket) closeIf(flushTimeout time.Duration, valid func() bool) error {
 	if s.isActiveClosed() {
 		return nil
 	}
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	if s.isActiveClosed() {
+	if s.isActiveClosed() || (valid != nil && !valid()) {
+		s.mu.Unlock()
 		return nil
 	}
 	atomic.StoreInt32(&s.curState, activeClose)
+	s.stopHeartbeat()
+	buffered, conn := s.buffered, s.conn
+	s.buffered = nil
+	s.mu.Unlock()
 
-	var err error
-	if s.Conn != nil {
-		err = s.Conn.Close()
-	}
+	// the flush may wait for a stalled write, so it is out of the lock
+	err := closeConn(conn, buffered, flushTimeout)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if s.fromPool {
-		s.Conn = nil
+		s.protoFuncs = nil
+		s.conn = nil
 		s.swap = nil
 		s.protocol = nil
+		s.negotiated = nil
+		s.onWrite = nil
+		s.onRead = nil
+		s.readLimiter = nil
+		s.idle = nil
 		socketPool.Put(s)
 	}
 	return err
 }
 
+// CloseGracefully stops accepting new writes, waits for the in-flight writes
+// to finish, and then closes the connection socket.
+// If the timeout elapses first, the socket is closed anyway
+// and ErrCloseGracefullyTimeout is returned.
+// Note:
+//  the new writes return ErrProactivelyCloseSocket;
+//  if timeout<=0, it waits until the in-flight writes finish.
+func (s *socket) CloseGracefully(timeout time.Duration) error {
+	if !atomic.CompareAndSwapInt32(&s.curState, normal, gracefulClose) {
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		// wait for the in-flight writes
+		s.writeMu.Lock()
+		close(done)
+		s.writeMu.Unlock()
+	}()
+	var timeoutCh <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+	select {
+	case <-done:
+		return s.Close()
+	case <-timeoutCh:
+		// the writes are stalled, so is the flush
+		s.close(0)
+		return ErrCloseGracefullyTimeout
+	}
+}
+
+// beginExclusiveWrite locks the writeMu if the socket is not closing gracefully,
+// so that no other write is in flight until it is unlocked.
+func (s *socket) beginExclusiveWrite() bool {
+	if atomic.LoadInt32(&s.curState) == gracefulClose {
+		return false
+	}
+	s.writeMu.Lock()
+	if atomic.LoadInt32(&s.curState) == gracefulClose {
+		s.writeMu.Unlock()
+		return false
+	}
+	return true
+}
+
+// beginWrite read-locks the writeMu if the socket is not closing gracefully.
+func (s *socket) beginWrite() bool {
+	if atomic.LoadInt32(&s.curState) == gracefulClose {
+		return false
+	}
+	s.writeMu.RLock()
+	if atomic.LoadInt32(&s.curState) == gracefulClose {
+		s.writeMu.RUnlock()
+		return false
+	}
+	return true
+}
+
 func (s *socket) isActiveClosed() bool {
 	return atomic.LoadInt32(&s.curState) == activeClose
 }
 
 func (s *socket) optimize() {
-	if c, ok := s.Conn.(ifaceSetKeepAlive); ok {
+	if c, ok := s.conn.(ifaceSetKeepAlive); ok {
 		if changeKeepAlive {
 			c.SetKeepAlive(keepAlive)
 		}
@@ -281,7 +1168,7 @@ func (s *socket) optimize() {
 			c.SetKeepAlivePeriod(keepAlivePeriod)
 		}
 	}
-	if c, ok := s.Conn.(ifaceSetBuffer); ok {
+	if c, ok := s.conn.(ifaceSetBuffer); ok {
 		if readBuffer >= 0 {
 			c.SetReadBuffer(readBuffer)
 		}
@@ -289,7 +1176,7 @@ func (s *socket) optimize() {
 			c.SetWriteBuffer(writeBuffer)
 		}
 	}
-	if c, ok := s.Conn.(ifaceSetNoDelay); ok {
+	if c, ok := s.conn.(ifaceSetNoDelay); ok {
 		if !noDelay {
 			c.SetNoDelay(noDelay)
 		}
@@ -312,6 +1199,58 @@ type (
 		// transmit buffer associated with the connection.
 		SetWriteBuffer(bytes int) error
 	}
+	ifacePackBytes interface {
+		// PackBytes packs the packet into a new frame without writing it.
+		PackBytes(*Packet) ([]byte, error)
+	}
+	ifacePackBatch interface {
+		// PackBatch writes the packets into the connection with only one write,
+		// and returns the number of packets written.
+		PackBatch([]*Packet) (int, error)
+	}
+	ifaceSetMaxBodyLength interface {
+		// SetMaxBodyLength sets the body length upper limit of reading.
+		// If n<=0, the package-level MaxBodyLength is used.
+		SetMaxBodyLength(n int64)
+	}
+	ifaceMaxBodyLength interface {
+		// MaxBodyLength returns the body length upper limit of reading.
+		MaxBodyLength() int64
+	}
+	ifaceSetMaxDecompressedBytes interface {
+		// SetMaxDecompressedBytes sets the size upper limit of the data decompressed by the transfer filters.
+		// If n<=0, the package-level xfer.MaxDecompressedBytes is used.
+		SetMaxDecompressedBytes(n int64)
+	}
+	ifaceSetHMACKey interface {
+		// SetHMACKey sets the shared key of the HMAC-SHA256 frame signature.
+		SetHMACKey(key []byte)
+	}
+	ifaceSetAESKey interface {
+		// SetAESKey sets the shared key of the AES-GCM frame encryption.
+		SetAESKey(key []byte) error
+	}
+	ifaceSetOnReadError interface {
+		// SetOnReadError sets the handler of the error that occurs after a frame is read completely.
+		SetOnReadError(fn func(*Packet, error) (skip bool))
+	}
+	ifaceResetConn interface {
+		// ResetConn switches the reads and writes onto the wrappers of the connection,
+		// keeping the settings and the buffered read bytes.
+		ResetConn(r io.Reader, w io.Writer)
+	}
+	ifaceSetReuseReadBuffer interface {
+		// SetReuseReadBuffer sets whether the frames are read into a scratch buffer.
+		SetReuseReadBuffer(reuse bool)
+	}
+	ifaceSetHeaderCompression interface {
+		// SetHeaderCompression sets whether the header is prefixed by a compression flag byte.
+		SetHeaderCompression(enable bool)
+	}
+	ifaceSetDrainOversizedFrame interface {
+		// SetDrainOversizedFrame sets the byte upper limit of discarding the rest of an oversized frame.
+		SetDrainOversizedFrame(limit int64)
+	}
 	ifaceSetNoDelay interface {
 		// SetNoDelay controls whether the operating system should delay
 		// packet transmission in hopes of sending fewer packets (Nagle's
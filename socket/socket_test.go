@@ -0,0 +1,1491 @@
+package socket
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/henrylee2cn/teleport/codec"
+)
+
+func TestReadPacketContext(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	s1, s2 := NewSocket(c1), NewSocket(c2)
+
+	p := GetPacket(WithBody(new([]byte)))
+	defer PutPacket(p)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := s1.ReadPacketContext(ctx, p); err != context.DeadlineExceeded {
+		t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if cost := time.Since(start); cost > time.Second {
+		t.Fatalf("the read should time out after 50ms, cost %v", cost)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if err := s1.ReadPacketContext(ctx, p); err != context.Canceled {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+
+	// the deadline is reset
+	go s2.WritePacket(GetPacket(WithSeq("1"), WithBody([]byte("ok"))))
+	if err := s1.ReadPacketContext(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Seq() != "1" || string(*p.Body().(*[]byte)) != "ok" {
+		t.Fatalf("seq: %q, body: %q", p.Seq(), *p.Body().(*[]byte))
+	}
+}
+
+func TestWritePacketContext(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	s := NewSocket(c1)
+
+	// nobody reads the other end
+	p := GetPacket(WithBody([]byte("body")))
+	defer PutPacket(p)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.WritePacketContext(ctx, p); err != context.DeadlineExceeded {
+		t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	s1, s2 := NewSocket(c1), NewSocket(c2)
+	if s1.NegotiatedCodecs() != nil {
+		t.Fatal("the socket is not negotiated yet")
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s2.Negotiate([]byte{codec.ID_JSON}, []byte{})
+	}()
+	if err := s1.Negotiate([]byte{codec.ID_MSGPACK, codec.ID_JSON}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []Socket{s1, s2} {
+		if codecs := s.NegotiatedCodecs(); !bytes.Equal(codecs, []byte{codec.ID_JSON}) {
+			t.Fatalf("negotiated codecs: %v", codecs)
+		}
+		if xfers := s.NegotiatedXfers(); len(xfers) != 0 {
+			t.Fatalf("negotiated xfers: %v", xfers)
+		}
+	}
+
+	// msgpack and gzip are not supported by the peer
+	p := GetPacket(WithBodyCodec(codec.ID_MSGPACK), WithXferPipe('z'), WithBody(map[string]int{"a": 1}))
+	defer PutPacket(p)
+	go func() {
+		errCh <- s1.WritePacket(p)
+	}()
+	q := GetPacket(WithBody(new(map[string]int)))
+	defer PutPacket(q)
+	if err := s2.ReadPacket(q); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if q.BodyCodec() != codec.ID_JSON || q.XferPipe().Len() != 0 || (*q.Body().(*map[string]int))["a"] != 1 {
+		t.Fatalf("packet: %s", q.String())
+	}
+}
+
+func TestNegotiateNotFirst(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	s1, s2 := NewSocket(c1), NewSocket(c2)
+
+	// the peer sends a packet instead of the negotiation
+	go func() {
+		s2.WritePacket(NewPacket(WithSeq("1"), WithBody([]byte("data"))))
+		s2.ReadPacket(NewPacket())
+	}()
+	err := s1.Negotiate(nil, nil)
+	e, ok := err.(*ErrNegotiatePacket)
+	if !ok || !errors.Is(err, ErrNegotiate) {
+		t.Fatalf("got error %v, want *ErrNegotiatePacket", err)
+	}
+	if e.Packet.Seq() != "1" || string(e.Packet.RawBody()) != "data" {
+		t.Fatalf("the consumed packet is not returned: %s", e.Packet.String())
+	}
+
+	// the peer does not negotiate at all
+	c3, c4 := net.Pipe()
+	defer c3.Close()
+	defer c4.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err = NewSocket(c3).NegotiateContext(ctx, nil, nil); err != context.DeadlineExceeded {
+		t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+type countWriteConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *countWriteConn) Write(b []byte) (int, error) {
+	c.writes++
+	return c.Conn.Write(b)
+}
+
+func TestWritePacketBatch(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	cc := &countWriteConn{Conn: c1}
+	s1, s2 := NewSocket(cc), NewSocket(c2)
+
+	done := make(chan error, 1)
+	go func() {
+		for _, seq := range []string{"1", "2", "3", "4"} {
+			p := GetPacket(WithBody(new([]byte)))
+			if err := s2.ReadPacket(p); err != nil {
+				done <- err
+				return
+			}
+			if p.Seq() != seq || string(*p.Body().(*[]byte)) != "body"+seq {
+				done <- fmt.Errorf("got seq %q, body %q", p.Seq(), *p.Body().(*[]byte))
+				return
+			}
+			PutPacket(p)
+		}
+		done <- nil
+	}()
+
+	ps := make([]*Packet, 3)
+	for i := range ps {
+		seq := strconv.Itoa(i + 1)
+		ps[i] = NewPacket(WithSeq(seq), WithBody([]byte("body"+seq)))
+	}
+	n, err := s1.WritePacketBatch(ps)
+	if n != 3 || err != nil {
+		t.Fatalf("n: %d, err: %v", n, err)
+	}
+	if cc.writes != 1 {
+		t.Fatalf("the batch should be written once, got %d writes", cc.writes)
+	}
+
+	// stop at the first packet that fails to be packed
+	ps = []*Packet{
+		NewPacket(WithSeq("4"), WithBody([]byte("body4"))),
+		NewPacket(WithSeq("5"), WithBodyCodec(codec.ID_JSON), WithBody(make(chan int))),
+		NewPacket(WithSeq("6"), WithBody([]byte("body6"))),
+	}
+	n, err = s1.WritePacketBatch(ps)
+	if n != 1 || err == nil {
+		t.Fatalf("n: %d, err: %v", n, err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func benchmarkLoopback(b *testing.B) Socket {
+	return NewSocket(loopbackConn(b, nil))
+}
+
+// loopbackConn returns a TCP connection whose peer calls serve, or discards the data if serve is nil.
+func loopbackConn(tb testing.TB, serve func(net.Conn)) net.Conn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go func() {
+		c, err := l.Accept()
+		l.Close()
+		if err != nil {
+			return
+		}
+		if serve != nil {
+			serve(c)
+		} else {
+			io.Copy(ioutil.Discard, c)
+		}
+		c.Close()
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return c
+}
+
+const benchmarkBatchSize = 32
+
+func BenchmarkWritePacketOneByOne(b *testing.B) {
+	s := benchmarkLoopback(b)
+	defer s.Close()
+	p := NewPacket(WithSeq("1"), WithUri("/a/b"), WithBody([]byte("notification")))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < benchmarkBatchSize; j++ {
+			if err := s.WritePacket(p); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkWritePacketBatch(b *testing.B) {
+	s := benchmarkLoopback(b)
+	defer s.Close()
+	ps := make([]*Packet, benchmarkBatchSize)
+	for i := range ps {
+		ps[i] = NewPacket(WithSeq("1"), WithUri("/a/b"), WithBody([]byte("notification")))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.WritePacketBatch(ps); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestStreamBody(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	s1, s2 := NewSocket(c1), NewSocket(c2)
+
+	file := make([]byte, 5<<20+123)
+	rand.New(rand.NewSource(1)).Read(file)
+
+	errCh := make(chan error, 1)
+	go func() {
+		p := NewPacket(WithSeq("7"), WithUri("/upload"), WithSetMeta("name", "file.bin"))
+		w, err := p.BodyWriter(s1)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		if _, err = io.Copy(w, bytes.NewReader(file)); err != nil {
+			errCh <- err
+			return
+		}
+		errCh <- w.Close()
+	}()
+
+	p := NewPacket()
+	r, err := p.BodyReader(s2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Seq() != "7" || p.Uri() != "/upload" || string(p.Meta().Peek("name")) != "file.bin" {
+		t.Fatalf("header: %s", p.String())
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, file) {
+		t.Fatalf("got %d bytes, want %d bytes", len(got), len(file))
+	}
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = NewPacket(WithXferPipe('z')).BodyWriter(s1); err != ErrStreamXferPipe {
+		t.Fatalf("got error %v, want %v", err, ErrStreamXferPipe)
+	}
+}
+
+func TestNextSeq(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	s := NewSocket(c1)
+
+	const n = 1000
+	seqs := make(chan uint64, 2*n)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				seqs <- s.NextSeq()
+			}
+		}()
+	}
+	wg.Wait()
+	close(seqs)
+	seen := make(map[uint64]bool, 2*n)
+	for seq := range seqs {
+		if seq == 0 || seen[seq] {
+			t.Fatalf("invalid or duplicate seq: %d", seq)
+		}
+		seen[seq] = true
+	}
+
+	// zero is skipped when wrapping around
+	s.(*socket).seq = math.MaxUint64 - 1
+	if seq := s.NextSeq(); seq != math.MaxUint64 {
+		t.Fatalf("got seq %d, want %d", seq, uint64(math.MaxUint64))
+	}
+	if seq := s.NextSeq(); seq != 1 {
+		t.Fatalf("got seq %d, want 1", seq)
+	}
+
+	req := NewPacket(WithAutoSeq(s))
+	if req.Seq() != "2" {
+		t.Fatalf("got seq %q, want %q", req.Seq(), "2")
+	}
+	if reply := NewPacket(WithEchoSeq(req)); reply.Seq() != req.Seq() {
+		t.Fatalf("got reply seq %q, want %q", reply.Seq(), req.Seq())
+	}
+}
+
+type countConn struct {
+	net.Conn
+	written, read int64
+}
+
+func (c *countConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+func (c *countConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func TestOnWriteOnRead(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	cc1, cc2 := &countConn{Conn: c1}, &countConn{Conn: c2}
+	s1, s2 := NewSocket(cc1), NewSocket(cc2)
+
+	var writes, written, reads, read int64
+	s1.SetOnWrite(func(p *Packet, n int) {
+		writes++
+		written += int64(n)
+	})
+	s2.SetOnRead(func(p *Packet, n int) {
+		reads++
+		read += int64(n)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s1.WritePacket(NewPacket(WithSeq("1"), WithBody([]byte("hello"))))
+		s1.WritePacketBatch([]*Packet{
+			NewPacket(WithSeq("2"), WithUri("/a"), WithBody([]byte("x"))),
+			NewPacket(WithSeq("3"), WithBodyCodec(codec.ID_JSON), WithBody(make(chan int))),
+		})
+	}()
+	for i := 0; i < 2; i++ {
+		if err := s2.ReadPacket(NewPacket(WithBody(new([]byte)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	if writes != 2 || reads != 2 {
+		t.Fatalf("writes: %d, reads: %d", writes, reads)
+	}
+	if written != atomic.LoadInt64(&cc1.written) || read != atomic.LoadInt64(&cc2.read) || written != read {
+		t.Fatalf("written: %d(%d on wire), read: %d(%d on wire)", written, cc1.written, read, cc2.read)
+	}
+
+	// not called for the failed operations
+	c1.Close()
+	s1.WritePacket(NewPacket(WithBody([]byte("lost"))))
+	s2.ReadPacket(NewPacket(WithBody(new([]byte))))
+	if writes != 2 || reads != 2 {
+		t.Fatalf("writes: %d, reads: %d", writes, reads)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	s1, s2 := NewSocket(c1), NewSocket(c2)
+	s1.StartHeartbeat(10*time.Millisecond, 100*time.Millisecond)
+	s2.StartHeartbeat(10*time.Millisecond, 100*time.Millisecond)
+	defer s1.Close()
+	defer s2.Close()
+
+	// the heartbeat packets keep both sides alive, and are not returned by ReadPacket
+	readCh := make(chan *Packet, 1)
+	go func() {
+		p := NewPacket(WithBody(new([]byte)))
+		if err := s2.ReadPacket(p); err != nil {
+			t.Error(err)
+		}
+		readCh <- p
+	}()
+	go func() {
+		for s1.ReadPacket(NewPacket(WithBody(new([]byte)))) == nil {
+		}
+	}()
+	time.Sleep(300 * time.Millisecond)
+	if err := s2.WritePacket(NewPacket(WithBody([]byte("alive")))); err != nil {
+		t.Fatalf("the socket should be alive: %v", err)
+	}
+	s1.WritePacket(NewPacket(WithSeq("1"), WithBody([]byte("data"))))
+	if p := <-readCh; p.Seq() != "1" || string(*p.Body().(*[]byte)) != "data" {
+		t.Fatalf("got seq %q, body %q", p.Seq(), *p.Body().(*[]byte))
+	}
+	if since := time.Since(s2.LastActiveTime()); since > 100*time.Millisecond {
+		t.Fatalf("the last active time is %v ago", since)
+	}
+
+	// the peer stops responding
+	c3, c4 := net.Pipe()
+	defer c4.Close()
+	s3 := NewSocket(c3)
+	start := time.Now()
+	s3.StartHeartbeat(10*time.Millisecond, 50*time.Millisecond)
+	if err := s3.ReadPacket(NewPacket(WithBody(new([]byte)))); err == nil {
+		t.Fatal("the read should fail after the socket is closed")
+	}
+	if cost := time.Since(start); cost > time.Second {
+		t.Fatalf("the socket should be closed after 50ms, cost %v", cost)
+	}
+}
+
+func TestHeartbeatXferPipe(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	s1, s2 := NewSocket(c1), NewSocket(c2)
+	go func() {
+		s1.WritePacket(NewPacket(WithPtype(PtypeHeartbeat), WithXferPipe('z')))
+		s1.WritePacket(NewPacket(WithSeq("1"), WithBody([]byte("data"))))
+	}()
+	// the transfer filters of the discarded heartbeat are not left in the pipe
+	p := NewPacket(WithBody(new([]byte)))
+	if err := s2.ReadPacket(p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Seq() != "1" || p.XferPipe().Len() != 0 {
+		t.Fatalf("seq: %q, transfer filters: %v", p.Seq(), p.XferPipe().Names())
+	}
+}
+
+func TestHeartbeatStopped(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	s := NewSocket(c1).(*socket)
+	defer s.Close()
+	s.StartHeartbeat(time.Hour, 0)
+	// the heartbeat goroutine stopped before the socket is reused does not act on it
+	stale := make(chan struct{})
+	if err := s.writeHeartbeat(stale); err != ErrProactivelyCloseSocket {
+		t.Fatalf("got error %v, want %v", err, ErrProactivelyCloseSocket)
+	}
+	s.closeIf(0, s.heartbeatRunning(stale))
+	if s.isActiveClosed() {
+		t.Fatal("the socket should not be closed by the stopped heartbeat")
+	}
+}
+
+func TestCloseGracefully(t *testing.T) {
+	// wait for the slow write
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	s := NewSocket(c1)
+	writeErr := make(chan error, 1)
+	go func() {
+		writeErr <- s.WritePacket(NewPacket(WithBody([]byte("slow"))))
+	}()
+	time.Sleep(10 * time.Millisecond)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		NewSocket(c2).ReadPacket(NewPacket(WithBody(new([]byte))))
+	}()
+	start := time.Now()
+	if err := s.CloseGracefully(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if cost := time.Since(start); cost < 50*time.Millisecond {
+		t.Fatalf("CloseGracefully should wait for the in-flight write, cost %v", cost)
+	}
+	if err := <-writeErr; err != nil {
+		t.Fatalf("the in-flight write should succeed: %v", err)
+	}
+	if err := s.WritePacket(NewPacket()); err == nil {
+		t.Fatal("the write after closing should fail")
+	}
+
+	// the write stalls
+	c3, c4 := net.Pipe()
+	defer c4.Close()
+	s = NewSocket(c3)
+	go func() {
+		writeErr <- s.WritePacket(NewPacket(WithBody([]byte("stalled"))))
+	}()
+	time.Sleep(10 * time.Millisecond)
+	start = time.Now()
+	if err := s.CloseGracefully(50 * time.Millisecond); err != ErrCloseGracefullyTimeout {
+		t.Fatalf("got error %v, want %v", err, ErrCloseGracefullyTimeout)
+	}
+	if cost := time.Since(start); cost > time.Second {
+		t.Fatalf("CloseGracefully should honor the timeout, cost %v", cost)
+	}
+	if err := <-writeErr; err == nil {
+		t.Fatal("the stalled write should fail after the socket is closed")
+	}
+	if err := s.WritePacket(NewPacket()); err == nil {
+		t.Fatal("the write after closing should fail")
+	}
+}
+
+type tempError struct{}
+
+func (tempError) Error() string   { return "temporary error" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+// flakyConn fails the first writes after writing a part of the data.
+type flakyConn struct {
+	net.Conn
+	fails  int
+	writes int
+	err    error
+}
+
+func (c *flakyConn) Write(b []byte) (int, error) {
+	c.writes++
+	if c.fails > 0 {
+		c.fails--
+		n, _ := c.Conn.Write(b[:1])
+		return n, c.err
+	}
+	return c.Conn.Write(b)
+}
+
+func TestWritePacketRetry(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	fc := &flakyConn{Conn: c1, fails: 2, err: tempError{}}
+	s1, s2 := NewSocket(fc), NewSocket(c2)
+
+	readCh := make(chan *Packet, 1)
+	go func() {
+		p := NewPacket(WithBody(new([]byte)))
+		if err := s2.ReadPacket(p); err != nil {
+			t.Error(err)
+		}
+		readCh <- p
+	}()
+	policy := RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}
+	var packs int
+	p := NewPacket(WithSeq("1"), WithBodyCodec(codec.ID_JSON), WithBody(marshalCounter{&packs}))
+	if err := s1.WritePacketRetry(p, policy); err != nil {
+		t.Fatal(err)
+	}
+	if fc.writes != 3 || packs != 1 {
+		t.Fatalf("writes: %d, packs: %d", fc.writes, packs)
+	}
+	if q := <-readCh; q.Seq() != "1" || string(bytes.TrimSpace(*q.Body().(*[]byte))) != `"ok"` {
+		t.Fatalf("got seq %q, body %q", q.Seq(), *q.Body().(*[]byte))
+	}
+
+	// abort on the permanent error
+	fc.fails, fc.writes, fc.err = 1, 0, errors.New("permanent error")
+	go io.Copy(ioutil.Discard, c2)
+	if err := s1.WritePacketRetry(NewPacket(WithBody([]byte("x"))), policy); err != fc.err {
+		t.Fatalf("got error %v, want %v", err, fc.err)
+	}
+	if fc.writes != 1 {
+		t.Fatalf("writes: %d", fc.writes)
+	}
+	// the frame is written partially
+	if err := s1.WritePacketRetry(NewPacket(WithBody([]byte("x"))), policy); err != ErrSocketBroken {
+		t.Fatalf("got error %v, want %v", err, ErrSocketBroken)
+	}
+
+	// give up after MaxAttempts
+	s1 = NewSocket(fc)
+	fc.fails, fc.writes, fc.err = 5, 0, tempError{}
+	if err := s1.WritePacketRetry(NewPacket(WithBody([]byte("x"))), policy); err != fc.err {
+		t.Fatalf("got error %v, want %v", err, fc.err)
+	}
+	if fc.writes != 3 {
+		t.Fatalf("writes: %d", fc.writes)
+	}
+}
+
+func TestWritePacketRetryNotInterleaved(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	// the interleaved frames fail instead of hanging
+	c1.SetWriteDeadline(time.Now().Add(time.Second))
+	c2.SetReadDeadline(time.Now().Add(time.Second))
+	fc := &flakyConn{Conn: c1, fails: 1, err: tempError{}}
+	s1, s2 := NewSocket(fc), NewSocket(c2)
+
+	readCh := make(chan string, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			p := NewPacket(WithBody(new([]byte)))
+			if err := s2.ReadPacket(p); err != nil {
+				t.Error(err)
+				return
+			}
+			readCh <- p.Seq()
+		}
+	}()
+	retryErr := make(chan error, 1)
+	go func() {
+		// the first byte is written, and the rest is resent after the backoff
+		retryErr <- s1.WritePacketRetry(NewPacket(WithSeq("retry"), WithBody([]byte("x"))), RetryPolicy{MaxAttempts: 2, Backoff: 50 * time.Millisecond})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := s1.WritePacket(NewPacket(WithSeq("next"), WithBody([]byte("y")))); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-retryErr; err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"retry", "next"} {
+		select {
+		case seq := <-readCh:
+			if seq != want {
+				t.Fatalf("got seq %q, want %q", seq, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("the frames are interleaved")
+		}
+	}
+}
+
+// partialConn accepts only the first n bytes, and then fails with a timeout.
+type partialConn struct {
+	net.Conn
+	n      int
+	writes int
+}
+
+func (c *partialConn) Write(b []byte) (int, error) {
+	c.writes++
+	if len(b) > c.n {
+		n := c.n
+		c.n = 0
+		return n, timeoutError{}
+	}
+	c.n -= len(b)
+	return len(b), nil
+}
+
+func (c *partialConn) Close() error { return nil }
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestSocketBroken(t *testing.T) {
+	newPacket := func() *Packet {
+		return NewPacket(WithSeq("1"), WithUri("/a/b"), WithBody([]byte("body")))
+	}
+	size, err := newPacket().TotalSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc := &partialConn{n: int(size) + 3}
+	s := NewSocket(pc)
+	// the first frame is written completely
+	if err = s.WritePacket(newPacket()); err != nil {
+		t.Fatal(err)
+	}
+	// the second one is cut by the deadline
+	if err = s.WritePacket(newPacket()); err != (timeoutError{}) {
+		t.Fatalf("got error %v, want %v", err, timeoutError{})
+	}
+	// the later writes fail fast
+	pc.n = math.MaxInt32
+	if err = s.WritePacket(newPacket()); err != ErrSocketBroken {
+		t.Fatalf("got error %v, want %v", err, ErrSocketBroken)
+	}
+	if _, err = s.WritePacketBatch([]*Packet{newPacket()}); err != ErrSocketBroken {
+		t.Fatalf("got error %v, want %v", err, ErrSocketBroken)
+	}
+	if pc.writes != 2 {
+		t.Fatalf("writes: got %d, want 2", pc.writes)
+	}
+	// Reset clears it
+	s.Reset(pc)
+	if err = s.WritePacket(newPacket()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the failed write without any written byte does not break the stream
+	pc.n = 0
+	if err = s.WritePacket(newPacket()); err != (timeoutError{}) {
+		t.Fatalf("got error %v, want %v", err, timeoutError{})
+	}
+	pc.n = math.MaxInt32
+	if err = s.WritePacket(newPacket()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// marshalCounter counts the JSON marshalling.
+type marshalCounter struct{ n *int }
+
+func (m marshalCounter) MarshalJSON() ([]byte, error) {
+	*m.n++
+	return []byte(`"ok"`), nil
+}
+
+func TestWritevBody(t *testing.T) {
+	body := make([]byte, 1<<20)
+	rand.New(rand.NewSource(2)).Read(body)
+	readCh := make(chan *Packet, 1)
+	c := loopbackConn(t, func(c net.Conn) {
+		p := NewPacket(WithBody(new([]byte)))
+		if err := NewSocket(c).ReadPacket(p); err != nil {
+			t.Error(err)
+		}
+		readCh <- p
+	})
+	defer c.Close()
+	s := NewSocket(c)
+	if !s.(*socket).protocol.(*rawProto).writer().writev {
+		t.Fatal("the TCP connection should use the scatter write")
+	}
+	p := NewPacket(WithSeq("1"), WithBodyCodec(codec.ID_PLAIN), WithBody(body))
+	if err := s.WritePacket(p); err != nil {
+		t.Fatal(err)
+	}
+	q := <-readCh
+	if q.Seq() != "1" || q.BodyCodec() != codec.ID_PLAIN || !bytes.Equal(*q.Body().(*[]byte), body) || q.Size() != p.Size() {
+		t.Fatalf("seq: %q, codec: %d, body: %d bytes, size: %d/%d", q.Seq(), q.BodyCodec(), len(*q.Body().(*[]byte)), q.Size(), p.Size())
+	}
+}
+
+// hiddenConn hides the concrete type of the connection to disable the scatter write.
+type hiddenConn struct{ net.Conn }
+
+func BenchmarkWritePacket1MB(b *testing.B) {
+	body := make([]byte, 1<<20)
+	for _, writev := range []bool{true, false} {
+		b.Run(fmt.Sprintf("writev=%v", writev), func(b *testing.B) {
+			c := loopbackConn(b, nil)
+			if !writev {
+				c = hiddenConn{c}
+			}
+			s := NewSocket(c)
+			defer s.Close()
+			p := NewPacket(WithBody(body))
+			b.SetBytes(int64(len(body)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := s.WritePacket(p); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestBufferedWrite(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	cc := &countWriteConn{Conn: c1}
+	s1, s2 := NewSocket(cc), NewSocket(c2)
+	if err := s1.SetBufferedWrite(4096); err != nil {
+		t.Fatal(err)
+	}
+	const n = 10
+	for i := 0; i < n; i++ {
+		p := NewPacket(WithSeq(strconv.Itoa(i)), WithUri("/a/b"), WithBody([]byte("notification")))
+		if err := s1.WritePacket(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cc.writes != 0 {
+		t.Fatalf("writes before flush: got %d, want 0", cc.writes)
+	}
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < n+1; i++ {
+			var body []byte
+			p := NewPacket(WithNewBody(func(Header) interface{} { return &body }))
+			if err := s2.ReadPacket(p); err != nil {
+				done <- err
+				return
+			}
+			if p.Seq() != strconv.Itoa(i) {
+				done <- fmt.Errorf("seq: got %q, want %d", p.Seq(), i)
+				return
+			}
+		}
+		done <- nil
+	}()
+	if err := s1.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if cc.writes != 1 {
+		t.Fatalf("writes after flush: got %d, want 1", cc.writes)
+	}
+	// Close must flush the rest
+	p := NewPacket(WithSeq(strconv.Itoa(n)), WithUri("/a/b"), WithBody([]byte("notification")))
+	if err := s1.WritePacket(p); err != nil {
+		t.Fatal(err)
+	}
+	go s1.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBufferedWriteHeartbeat(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	s1, s2 := NewSocket(c1), NewSocket(c2)
+	if err := s1.SetBufferedWrite(4096); err != nil {
+		t.Fatal(err)
+	}
+	s1.StartHeartbeat(10*time.Millisecond, 100*time.Millisecond)
+	s2.StartHeartbeat(10*time.Millisecond, 100*time.Millisecond)
+	defer s1.Close()
+	defer s2.Close()
+	go func() {
+		for s1.ReadPacket(NewPacket(WithBody(new([]byte)))) == nil {
+		}
+	}()
+	readCh := make(chan error, 1)
+	go func() {
+		p := NewPacket(WithBody(new([]byte)))
+		err := s2.ReadPacket(p)
+		if err == nil && p.Seq() != "1" {
+			err = fmt.Errorf("seq: got %q, want 1", p.Seq())
+		}
+		readCh <- err
+	}()
+
+	// the buffered packet is flushed with the heartbeat
+	if err := s1.WritePacket(NewPacket(WithSeq("1"), WithBody([]byte("data")))); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-readCh; err != nil {
+		t.Fatal(err)
+	}
+	// the heartbeat packets keep the peer alive on the idle connection
+	go func() {
+		for s2.ReadPacket(NewPacket(WithBody(new([]byte)))) == nil {
+		}
+	}()
+	time.Sleep(300 * time.Millisecond)
+	if err := s2.WritePacket(NewPacket(WithBody([]byte("alive")))); err != nil {
+		t.Fatalf("the socket should be alive: %v", err)
+	}
+}
+
+func TestBufferedWriteCloseStalled(t *testing.T) {
+	defer func(d time.Duration) { closeFlushTimeout = d }(closeFlushTimeout)
+	closeFlushTimeout = 100 * time.Millisecond
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	s := NewSocket(c1)
+	if err := s.SetBufferedWrite(16); err != nil {
+		t.Fatal(err)
+	}
+	// the peer reads nothing, so the write is stalled with the buffer locked
+	go s.WritePacket(NewPacket(WithBody(make([]byte, 1024))))
+	time.Sleep(50 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		s.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close is blocked by the stalled write")
+	}
+}
+
+func TestBufferedWriteKeepSettings(t *testing.T) {
+	var frames bytes.Buffer
+	proto := NewRawProtoFunc(&frames)
+	for _, size := range []int{4, 16} {
+		if err := proto.Pack(NewPacket(WithBody(make([]byte, size)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	// both frames are sent by one write, and are read into the buffer of the protocol at once
+	go c1.Write(frames.Bytes())
+	s := NewSocket(c2)
+	defer s.Close()
+	s.SetMaxBodyLength(8)
+	if err := s.ReadPacket(NewPacket(WithBody(new([]byte)))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetBufferedWrite(64); err != nil {
+		t.Fatal(err)
+	}
+	s.SetReadIdleTimeout(time.Second)
+	if err := s.ReadPacket(NewPacket(WithBody(new([]byte)))); err != ErrBodyTooLarge {
+		t.Fatalf("got error %v, want %v", err, ErrBodyTooLarge)
+	}
+}
+
+const benchmarkSmallPackets = 1000
+
+func benchmarkSmallPacketsWrite(b *testing.B, bufferSize int) {
+	cc := &countWriteConn{Conn: loopbackConn(b, nil)}
+	s := NewSocket(cc)
+	defer s.Close()
+	if err := s.SetBufferedWrite(bufferSize); err != nil {
+		b.Fatal(err)
+	}
+	p := NewPacket(WithSeq("1"), WithUri("/a/b"), WithBody([]byte("notification")))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < benchmarkSmallPackets; j++ {
+			if err := s.WritePacket(p); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := s.Flush(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(cc.writes)/float64(b.N), "writes/op")
+}
+
+func BenchmarkWriteSmallPacketsUnbuffered(b *testing.B) {
+	benchmarkSmallPacketsWrite(b, 0)
+}
+
+func BenchmarkWriteSmallPacketsBuffered(b *testing.B) {
+	benchmarkSmallPacketsWrite(b, 64<<10)
+}
+
+func TestMaxConsecutiveReadErrors(t *testing.T) {
+	const n = 3
+	garbage := rawFrame(rawHeader(0, 100, "/a/b"))
+	valid, err := NewPacket(WithSeq("1"), WithBody([]byte("ok"))).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frames []byte
+	// the valid packet resets the count
+	for i := 0; i < n; i++ {
+		frames = append(frames, garbage...)
+	}
+	frames = append(frames, valid...)
+	for i := 0; i < n+1; i++ {
+		frames = append(frames, garbage...)
+	}
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go c2.Write(frames)
+	s := NewSocket(c1)
+	s.SetMaxConsecutiveReadErrors(n)
+	read := func() error {
+		return s.ReadPacket(NewPacket(WithBody(new([]byte))))
+	}
+	for i := 0; i < n; i++ {
+		if err = read(); err != io.ErrUnexpectedEOF {
+			t.Fatalf("read %d: got error %v, want %v", i, err, io.ErrUnexpectedEOF)
+		}
+	}
+	if err = read(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if err = read(); err != io.ErrUnexpectedEOF {
+			t.Fatalf("read %d: got error %v, want %v", i, err, io.ErrUnexpectedEOF)
+		}
+	}
+	if err = read(); err != ErrTooManyReadErrors {
+		t.Fatalf("got error %v, want %v", err, ErrTooManyReadErrors)
+	}
+	if err = s.WritePacket(NewPacket()); err != ErrProactivelyCloseSocket {
+		t.Fatalf("the socket should be closed: %v", err)
+	}
+}
+
+func TestMux(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client, server := NewMux(NewSocket(c1), true), NewMux(NewSocket(c2), false)
+	defer client.Close()
+	defer server.Close()
+
+	// the server echoes the packets of every stream
+	go func() {
+		for {
+			st, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer st.Close()
+				for {
+					p := NewPacket(WithBody(new([]byte)))
+					if err := st.ReadPacket(p); err != nil {
+						return
+					}
+					if err := st.WritePacket(NewPacket(WithSeq(p.Seq()), WithBody(p.RawBody()))); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	large, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if large.Id() != 1 || small.Id() != 3 {
+		t.Fatalf("stream ids: %d, %d", large.Id(), small.Id())
+	}
+
+	body := bytes.Repeat([]byte("0123456789abcdef"), 2<<20)
+	var largeDone int32
+	largeErr := make(chan error, 1)
+	go func() {
+		defer atomic.StoreInt32(&largeDone, 1)
+		if err := large.WritePacket(NewPacket(WithSeq("large"), WithBody(body))); err != nil {
+			largeErr <- err
+			return
+		}
+		p := NewPacket(WithBody(new([]byte)))
+		if err := large.ReadPacket(p); err != nil {
+			largeErr <- err
+			return
+		}
+		if p.Seq() != "large" || !bytes.Equal(p.RawBody(), body) {
+			largeErr <- fmt.Errorf("the large body is changed: %d bytes", len(p.RawBody()))
+			return
+		}
+		largeErr <- nil
+	}()
+
+	// the small stream stays responsive while the large body is transferred
+	for i := 0; i < 10; i++ {
+		seq := strconv.Itoa(i)
+		if err := small.WritePacket(NewPacket(WithSeq(seq), WithBody([]byte("ping")))); err != nil {
+			t.Fatal(err)
+		}
+		p := NewPacket(WithBody(new([]byte)))
+		if err := small.ReadPacket(p); err != nil {
+			t.Fatal(err)
+		}
+		if p.Seq() != seq || string(p.RawBody()) != "ping" {
+			t.Fatalf("seq: %q, body: %q", p.Seq(), p.RawBody())
+		}
+	}
+	if atomic.LoadInt32(&largeDone) == 1 {
+		t.Fatal("the small stream should not wait for the large body")
+	}
+	if err := <-largeErr; err != nil {
+		t.Fatal(err)
+	}
+
+	// closing the stream ends the peer's reading
+	if err := small.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := small.WritePacket(NewPacket()); err != ErrStreamClosed {
+		t.Fatalf("got error %v, want %v", err, ErrStreamClosed)
+	}
+	if err := large.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	client.Close()
+	if _, err := client.OpenStream(); err != ErrMuxClosed {
+		t.Fatalf("got error %v, want %v", err, ErrMuxClosed)
+	}
+	if _, err := server.AcceptStream(); err != ErrMuxClosed {
+		t.Fatalf("got error %v, want %v", err, ErrMuxClosed)
+	}
+}
+
+func TestMuxBacklog(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client, server := NewMux(NewSocket(c1), true), NewMux(NewSocket(c2), false)
+	defer client.Close()
+	defer server.Close()
+
+	// the streams over the accept backlog are refused, without blocking the read loop
+	var opened []Stream
+	for i := 0; i <= muxAcceptBacklog; i++ {
+		st, err := client.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		opened = append(opened, st)
+	}
+	if err := opened[muxAcceptBacklog].ReadPacket(NewPacket(WithBody(new([]byte)))); err != io.EOF {
+		t.Fatalf("the refused stream: got error %v, want %v", err, io.EOF)
+	}
+	first, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Id() != opened[0].Id() {
+		t.Fatalf("accepted stream id: got %d, want %d", first.Id(), opened[0].Id())
+	}
+
+	// the stream whose packets are unread over the backlog is reset
+	for i := 0; i <= muxStreamBacklog; i++ {
+		if err := opened[0].WritePacket(NewPacket(WithBody([]byte("x")))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := opened[0].ReadPacket(NewPacket(WithBody(new([]byte)))); err != io.EOF {
+		t.Fatalf("the reset stream: got error %v, want %v", err, io.EOF)
+	}
+	if err := first.ReadPacket(NewPacket(WithBody(new([]byte)))); err != ErrMuxStreamReset {
+		t.Fatalf("got error %v, want %v", err, ErrMuxStreamReset)
+	}
+}
+
+func TestMuxMaxBodyLength(t *testing.T) {
+	c1, c2 := net.Pipe()
+	s2 := NewSocket(c2)
+	// the frames fit, but the reassembled packet does not
+	s2.SetMaxBodyLength(2 * muxChunkSize)
+	client, server := NewMux(NewSocket(c1), true), NewMux(s2, false)
+	defer client.Close()
+	defer server.Close()
+	st, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go st.WritePacket(NewPacket(WithBody(make([]byte, 2*MaxHeaderLength()))))
+	select {
+	case <-server.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the multiplexer should be stopped by the large packet")
+	}
+	if err := server.Err(); err != ErrBodyTooLarge {
+		t.Fatalf("got error %v, want %v", err, ErrBodyTooLarge)
+	}
+}
+
+func TestSocketConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	s := NewSocket(c1)
+	if s.Conn() != c1 {
+		t.Fatalf("got conn %v, want %v", s.Conn(), c1)
+	}
+	s.Reset(c2)
+	if s.Conn() != c2 {
+		t.Fatalf("got conn %v after reset, want %v", s.Conn(), c2)
+	}
+
+	p := GetSocket(c1)
+	if p.Conn() != c1 {
+		t.Fatalf("got pooled conn %v, want %v", p.Conn(), c1)
+	}
+	p.Close()
+	if p.Conn() != nil {
+		t.Fatalf("got conn %v after the pooled socket is closed, want nil", p.Conn())
+	}
+}
+
+func ExampleNewSocket() {
+	c1, c2 := net.Pipe()
+	s1, s2 := NewSocket(c1), NewSocket(c2)
+	defer s1.Close()
+	defer s2.Close()
+
+	go s1.WritePacket(NewPacket(
+		WithSeq("1"),
+		WithPtype(1),
+		WithUri("/hello"),
+		WithBody([]byte("world")),
+	))
+	p := NewPacket(WithBody(new([]byte)))
+	if err := s2.ReadPacket(p); err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("%s %s %s\n", p.Seq(), p.Uri(), *p.Body().(*[]byte))
+	// Output: 1 /hello world
+}
+
+// tcpOptionConn records the TCP options set on the connection.
+type tcpOptionConn struct {
+	*net.TCPConn
+	noDelay         []bool
+	keepAlive       []bool
+	keepAlivePeriod []time.Duration
+}
+
+func (c *tcpOptionConn) SetNoDelay(noDelay bool) error {
+	c.noDelay = append(c.noDelay, noDelay)
+	return c.TCPConn.SetNoDelay(noDelay)
+}
+
+func (c *tcpOptionConn) SetKeepAlive(keepalive bool) error {
+	c.keepAlive = append(c.keepAlive, keepalive)
+	return c.TCPConn.SetKeepAlive(keepalive)
+}
+
+func (c *tcpOptionConn) SetKeepAlivePeriod(d time.Duration) error {
+	c.keepAlivePeriod = append(c.keepAlivePeriod, d)
+	return c.TCPConn.SetKeepAlivePeriod(d)
+}
+
+func TestTCPOptions(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		c, err := lis.Accept()
+		if err == nil {
+			defer c.Close()
+			io.Copy(ioutil.Discard, c)
+		}
+	}()
+	c, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &tcpOptionConn{TCPConn: c.(*net.TCPConn)}
+	s := NewSocket(conn)
+	defer s.Close()
+	// discard the calls of the package-level settings
+	conn.noDelay, conn.keepAlive, conn.keepAlivePeriod = nil, nil, nil
+
+	if err = s.SetNoDelay(false); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SetKeepAlivePeriod(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SetKeepAlivePeriod(0); err != nil {
+		t.Fatal(err)
+	}
+	if len(conn.noDelay) != 1 || conn.noDelay[0] {
+		t.Fatalf("got SetNoDelay calls %v, want [false]", conn.noDelay)
+	}
+	if len(conn.keepAlive) != 2 || !conn.keepAlive[0] || conn.keepAlive[1] {
+		t.Fatalf("got SetKeepAlive calls %v, want [true false]", conn.keepAlive)
+	}
+	if len(conn.keepAlivePeriod) != 1 || conn.keepAlivePeriod[0] != time.Minute {
+		t.Fatalf("got SetKeepAlivePeriod calls %v, want [%v]", conn.keepAlivePeriod, time.Minute)
+	}
+
+	// no-ops for a non-TCP connection
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	s = NewSocket(c1)
+	defer s.Close()
+	if err = s.SetNoDelay(false); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SetKeepAlivePeriod(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// intervalLimiter allows one event per interval.
+type intervalLimiter struct {
+	interval time.Duration
+	mu       sync.Mutex
+	next     time.Time
+}
+
+func (l *intervalLimiter) Wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+	timer := time.NewTimer(time.Until(at))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestReadRateLimiter(t *testing.T) {
+	c1, c2 := net.Pipe()
+	s1, s2 := NewSocket(c1), NewSocket(c2)
+	defer s1.Close()
+	defer s2.Close()
+	const (
+		n        = 10
+		interval = 20 * time.Millisecond
+	)
+	s2.SetReadRateLimiter(&intervalLimiter{interval: interval})
+
+	// the frames are fed as fast as they are read
+	go func() {
+		for i := 0; i < n; i++ {
+			s1.WritePacket(GetPacket(WithSeq(strconv.Itoa(i)), WithBody([]byte("flood"))))
+		}
+	}()
+	p := GetPacket(WithBody(new([]byte)))
+	defer PutPacket(p)
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		if err := s2.ReadPacket(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cost, min := time.Since(start), (n-1)*interval; cost < min {
+		t.Fatalf("read %d packets in %v, want at least %v", n, cost, min)
+	}
+
+	// the wait respects the context deadline
+	s2.SetReadRateLimiter(&intervalLimiter{interval: time.Hour, next: time.Now().Add(time.Hour)})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s2.ReadPacketContext(ctx, p); err != context.DeadlineExceeded {
+		t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// the nil limiter does not limit
+	s2.SetReadRateLimiter(nil)
+	go s1.WritePacket(GetPacket(WithSeq("free"), WithBody([]byte("ok"))))
+	if err := s2.ReadPacket(p); err != nil || p.Seq() != "free" {
+		t.Fatalf("seq: %q, error: %v", p.Seq(), err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	const idle = 100 * time.Millisecond
+	c1, c2 := net.Pipe()
+	s1, s2 := NewSocket(c1), NewSocket(c2)
+	defer s1.Close()
+	defer s2.Close()
+	s1.SetWriteIdleTimeout(idle)
+	s2.SetReadIdleTimeout(idle)
+	body := make([]byte, 1<<15)
+
+	// a slow peer that keeps reading is not cut off
+	p := GetPacket(WithSeq("slow"), WithBody(body))
+	defer PutPacket(p)
+	size, err := p.TotalSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1<<10)
+		for n := int64(0); n < size; {
+			time.Sleep(idle / 10)
+			m, err := c2.Read(b)
+			if err != nil {
+				done <- err
+				return
+			}
+			n += int64(m)
+		}
+		done <- nil
+	}()
+	start := time.Now()
+	if err = s1.WritePacket(p); err != nil {
+		t.Fatal(err)
+	}
+	if cost := time.Since(start); cost < 2*idle {
+		t.Fatalf("the write should outlast the idle timeout, cost %v", cost)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// a peer that stalls mid-write is cut off
+	c3, c4 := net.Pipe()
+	defer c4.Close()
+	s3 := NewSocket(c3)
+	defer s3.Close()
+	s3.SetWriteIdleTimeout(idle)
+	go c4.Read(make([]byte, 1<<10))
+	start = time.Now()
+	err = s3.WritePacket(GetPacket(WithSeq("stall"), WithBody(body)))
+	if !isTimeout(err) {
+		t.Fatalf("got error %v, want a timeout", err)
+	}
+	if cost := time.Since(start); cost > 10*idle {
+		t.Fatalf("the stalled write should fail after the idle timeout, cost %v", cost)
+	}
+
+	// the retried write is timed as well
+	c5, c6 := net.Pipe()
+	defer c6.Close()
+	s5 := NewSocket(c5)
+	defer s5.Close()
+	s5.SetWriteIdleTimeout(idle)
+	start = time.Now()
+	err = s5.WritePacketRetry(GetPacket(WithSeq("retry"), WithBody(body)), RetryPolicy{})
+	if !isTimeout(err) {
+		t.Fatalf("got error %v, want a timeout", err)
+	}
+	if cost := time.Since(start); cost > 10*idle {
+		t.Fatalf("the stalled retried write should fail after the idle timeout, cost %v", cost)
+	}
+
+	// a read that gets no byte is cut off
+	p.Reset(WithBody(new([]byte)))
+	start = time.Now()
+	if err = s2.ReadPacket(p); !isTimeout(err) {
+		t.Fatalf("got error %v, want a timeout", err)
+	}
+	if cost := time.Since(start); cost > 10*idle {
+		t.Fatalf("the idle read should fail after the idle timeout, cost %v", cost)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socket
+
+import (
+	"errors"
+	"io"
+)
+
+// MetaStream the metadata key of the streamed body chunk packet,
+// the value is "chunk" or "end".
+const MetaStream = "X-Stream"
+
+const (
+	streamChunk = "chunk"
+	streamEnd   = "end"
+	// streamChunkSize is the body length upper limit of a chunk packet.
+	streamChunkSize = 1 << 16
+)
+
+// Streamed body errors
+var (
+	ErrStreamXferPipe    = errors.New("socket: the streamed body can not be transferred by filters")
+	ErrStreamClosed      = errors.New("socket: the body stream is closed")
+	ErrStreamInterrupted = errors.New("socket: the body stream is interrupted by another packet")
+)
+
+// BodyWriter writes the packet header to the socket,
+// and returns a writer to stream the body whose length is unknown.
+// Note:
+//  the body is sent as a series of chunk packets with the same header,
+//  and Close sends the terminating packet;
+//  the transfer filters (such as gzip) can not be applied to the whole body in place,
+//  so the packet must not have a transfer pipe;
+//  the socket should not be written by others until Close is called.
+func (p *Packet) BodyWriter(s Socket) (io.WriteCloser, error) {
+	if p.xferPipe.Len() > 0 {
+		return nil, ErrStreamXferPipe
+	}
+	chunk := NewPacket(
+		WithContext(p.Context()),
+		WithSeq(p.seq),
+		WithPtype(p.ptype),
+		WithUri(p.Uri()),
+		WithBodyCodec(p.bodyCodec),
+	)
+	p.meta.CopyTo(chunk.meta)
+	chunk.meta.Set(MetaStream, streamChunk)
+	chunk.SetBody([]byte{})
+	if err := s.WritePacket(chunk); err != nil {
+		return nil, err
+	}
+	return &bodyWriter{s: s, chunk: chunk}, nil
+}
+
+type bodyWriter struct {
+	s      Socket
+	chunk  *Packet
+	closed bool
+}
+
+func (w *bodyWriter) Write(b []byte) (int, error) {
+	if w.closed {
+		return 0, ErrStreamClosed
+	}
+	var n int
+	for len(b) > 0 {
+		size := len(b)
+		if size > streamChunkSize {
+			size = streamChunkSize
+		}
+		w.chunk.SetBody(b[:size])
+		if err := w.s.WritePacket(w.chunk); err != nil {
+			return n, err
+		}
+		n += size
+		b = b[size:]
+	}
+	return n, nil
+}
+
+func (w *bodyWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	w.chunk.meta.Set(MetaStream, streamEnd)
+	w.chunk.SetBody([]byte{})
+	return w.s.WritePacket(w.chunk)
+}
+
+// BodyReader reads the packet header from the socket,
+// and returns a reader of the body streamed by BodyWriter.
+// Note:
+//  the body is read from the chunk packets until the terminating one;
+//  Close discards the unread chunks;
+//  the socket should not be read by others until io.EOF or Close.
+func (p *Packet) BodyReader(s Socket) (io.ReadCloser, error) {
+	r := &bodyReader{s: s, p: p}
+	if err := r.next(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+type bodyReader struct {
+	s     Socket
+	p     *Packet
+	chunk []byte
+	off   int
+	seq   string
+	done  bool
+}
+
+func (r *bodyReader) next() error {
+	// the empty body is not unmarshalled
+	r.chunk = r.chunk[:0]
+	r.p.SetBody(&r.chunk)
+	if err := r.s.ReadPacket(r.p); err != nil {
+		return err
+	}
+	r.off = 0
+	switch string(r.p.meta.Peek(MetaStream)) {
+	case streamChunk:
+	case streamEnd:
+		r.done = true
+	default:
+		return ErrStreamInterrupted
+	}
+	if r.seq == "" {
+		// the seq may alias the read buffer replaced by the next read
+		r.seq = string(append([]byte(nil), r.p.seq...))
+	} else if r.seq != r.p.seq {
+		return ErrStreamInterrupted
+	}
+	return nil
+}
+
+func (r *bodyReader) Read(b []byte) (int, error) {
+	for r.off >= len(r.chunk) {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, r.chunk[r.off:])
+	r.off += n
+	return n, nil
+}
+
+func (r *bodyReader) Close() error {
+	for !r.done {
+		if err := r.next(); err != nil {
+			return err
+		}
+	}
+	r.chunk, r.off = nil, 0
+	r.p.SetBody(nil)
+	return nil
+}
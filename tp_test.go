@@ -1,10 +1,12 @@
 package tp_test
 
 import (
+	"strings"
 	"testing"
 	"time"
 
 	tp "github.com/henrylee2cn/teleport"
+	"github.com/henrylee2cn/teleport/xfer/gzip"
 )
 
 func panic_call(tp.CallCtx, *interface{}) (interface{}, *tp.Rerror) {
@@ -43,3 +45,55 @@ func TestPanic(t *testing.T) {
 	}
 	t.Logf("/panic/push: ok")
 }
+
+func init() {
+	gzip.Reg('g', "gzip-test", 5)
+}
+
+func xfer_call(tp.CallCtx, *string) (interface{}, *tp.Rerror) {
+	return strings.Repeat("teleport", 1024), nil
+}
+
+type replyXferPlugin struct {
+	compressed chan bool
+}
+
+func (*replyXferPlugin) Name() string {
+	return "reply_xfer"
+}
+
+func (p *replyXferPlugin) PostReadReplyBody(ctx tp.ReadCtx) *tp.Rerror {
+	pipe := ctx.Input().XferPipe()
+	p.compressed <- pipe.Len() == 1 && !pipe.Skipped(0)
+	return nil
+}
+
+func TestReplyXferPipe(t *testing.T) {
+	srv := tp.NewPeer(tp.PeerConfig{
+		ListenPort: 9091,
+	})
+	srv.RouteCallFunc(xfer_call)
+	go srv.ListenAndServe()
+
+	time.Sleep(2 * time.Second)
+
+	plugin := &replyXferPlugin{compressed: make(chan bool, 1)}
+	cli := tp.NewPeer(tp.PeerConfig{}, plugin)
+	defer cli.Close()
+	sess, err := cli.Dial(":9091")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	// the small request skips gzip, but the large reply is still compressed
+	var result string
+	rerr := sess.Call("/xfer/call", "hi", &result, tp.WithXferPipe('g')).Rerror()
+	if rerr != nil {
+		t.Fatalf("/xfer/call: %v", rerr)
+	}
+	if len(result) != len("teleport")*1024 {
+		t.Fatalf("/xfer/call: got %d bytes", len(result))
+	}
+	if !<-plugin.compressed {
+		t.Fatal("/xfer/call: the reply should be gzipped")
+	}
+}
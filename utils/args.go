@@ -38,6 +38,9 @@ var argsPool = &sync.Pool{
 type Args struct {
 	args []argsKV
 	buf  []byte
+	// encoded is true if buf holds the query string of args,
+	// which is reused until args are changed
+	encoded bool
 }
 
 type argsKV struct {
@@ -48,6 +51,7 @@ type argsKV struct {
 // Reset clears query args.
 func (a *Args) Reset() {
 	a.args = a.args[:0]
+	a.encoded = false
 }
 
 // CopyTo copies all args to dst.
@@ -100,8 +104,12 @@ func (a *Args) String() string {
 // QueryString returns query string for the args.
 //
 // The returned value is valid until the next call to Args methods.
+// It is cached until the args are changed, so the repeated calls are cheap.
 func (a *Args) QueryString() []byte {
-	a.buf = a.AppendBytes(a.buf[:0])
+	if !a.encoded {
+		a.buf = a.AppendBytes(a.buf[:0])
+		a.encoded = true
+	}
 	return a.buf
 }
 
@@ -131,11 +139,13 @@ func (a *Args) WriteTo(w io.Writer) (int64, error) {
 
 // Del deletes argument with the given key from query args.
 func (a *Args) Del(key string) {
+	a.encoded = false
 	a.args = delAllArgs(a.args, key)
 }
 
 // DelBytes deletes argument with the given key from query args.
 func (a *Args) DelBytes(key []byte) {
+	a.encoded = false
 	a.args = delAllArgs(a.args, b2s(key))
 }
 
@@ -143,6 +153,7 @@ func (a *Args) DelBytes(key []byte) {
 //
 // Multiple values for the same key may be added.
 func (a *Args) Add(key, value string) {
+	a.encoded = false
 	a.args = appendArg(a.args, key, value)
 }
 
@@ -150,6 +161,7 @@ func (a *Args) Add(key, value string) {
 //
 // Multiple values for the same key may be added.
 func (a *Args) AddBytesK(key []byte, value string) {
+	a.encoded = false
 	a.args = appendArg(a.args, b2s(key), value)
 }
 
@@ -157,6 +169,7 @@ func (a *Args) AddBytesK(key []byte, value string) {
 //
 // Multiple values for the same key may be added.
 func (a *Args) AddBytesV(key string, value []byte) {
+	a.encoded = false
 	a.args = appendArg(a.args, key, b2s(value))
 }
 
@@ -164,26 +177,31 @@ func (a *Args) AddBytesV(key string, value []byte) {
 //
 // Multiple values for the same key may be added.
 func (a *Args) AddBytesKV(key, value []byte) {
+	a.encoded = false
 	a.args = appendArg(a.args, b2s(key), b2s(value))
 }
 
 // Set sets 'key=value' argument.
 func (a *Args) Set(key, value string) {
+	a.encoded = false
 	a.args = setArg(a.args, key, value)
 }
 
 // SetBytesK sets 'key=value' argument.
 func (a *Args) SetBytesK(key []byte, value string) {
+	a.encoded = false
 	a.args = setArg(a.args, b2s(key), value)
 }
 
 // SetBytesV sets 'key=value' argument.
 func (a *Args) SetBytesV(key string, value []byte) {
+	a.encoded = false
 	a.args = setArg(a.args, key, b2s(value))
 }
 
 // SetBytesKV sets 'key=value' argument.
 func (a *Args) SetBytesKV(key, value []byte) {
+	a.encoded = false
 	a.args = setArgBytes(a.args, key, value)
 }
 
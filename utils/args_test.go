@@ -0,0 +1,34 @@
+package utils
+
+import "testing"
+
+func TestArgsQueryStringCache(t *testing.T) {
+	var a, b Args
+	check := func(step, want string) {
+		t.Helper()
+		if got := string(a.QueryString()); got != want {
+			t.Fatalf("%s: got %q, want %q", step, got, want)
+		}
+	}
+	check("empty", "")
+	a.Set("a", "1")
+	check("Set", "a=1")
+	check("cached", "a=1")
+	a.Add("b", "x y")
+	check("Add", "a=1&b=x%20y")
+	a.SetBytesV("a", []byte("2"))
+	check("SetBytesV", "a=2&b=x%20y")
+	a.SetUint("c", 3)
+	check("SetUint", "a=2&b=x%20y&c=3")
+	a.Del("b")
+	check("Del", "a=2&c=3")
+	a.Parse("k=v")
+	check("Parse", "k=v")
+	b.Set("z", "0")
+	b.CopyTo(&a)
+	check("CopyTo", "z=0")
+	a.ParseBytes([]byte("p=q&r"))
+	check("ParseBytes", "p=q&r")
+	a.Reset()
+	check("Reset", "")
+}
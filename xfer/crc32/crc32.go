@@ -0,0 +1,96 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package crc32 provides a CRC-32 integrity check transfer filter.
+package crc32
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"sync/atomic"
+
+	"github.com/henrylee2cn/teleport/xfer"
+)
+
+// Reg registers a CRC-32 checker filter for transfer.
+func Reg(id byte, name string) {
+	xfer.Reg(&Crc32{
+		id:   id,
+		name: name,
+	})
+}
+
+// Crc32 integrity check filter.
+// It appends the IEEE CRC-32 checksum of the data when packing,
+// and strips it when unpacking.
+// Note:
+//  the checksum is only verified if SetVerifyChecksum(true),
+//  so that the peers that do not verify are not broken;
+//  put it inside the compression filter to check the decompressed data.
+type Crc32 struct {
+	id   byte
+	name string
+}
+
+const crc32Length = 4
+
+// ErrChecksumMismatch the checksum mismatch error.
+var ErrChecksumMismatch = errors.New("crc32: checksum mismatch")
+
+var verifyChecksum int32
+
+// VerifyChecksum returns whether to verify the checksum when unpacking.
+func VerifyChecksum() bool {
+	return atomic.LoadInt32(&verifyChecksum) == 1
+}
+
+// SetVerifyChecksum sets whether to verify the checksum when unpacking.
+// The default is false.
+func SetVerifyChecksum(verify bool) {
+	if verify {
+		atomic.StoreInt32(&verifyChecksum, 1)
+	} else {
+		atomic.StoreInt32(&verifyChecksum, 0)
+	}
+}
+
+// Id returns transfer filter id.
+func (c *Crc32) Id() byte {
+	return c.id
+}
+
+// Name returns transfer filter name.
+func (c *Crc32) Name() string {
+	return c.name
+}
+
+// OnPack performs filtering on packing.
+func (c *Crc32) OnPack(src []byte) ([]byte, error) {
+	var sum [crc32Length]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(src))
+	return append(src, sum[:]...), nil
+}
+
+// OnUnpack performs filtering on unpacking.
+func (c *Crc32) OnUnpack(src []byte) ([]byte, error) {
+	n := len(src) - crc32Length
+	if n < 0 {
+		return nil, ErrChecksumMismatch
+	}
+	if VerifyChecksum() && crc32.ChecksumIEEE(src[:n]) != binary.BigEndian.Uint32(src[n:]) {
+		return nil, ErrChecksumMismatch
+	}
+	return src[:n], nil
+}
@@ -0,0 +1,61 @@
+package crc32
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/henrylee2cn/teleport/socket"
+	"github.com/henrylee2cn/teleport/xfer"
+)
+
+func init() {
+	Reg('c', "crc32")
+}
+
+func TestCrc32(t *testing.T) {
+	SetVerifyChecksum(true)
+	defer SetVerifyChecksum(false)
+	filter, _ := xfer.Get('c')
+	input := []byte("teleport")
+	b, err := filter.OnPack(append([]byte(nil), input...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := filter.OnUnpack(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(output, input) {
+		t.Fatalf("got %q, want %q", output, input)
+	}
+
+	// flip a byte
+	b[0] ^= 0x01
+	if _, err = filter.OnUnpack(b); err != ErrChecksumMismatch {
+		t.Fatalf("got error %v, want %v", err, ErrChecksumMismatch)
+	}
+	SetVerifyChecksum(false)
+	if _, err = filter.OnUnpack(b); err != nil {
+		t.Fatalf("the checksum should not be verified: %v", err)
+	}
+}
+
+func TestCrc32Packet(t *testing.T) {
+	SetVerifyChecksum(true)
+	defer SetVerifyChecksum(false)
+	var rw bytes.Buffer
+	proto := socket.NewRawProtoFunc(&rw)
+	p := socket.GetPacket(socket.WithXferPipe('c'), socket.WithBody([]byte("body")))
+	defer socket.PutPacket(p)
+	if err := proto.Pack(p); err != nil {
+		t.Fatal(err)
+	}
+	// flip the last byte of the body
+	frame := rw.Bytes()
+	frame[len(frame)-crc32Length-1] ^= 0x01
+	q := socket.GetPacket(socket.WithBody(new([]byte)))
+	defer socket.PutPacket(q)
+	if err := proto.Unpack(q); err != ErrChecksumMismatch {
+		t.Fatalf("got error %v, want %v", err, ErrChecksumMismatch)
+	}
+}
@@ -1,6 +1,8 @@
 package gzip_test
 
 import (
+	"bytes"
+	"fmt"
 	"testing"
 
 	"github.com/henrylee2cn/teleport/xfer"
@@ -17,6 +19,10 @@ func TestGzip(t *testing.T) {
 	if _, err := xfer.GetByName("gzip-5"); err != nil {
 		t.Fatal(err)
 	}
+	// always compress
+	defer gzip.SetCompressMinBytes(gzip.CompressMinBytes())
+	gzip.SetCompressMinBytes(0)
+
 	xferPipe := xfer.NewXferPipe()
 	xferPipe.Append('g')
 	t.Logf("transfer filter: ids:%v, names:%v", xferPipe.Ids(), xferPipe.Names())
@@ -34,3 +40,130 @@ func TestGzip(t *testing.T) {
 		t.Fatalf("gunzip has error: want \"src\", have %q", string(src))
 	}
 }
+
+func TestCompressMinBytes(t *testing.T) {
+	gzip.Reg('G', "gzip-6", 6)
+	defer gzip.SetCompressMinBytes(gzip.CompressMinBytes())
+	gzip.SetCompressMinBytes(16)
+
+	for _, src := range []string{"0123456789abcde", "0123456789abcdef"} {
+		xferPipe := xfer.NewXferPipe()
+		xferPipe.Append('G')
+		b, ids, err := xferPipe.OnPackIds([]byte(src))
+		if err != nil {
+			t.Fatalf("onpack: %v", err)
+		}
+		skipped := len(src) < gzip.CompressMinBytes()
+		if skipped != (len(ids) == 0) || xferPipe.Len() != 1 {
+			t.Fatalf("size: %d, skipped: %v, applied: %v, transfer filters: %v", len(src), skipped, ids, xferPipe.Names())
+		}
+		if skipped && string(b) != src {
+			t.Fatalf("the skipped data should not be changed: %q", b)
+		}
+		unpackPipe := xfer.NewXferPipe()
+		unpackPipe.Append(ids...)
+		dst, err := unpackPipe.OnUnpack(b)
+		if err != nil {
+			t.Fatalf("onunpack: %v", err)
+		}
+		if string(dst) != src {
+			t.Fatalf("want %q, have %q", src, dst)
+		}
+
+		// the skipped filter is kept in the pipe, but not applied on unpacking
+		b, skippedList, err := xferPipe.OnPackSkip([]byte(src))
+		if err != nil {
+			t.Fatalf("onpack: %v", err)
+		}
+		unpackPipe = xfer.NewXferPipe()
+		if skipped {
+			unpackPipe.AppendSkipped('G')
+		} else {
+			unpackPipe.Append('G')
+		}
+		if (skippedList != nil) != skipped || unpackPipe.Len() != 1 || unpackPipe.Skipped(0) != skipped {
+			t.Fatalf("size: %d, skipped: %v", len(src), skippedList)
+		}
+		if dst, err = unpackPipe.OnUnpack(b); err != nil || string(dst) != src {
+			t.Fatalf("want %q, have %q, error: %v", src, dst, err)
+		}
+	}
+}
+
+func init() {
+	gzip.Reg('b', "gzip-bench", 5)
+}
+
+func BenchmarkGzip(b *testing.B) {
+	xferPipe := xfer.NewXferPipe()
+	xferPipe.Append('b')
+	src := bytes.Repeat([]byte("teleport"), 1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data, err := xferPipe.OnPack(src)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err = xferPipe.OnUnpack(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestLevel(t *testing.T) {
+	for i, level := range []int{-3, -2, -1, 0, 9, 10} {
+		valid := level >= -2 && level <= 9
+		func() {
+			defer func() {
+				if p := recover(); (p == nil) != valid {
+					t.Fatalf("level: %d, valid: %v, panic: %v", level, valid, p)
+				}
+			}()
+			gzip.Reg(byte(0xf0+i), fmt.Sprintf("gzip-level%d", level), level)
+		}()
+	}
+}
+
+func TestMaxDecompressedBytes(t *testing.T) {
+	xferPipe := xfer.NewXferPipe()
+	xferPipe.Append('b')
+	// 4MB of zeros compress into a few KB
+	src := make([]byte, 4<<20)
+	b, err := xferPipe.OnPack(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) >= 64<<10 {
+		t.Fatalf("the data should be highly compressible: %d bytes", len(b))
+	}
+	defer xfer.SetMaxDecompressedBytes(xfer.MaxDecompressedBytes())
+	xfer.SetMaxDecompressedBytes(1 << 20)
+	if _, err = xferPipe.OnUnpack(b); err != xfer.ErrDecompressedTooLarge {
+		t.Fatalf("got error %v, want %v", err, xfer.ErrDecompressedTooLarge)
+	}
+	xfer.SetMaxDecompressedBytes(int64(len(src)))
+	dst, err := xferPipe.OnUnpack(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dst) != len(src) {
+		t.Fatalf("got %d bytes, want %d", len(dst), len(src))
+	}
+}
+
+func TestNotGzipped(t *testing.T) {
+	xferPipe := xfer.NewXferPipe()
+	xferPipe.Append('b')
+	_, err := xferPipe.OnUnpack([]byte(`{"uncompressed":true}`))
+	e, ok := err.(*gzip.ErrNotGzipped)
+	if !ok {
+		t.Fatalf("got error %v, want *gzip.ErrNotGzipped", err)
+	}
+	if string(e.Head) != `{"uncomp` {
+		t.Fatalf("head: %q", e.Head)
+	}
+	if msg := err.Error(); msg != "gzip: the data is not gzipped, the first bytes are [7b 22 75 6e 63 6f 6d 70]" {
+		t.Fatal(msg)
+	}
+}
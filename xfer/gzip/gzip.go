@@ -18,13 +18,36 @@ import (
 	"bytes"
 	"compress/gzip"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"sync"
+	"sync/atomic"
 
 	"github.com/henrylee2cn/teleport/utils"
 	"github.com/henrylee2cn/teleport/xfer"
 )
 
+// compressMinBytes is accessed atomically
+var compressMinBytes int64 = 512
+
+// CompressMinBytes returns the minimum data size to compress.
+func CompressMinBytes() int {
+	return int(atomic.LoadInt64(&compressMinBytes))
+}
+
+// SetCompressMinBytes sets the minimum data size to compress.
+// The data smaller than it is transferred without compression,
+// and the gzip filter is not listed in the frame, the transfer pipe of the packet is not changed.
+// Note:
+//  if n<=0, always compress;
+//  the default is 512.
+func SetCompressMinBytes(n int) {
+	if n < 0 {
+		n = 0
+	}
+	atomic.StoreInt64(&compressMinBytes, int64(n))
+}
+
 // Reg registers a gzip filter for transfer.
 func Reg(id byte, name string, level int) {
 	xfer.Reg(newGzip(id, name, level))
@@ -60,6 +83,8 @@ type Gzip struct {
 	level int
 	wPool sync.Pool
 	rPool sync.Pool
+	// levels caches the *Gzip of the other levels, created by WithLevel
+	levels sync.Map
 }
 
 // Id returns transfer filter id.
@@ -72,6 +97,28 @@ func (g *Gzip) Name() string {
 	return g.name
 }
 
+// LevelRange returns the minimum and maximum compression levels.
+func (g *Gzip) LevelRange() (min, max int) {
+	return gzip.HuffmanOnly, gzip.BestCompression
+}
+
+// WithLevel returns the gzip filter with the same id and name compressing at the level.
+func (g *Gzip) WithLevel(level int) xfer.XferFilter {
+	if level == g.level {
+		return g
+	}
+	if v, ok := g.levels.Load(level); ok {
+		return v.(*Gzip)
+	}
+	v, _ := g.levels.LoadOrStore(level, newGzip(g.id, g.name, level))
+	return v.(*Gzip)
+}
+
+// SkipPack reports whether the data is too small to compress.
+func (g *Gzip) SkipPack(src []byte) bool {
+	return int64(len(src)) < atomic.LoadInt64(&compressMinBytes)
+}
+
 // OnPack performs filtering on packing.
 func (g *Gzip) OnPack(src []byte) ([]byte, error) {
 	gw := g.wPool.Get().(*gzip.Writer)
@@ -91,17 +138,51 @@ func (g *Gzip) OnPack(src []byte) ([]byte, error) {
 	return bb.Bytes(), nil
 }
 
+// ErrNotGzipped is returned on unpacking the data without the gzip magic bytes,
+// which is usually sent by a peer that sets the gzip filter but does not compress.
+type ErrNotGzipped struct {
+	// Head is the first bytes of the data, at most 8.
+	Head []byte
+}
+
+// Error implements error.
+func (e *ErrNotGzipped) Error() string {
+	return fmt.Sprintf("gzip: the data is not gzipped, the first bytes are [% x]", e.Head)
+}
+
+// gzipMagic is the first two bytes of the gzip format.
+var gzipMagic = []byte{0x1f, 0x8b}
+
 // OnUnpack performs filtering on unpacking.
 func (g *Gzip) OnUnpack(src []byte) ([]byte, error) {
+	return g.OnUnpackLimit(src, xfer.MaxDecompressedBytes())
+}
+
+// OnUnpackLimit performs filtering on unpacking, the data decompressed can not exceed max.
+func (g *Gzip) OnUnpackLimit(src []byte, max int64) ([]byte, error) {
 	if len(src) == 0 {
 		return src, nil
 	}
+	if !bytes.HasPrefix(src, gzipMagic) {
+		head := src
+		if len(head) > 8 {
+			head = head[:8]
+		}
+		return nil, &ErrNotGzipped{Head: append([]byte(nil), head...)}
+	}
 	gr := g.rPool.Get().(*gzip.Reader)
 	defer g.rPool.Put(gr)
 	err := gr.Reset(bytes.NewReader(src))
 	if err != nil {
 		return nil, err
 	}
-	dest, _ := ioutil.ReadAll(gr)
+	var r io.Reader = gr
+	if max > 0 {
+		r = io.LimitReader(gr, max+1)
+	}
+	dest, _ := ioutil.ReadAll(r)
+	if err = xfer.CheckDecompressedLimit(int64(len(dest)), max); err != nil {
+		return nil, err
+	}
 	return dest, nil
 }
@@ -0,0 +1,76 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snappy
+
+import (
+	"github.com/golang/snappy"
+
+	"github.com/henrylee2cn/teleport/xfer"
+)
+
+// Reg registers a snappy filter for transfer.
+func Reg(id byte, name string) {
+	xfer.Reg(newSnappy(id, name))
+}
+
+// newSnappy creates a new snappy filter.
+func newSnappy(id byte, name string) *Snappy {
+	return &Snappy{
+		id:   id,
+		name: name,
+	}
+}
+
+// Snappy compression filter.
+// Note: it is much faster than gzip, but the compression ratio is lower.
+type Snappy struct {
+	id   byte
+	name string
+}
+
+// Id returns transfer filter id.
+func (s *Snappy) Id() byte {
+	return s.id
+}
+
+// Name returns transfer filter name.
+func (s *Snappy) Name() string {
+	return s.name
+}
+
+// OnPack performs filtering on packing.
+func (s *Snappy) OnPack(src []byte) ([]byte, error) {
+	return snappy.Encode(nil, src), nil
+}
+
+// OnUnpack performs filtering on unpacking.
+func (s *Snappy) OnUnpack(src []byte) ([]byte, error) {
+	return s.OnUnpackLimit(src, xfer.MaxDecompressedBytes())
+}
+
+// OnUnpackLimit performs filtering on unpacking, the data decompressed can not exceed max.
+func (s *Snappy) OnUnpackLimit(src []byte, max int64) ([]byte, error) {
+	if len(src) == 0 {
+		return src, nil
+	}
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	if err = xfer.CheckDecompressedLimit(int64(n), max); err != nil {
+		return nil, err
+	}
+	return snappy.Decode(nil, src)
+}
@@ -0,0 +1,76 @@
+package snappy_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/henrylee2cn/teleport/xfer"
+	"github.com/henrylee2cn/teleport/xfer/gzip"
+	"github.com/henrylee2cn/teleport/xfer/snappy"
+)
+
+func init() {
+	snappy.Reg('s', "snappy")
+	gzip.Reg('g', "gzip-5", 5)
+}
+
+var testData = bytes.Repeat([]byte(`{"id":1,"name":"teleport","tags":["a","b","c"]}`), 100)
+
+func TestSnappy(t *testing.T) {
+	if _, err := xfer.GetByName("snappy"); err != nil {
+		t.Fatal(err)
+	}
+	xferPipe := xfer.NewXferPipe()
+	xferPipe.Append('s')
+
+	b, err := xferPipe.OnPack(testData)
+	if err != nil {
+		t.Fatalf("onpack: %v", err)
+	}
+	src, err := xferPipe.OnUnpack(b)
+	if err != nil {
+		t.Fatalf("onunpack: %v", err)
+	}
+	if !bytes.Equal(src, testData) {
+		t.Fatalf("unsnappy has error: want %q, have %q", testData, src)
+	}
+}
+
+func TestSnappyMaxDecompressedBytes(t *testing.T) {
+	xferPipe := xfer.NewXferPipe()
+	xferPipe.Append('s')
+	b, err := xferPipe.OnPack(testData)
+	if err != nil {
+		t.Fatalf("onpack: %v", err)
+	}
+	defer xfer.SetMaxDecompressedBytes(xfer.MaxDecompressedBytes())
+	xfer.SetMaxDecompressedBytes(int64(len(testData) - 1))
+	if _, err = xferPipe.OnUnpack(b); err != xfer.ErrDecompressedTooLarge {
+		t.Fatalf("got error %v, want %v", err, xfer.ErrDecompressedTooLarge)
+	}
+}
+
+func benchmarkFilter(b *testing.B, id byte) {
+	xferPipe := xfer.NewXferPipe()
+	xferPipe.Append(id)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(testData)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data, err := xferPipe.OnPack(testData)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err = xferPipe.OnUnpack(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSnappy(b *testing.B) {
+	benchmarkFilter(b, 's')
+}
+
+func BenchmarkGzip(b *testing.B) {
+	benchmarkFilter(b, 'g')
+}
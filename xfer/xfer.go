@@ -20,6 +20,8 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"sort"
+	"sync/atomic"
 )
 
 // XferFilter handles byte stream of packet when transfer.
@@ -34,6 +36,34 @@ type XferFilter interface {
 	OnUnpack([]byte) ([]byte, error)
 }
 
+// XferSkipper is an optional interface implemented by a transfer filter.
+// If SkipPack returns true, OnPackIds and OnPackSkip do not apply the filter to the data,
+// and leave its id out of the applied ones, while the transfer pipe is not changed.
+type XferSkipper interface {
+	// SkipPack reports whether to skip the filter on packing.
+	SkipPack([]byte) bool
+}
+
+// XferLimiter is an optional interface implemented by a decompression filter,
+// so that the size upper limit of the data decompressed can be set per socket.
+type XferLimiter interface {
+	// OnUnpackLimit performs filtering on unpacking,
+	// it returns ErrDecompressedTooLarge if the data decompressed exceeds max.
+	// If max<=0, there is no limit.
+	OnUnpackLimit(src []byte, max int64) ([]byte, error)
+}
+
+// XferLeveler is an optional interface implemented by a compression filter,
+// which can compress at the other levels in its range with the same id,
+// since the data is decompressed in the same way whatever the level is.
+type XferLeveler interface {
+	// LevelRange returns the minimum and maximum compression levels.
+	LevelRange() (min, max int)
+	// WithLevel returns the filter with the same id and name compressing at the level,
+	// which is in the range.
+	WithLevel(level int) XferFilter
+}
+
 var xferFilterMap = struct {
 	idMap   map[byte]XferFilter
 	nameMap map[string]XferFilter
@@ -45,6 +75,47 @@ var xferFilterMap = struct {
 // ErrXferPipeTooLong error
 var ErrXferPipeTooLong = errors.New("The length of transfer pipe cannot be bigger than 255")
 
+var maxDecompressedBytes int64 = 1 << 26
+
+// ErrDecompressedTooLarge error
+var ErrDecompressedTooLarge = errors.New("The decompressed data exceeds the limit")
+
+// MaxDecompressedBytes returns the size upper limit of the data
+// decompressed by a transfer filter.
+func MaxDecompressedBytes() int64 {
+	return atomic.LoadInt64(&maxDecompressedBytes)
+}
+
+// SetMaxDecompressedBytes sets the size upper limit of the data
+// decompressed by a transfer filter, such as gzip, zstd and snappy,
+// when it is exceeded, unpacking fails with ErrDecompressedTooLarge,
+// so that a tiny compressed frame can not inflate into a huge buffer.
+// Note:
+//  if n<=0, there is no limit;
+//  the default is 64MB;
+//  it can be overridden per socket by Socket.SetMaxDecompressedBytes, see XferLimiter;
+//  the zstd filter also caps its decoder memory with the limit.
+func SetMaxDecompressedBytes(n int64) {
+	if n < 0 {
+		n = 0
+	}
+	atomic.StoreInt64(&maxDecompressedBytes, n)
+}
+
+// CheckDecompressedBytes returns ErrDecompressedTooLarge if n exceeds MaxDecompressedBytes.
+func CheckDecompressedBytes(n int64) error {
+	return CheckDecompressedLimit(n, MaxDecompressedBytes())
+}
+
+// CheckDecompressedLimit returns ErrDecompressedTooLarge if n exceeds max,
+// which has no limit if max<=0.
+func CheckDecompressedLimit(n, max int64) error {
+	if max > 0 && n > max {
+		return ErrDecompressedTooLarge
+	}
+	return nil
+}
+
 // Reg registers transfer filter.
 func Reg(xferFilter XferFilter) {
 	id := xferFilter.Id()
@@ -77,10 +148,41 @@ func GetByName(name string) (XferFilter, error) {
 	return xferFilter, nil
 }
 
+// GetLevel returns the transfer filter by name, which compresses at the level.
+func GetLevel(name string, level int) (XferFilter, error) {
+	xferFilter, err := GetByName(name)
+	if err != nil {
+		return nil, err
+	}
+	leveler, ok := xferFilter.(XferLeveler)
+	if !ok {
+		return nil, fmt.Errorf("transfer filter %s has no compression level", name)
+	}
+	if min, max := leveler.LevelRange(); level < min || level > max {
+		return nil, fmt.Errorf("invalid compression level of transfer filter %s: %d, not in [%d, %d]", name, level, min, max)
+	}
+	return leveler.WithLevel(level), nil
+}
+
+// ListAll returns all registered transfer filters sorted by id.
+func ListAll() []XferFilter {
+	list := make([]XferFilter, 0, len(xferFilterMap.idMap))
+	for _, xferFilter := range xferFilterMap.idMap {
+		list = append(list, xferFilter)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Id() < list[j].Id()
+	})
+	return list
+}
+
 // XferPipe transfer filter pipe, handlers from outer-most to inner-most.
 // Note: the length can not be bigger than 255!
 type XferPipe struct {
 	filters []XferFilter
+	// skipped[i] is true if filters[i] was skipped on packing,
+	// it may be shorter than filters
+	skipped []bool
 }
 
 // NewXferPipe creates a new transfer filter pipe.
@@ -91,6 +193,7 @@ func NewXferPipe() *XferPipe {
 // Reset resets transfer filter pipe.
 func (x *XferPipe) Reset() {
 	x.filters = x.filters[:0]
+	x.skipped = x.skipped[:0]
 }
 
 // Append appends transfer filter by id.
@@ -105,7 +208,37 @@ func (x *XferPipe) Append(filterId ...byte) error {
 	return x.check()
 }
 
+// AppendFilter appends transfer filter, such as the one returned by GetLevel.
+func (x *XferPipe) AppendFilter(filter ...XferFilter) error {
+	x.filters = append(x.filters, filter...)
+	return x.check()
+}
+
+// AppendSkipped appends transfer filter by id, which was skipped on packing,
+// so that OnUnpack does not apply it, while Ids and AppendFrom keep it.
+func (x *XferPipe) AppendSkipped(filterId ...byte) error {
+	for len(x.skipped) < len(x.filters) {
+		x.skipped = append(x.skipped, false)
+	}
+	for _, id := range filterId {
+		filter, err := Get(id)
+		if err != nil {
+			return err
+		}
+		x.filters = append(x.filters, filter)
+		x.skipped = append(x.skipped, true)
+	}
+	return x.check()
+}
+
+// Skipped reports whether the transfer filter at idx was skipped on packing,
+// see AppendSkipped.
+func (x *XferPipe) Skipped(idx int) bool {
+	return x != nil && idx < len(x.skipped) && x.skipped[idx]
+}
+
 // AppendFrom appends transfer filters from a *XferPipe.
+// Note: the filters skipped by src are appended as the normal ones.
 func (x *XferPipe) AppendFrom(src *XferPipe) {
 	for _, filter := range src.filters {
 		x.filters = append(x.filters, filter)
@@ -162,6 +295,7 @@ func (x *XferPipe) Range(callback func(idx int, filter XferFilter) bool) {
 }
 
 // OnPack packs transfer byte stream, from inner-most to outer-most.
+// Note: all the filters are applied, see OnPackIds for the skippable ones.
 func (x *XferPipe) OnPack(data []byte) ([]byte, error) {
 	var err error
 	for i := x.Len() - 1; i >= 0; i-- {
@@ -172,14 +306,82 @@ func (x *XferPipe) OnPack(data []byte) ([]byte, error) {
 	return data, err
 }
 
+// OnPackIds packs transfer byte stream, from inner-most to outer-most,
+// and returns the id list of the applied filters, which is to be written into the frame.
+// Note: the filters that skip the data are not applied, and the transfer pipe is not changed.
+func (x *XferPipe) OnPackIds(data []byte) ([]byte, []byte, error) {
+	data, skipped, err := x.OnPackSkip(data)
+	if err != nil {
+		return data, nil, err
+	}
+	var ids = make([]byte, 0, x.Len())
+	for i, filter := range x.filters {
+		if skipped == nil || !skipped[i] {
+			ids = append(ids, filter.Id())
+		}
+	}
+	return data, ids, nil
+}
+
+// OnPackSkip packs transfer byte stream, from inner-most to outer-most,
+// and returns whether each filter is skipped, in the same order as Ids,
+// or nil if none is skipped, so that the frame can record the whole pipe.
+// Note: the filters that skip the data are not applied, and the transfer pipe is not changed.
+func (x *XferPipe) OnPackSkip(data []byte) ([]byte, []bool, error) {
+	var err error
+	var skipped []bool
+	for i := x.Len() - 1; i >= 0; i-- {
+		if skipper, ok := x.filters[i].(XferSkipper); ok && skipper.SkipPack(data) {
+			if skipped == nil {
+				skipped = make([]bool, x.Len())
+			}
+			skipped[i] = true
+			continue
+		}
+		if data, err = x.filters[i].OnPack(data); err != nil {
+			return data, nil, err
+		}
+	}
+	return data, skipped, err
+}
+
 // OnUnpack unpacks transfer byte stream, from outer-most to inner-most.
+// Note: the filters skipped on packing are not applied, see AppendSkipped.
 func (x *XferPipe) OnUnpack(data []byte) ([]byte, error) {
 	var err error
 	var count = x.Len()
 	for i := 0; i < count; i++ {
+		if x.Skipped(i) {
+			continue
+		}
 		if data, err = x.filters[i].OnUnpack(data); err != nil {
 			return data, err
 		}
 	}
 	return data, err
 }
+
+// OnUnpackLimit unpacks transfer byte stream, from outer-most to inner-most,
+// the filters implementing XferLimiter decompress at most max bytes instead of MaxDecompressedBytes.
+// If max<=0, it is the same as OnUnpack.
+func (x *XferPipe) OnUnpackLimit(data []byte, max int64) ([]byte, error) {
+	if max <= 0 {
+		return x.OnUnpack(data)
+	}
+	var err error
+	var count = x.Len()
+	for i := 0; i < count; i++ {
+		if x.Skipped(i) {
+			continue
+		}
+		if limiter, ok := x.filters[i].(XferLimiter); ok {
+			data, err = limiter.OnUnpackLimit(data, max)
+		} else {
+			data, err = x.filters[i].OnUnpack(data)
+		}
+		if err != nil {
+			return data, err
+		}
+	}
+	return data, err
+}
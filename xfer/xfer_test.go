@@ -0,0 +1,78 @@
+package xfer
+
+import (
+	"bytes"
+	"testing"
+)
+
+// xorFilter is a trivial custom filter.
+type xorFilter struct{}
+
+func (xorFilter) Id() byte     { return 'x' }
+func (xorFilter) Name() string { return "xor" }
+
+func (xorFilter) OnPack(src []byte) ([]byte, error) {
+	dst := make([]byte, len(src))
+	for i, b := range src {
+		dst[i] = b ^ 0x5a
+	}
+	return dst, nil
+}
+
+func (f xorFilter) OnUnpack(src []byte) ([]byte, error) {
+	return f.OnPack(src)
+}
+
+func init() {
+	Reg(xorFilter{})
+}
+
+func TestCustomFilter(t *testing.T) {
+	x := NewXferPipe()
+	if err := x.Append('x'); err != nil {
+		t.Fatal(err)
+	}
+	input := []byte("teleport")
+	packed, err := x.OnPack(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(packed, input) {
+		t.Fatal("the data should be filtered")
+	}
+	y := NewXferPipe()
+	if err = y.Append(x.Ids()...); err != nil {
+		t.Fatal(err)
+	}
+	output, err := y.OnUnpack(packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(output, input) {
+		t.Fatalf("got %q, want %q", output, input)
+	}
+}
+
+func TestUnknownFilter(t *testing.T) {
+	if err := NewXferPipe().Append(0xfe); err == nil {
+		t.Fatal("appending an unregistered filter id should fail")
+	}
+}
+
+func TestDuplicateFilter(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registering a duplicate filter id should panic")
+		}
+	}()
+	Reg(xorFilter{})
+}
+
+func TestGetLevel(t *testing.T) {
+	if _, err := GetLevel("unknown", 1); err == nil {
+		t.Fatal("expect error for unregistered filter name")
+	}
+	if _, err := GetLevel("xor", 1); err == nil {
+		t.Fatal("expect error for the filter without compression level")
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2018 HenryLee. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zstd
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/henrylee2cn/teleport/xfer"
+)
+
+// Compression level range
+const (
+	MinLevel = 1
+	MaxLevel = 22
+)
+
+// Reg registers a zstd filter for transfer.
+// NOTE:
+//  panic if the level is not in [MinLevel, MaxLevel].
+func Reg(id byte, name string, level int) {
+	xfer.Reg(newZstd(id, name, level))
+}
+
+// newZstd creates a new zstd filter.
+func newZstd(id byte, name string, level int) *Zstd {
+	if level < MinLevel || level > MaxLevel {
+		panic(fmt.Sprintf("zstd: invalid compression level: %d", level))
+	}
+	// EncodeAll and DecodeAll are safe for concurrent use,
+	// and reuse the internal encoding/decoding state.
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	if err != nil {
+		panic(err)
+	}
+	z := &Zstd{
+		id:      id,
+		name:    name,
+		level:   level,
+		encoder: encoder,
+	}
+	if _, err = z.getDecoder(xfer.MaxDecompressedBytes()); err != nil {
+		panic(err)
+	}
+	return z
+}
+
+// Zstd compression filter.
+// Note: it has a better compression ratio than gzip on large payloads.
+type Zstd struct {
+	id      byte
+	name    string
+	level   int
+	encoder *zstd.Encoder
+	// decoders caches the *zstd.Decoder capped by each size limit
+	decoders sync.Map
+	// levels caches the *Zstd of the other levels, created by WithLevel
+	levels sync.Map
+}
+
+// getDecoder returns the decoder whose memory is capped by max,
+// which is created on the first use of the limit.
+func (z *Zstd) getDecoder(max int64) (*zstd.Decoder, error) {
+	if max < 0 {
+		max = 0
+	}
+	if v, ok := z.decoders.Load(max); ok {
+		return v.(*zstd.Decoder), nil
+	}
+	dOpts := []zstd.DOption{zstd.WithDecoderConcurrency(0)}
+	if max > 0 {
+		dOpts = append(dOpts, zstd.WithDecoderMaxMemory(uint64(max)))
+	}
+	decoder, err := zstd.NewReader(nil, dOpts...)
+	if err != nil {
+		return nil, err
+	}
+	if v, loaded := z.decoders.LoadOrStore(max, decoder); loaded {
+		decoder.Close()
+		return v.(*zstd.Decoder), nil
+	}
+	return decoder, nil
+}
+
+// Id returns transfer filter id.
+func (z *Zstd) Id() byte {
+	return z.id
+}
+
+// Name returns transfer filter name.
+func (z *Zstd) Name() string {
+	return z.name
+}
+
+// LevelRange returns the minimum and maximum compression levels.
+func (z *Zstd) LevelRange() (min, max int) {
+	return MinLevel, MaxLevel
+}
+
+// WithLevel returns the zstd filter with the same id and name compressing at the level.
+func (z *Zstd) WithLevel(level int) xfer.XferFilter {
+	if level == z.level {
+		return z
+	}
+	if v, ok := z.levels.Load(level); ok {
+		return v.(*Zstd)
+	}
+	v, _ := z.levels.LoadOrStore(level, newZstd(z.id, z.name, level))
+	return v.(*Zstd)
+}
+
+// OnPack performs filtering on packing.
+func (z *Zstd) OnPack(src []byte) ([]byte, error) {
+	return z.encoder.EncodeAll(src, nil), nil
+}
+
+// OnUnpack performs filtering on unpacking.
+func (z *Zstd) OnUnpack(src []byte) ([]byte, error) {
+	return z.OnUnpackLimit(src, xfer.MaxDecompressedBytes())
+}
+
+// OnUnpackLimit performs filtering on unpacking, the data decompressed can not exceed max.
+func (z *Zstd) OnUnpackLimit(src []byte, max int64) ([]byte, error) {
+	if len(src) == 0 {
+		return src, nil
+	}
+	decoder, err := z.getDecoder(max)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := decoder.DecodeAll(src, nil)
+	if err == zstd.ErrDecoderSizeExceeded {
+		return nil, xfer.ErrDecompressedTooLarge
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = xfer.CheckDecompressedLimit(int64(len(dest)), max); err != nil {
+		return nil, err
+	}
+	return dest, nil
+}
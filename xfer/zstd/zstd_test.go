@@ -0,0 +1,101 @@
+package zstd_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/henrylee2cn/teleport/xfer"
+	"github.com/henrylee2cn/teleport/xfer/zstd"
+)
+
+func TestZstd(t *testing.T) {
+	zstd.Reg('z', "zstd-3", 3)
+
+	if _, err := xfer.GetByName("zstd-3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := xfer.GetByName("zstd-99"); err == nil {
+		t.Fatal("expect error for unregistered filter name")
+	}
+	xferPipe := xfer.NewXferPipe()
+	xferPipe.Append('z')
+
+	data := bytes.Repeat([]byte(`{"id":1,"name":"teleport"}`), 4<<20/26)
+	b, err := xferPipe.OnPack(data)
+	if err != nil {
+		t.Fatalf("onpack: %v", err)
+	}
+	src, err := xferPipe.OnUnpack(b)
+	if err != nil {
+		t.Fatalf("onunpack: %v", err)
+	}
+	if !bytes.Equal(src, data) {
+		t.Fatal("unzstd has error: the data is changed")
+	}
+}
+
+func TestInvalidLevel(t *testing.T) {
+	for _, level := range []int{zstd.MinLevel - 1, zstd.MaxLevel + 1} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("expect panic for level %d", level)
+				}
+			}()
+			zstd.Reg('Z', "zstd-invalid", level)
+		}()
+	}
+}
+
+func TestZstdWithLevel(t *testing.T) {
+	zstd.Reg('x', "zstd-level", 3)
+	if _, err := xfer.GetLevel("zstd-level", zstd.MaxLevel+1); err == nil {
+		t.Fatal("expect error for invalid level")
+	}
+	filter, err := xfer.GetLevel("zstd-level", 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xferPipe := xfer.NewXferPipe()
+	xferPipe.AppendFilter(filter)
+	data := bytes.Repeat([]byte(`{"id":1,"name":"teleport"}`), 4<<20/26)
+	b, err := xferPipe.OnPack(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the peer decompresses it with the filter registered by the same id
+	xferPipe.Reset()
+	xferPipe.Append('x')
+	src, err := xferPipe.OnUnpack(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(src, data) {
+		t.Fatal("unzstd has error: the data is changed")
+	}
+}
+
+func TestZstdMaxDecompressedBytes(t *testing.T) {
+	zstd.Reg('y', "zstd-limit", 3)
+	xferPipe := xfer.NewXferPipe()
+	xferPipe.Append('y')
+	src := make([]byte, 4<<20)
+	b, err := xferPipe.OnPack(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer xfer.SetMaxDecompressedBytes(xfer.MaxDecompressedBytes())
+	// the limit changed after the registration is applied
+	xfer.SetMaxDecompressedBytes(1 << 20)
+	if _, err = xferPipe.OnUnpack(b); err != xfer.ErrDecompressedTooLarge {
+		t.Fatalf("got error %v, want %v", err, xfer.ErrDecompressedTooLarge)
+	}
+	xfer.SetMaxDecompressedBytes(int64(len(src)))
+	dst, err := xferPipe.OnUnpack(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dst) != len(src) {
+		t.Fatalf("got %d bytes, want %d", len(dst), len(src))
+	}
+}